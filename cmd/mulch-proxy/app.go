@@ -20,11 +20,12 @@ import (
 
 // App describes an the application
 type App struct {
-	Config      *AppConfig
-	Log         *Log
-	ProxyServer *ProxyServer
-	APIServer   *APIServer
-	Rand        *rand.Rand
+	Config        *AppConfig
+	Log           *Log
+	ProxyServer   *ProxyServer
+	PortForwarder *PortForwarder
+	APIServer     *APIServer
+	Rand          *rand.Rand
 }
 
 // PSKHeaderName is the name of HTTP header for the PSK
@@ -80,6 +81,8 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 		DirectoryURL:          app.Config.AcmeURL,
 		DomainDB:              ddb,
 		ErrorHTMLTemplateFile: path.Clean(app.Config.configPath + "/templates/error_page.html"),
+		MaintenanceHTMLPath:   path.Clean(app.Config.configPath + "/templates"),
+		MaintenanceRetryAfter: app.Config.MaintenanceRetryAfter,
 		MulchdHTTPSDomain:     app.Config.ListenHTTPSDomain,
 		ChainMode:             app.Config.ChainMode,
 		ChainPSK:              app.Config.ChainPSK,
@@ -92,6 +95,12 @@ func NewApp(config *AppConfig, trace bool, debug bool) (*App, error) {
 
 	app.ProxyServer.RefreshReverseProxies()
 
+	app.PortForwarder = NewPortForwarder(path.Clean(app.Config.DataPath+"/mulch-proxy-ports.db"), app.Log)
+	err = app.PortForwarder.Reload()
+	if err != nil {
+		return nil, err
+	}
+
 	app.initSigHUPHandler()
 	app.initSigQUITHandler()
 
@@ -153,9 +162,13 @@ func (app *App) initSigHUPHandler() {
 	go func() {
 		for sig := range c {
 			if sig == syscall.SIGHUP {
-				app.Log.Infof("HUP Signal, reloading domains")
+				app.Log.Infof("HUP Signal, reloading domains and ports")
 				app.ProxyServer.ReloadDomains()
 				app.refreshDomains()
+				err := app.PortForwarder.Reload()
+				if err != nil {
+					app.Log.Errorf("reloading ports: %s", err)
+				}
 			}
 		}
 	}()
@@ -54,6 +54,9 @@ type AppConfig struct {
 	// Pre-Shared key for the chain
 	ChainPSK string
 
+	// Retry-After header value (seconds) for maintenance pages
+	MaintenanceRetryAfter int
+
 	// global mulchd configuration path
 	configPath string
 }
@@ -70,6 +73,8 @@ type tomlAppConfig struct {
 	ChainParentURL string `toml:"proxy_chain_parent_url"`
 	ChainChildURL  string `toml:"proxy_chain_child_url"`
 	ChainPSK       string `toml:"proxy_chain_psk"`
+
+	MaintenanceRetryAfter int `toml:"proxy_maintenance_retry_after"`
 }
 
 // NewAppConfigFromTomlFile return a AppConfig using
@@ -89,6 +94,8 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 		AcmeEmail:    "root@localhost.localdomain",
 		HTTPAddress:  ":80",
 		HTTPSAddress: ":443",
+
+		MaintenanceRetryAfter: 120,
 	}
 
 	meta, err := toml.DecodeFile(filename, tConfig)
@@ -123,6 +130,11 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 
 	appConfig.ListenHTTPSDomain = tConfig.ListenHTTPSDomain
 
+	if tConfig.MaintenanceRetryAfter < 0 {
+		return nil, fmt.Errorf("invalid proxy_maintenance_retry_after value (%d)", tConfig.MaintenanceRetryAfter)
+	}
+	appConfig.MaintenanceRetryAfter = tConfig.MaintenanceRetryAfter
+
 	switch tConfig.ChainMode {
 	case "":
 		appConfig.ChainMode = ChainModeNone
@@ -4,7 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"os"
+	"time"
 )
 
 var configPath = flag.String("path", "./etc/", "configuration path")
@@ -15,6 +17,9 @@ var configVersion = flag.Bool("version", false, "show version")
 func main() {
 	flag.Parse()
 
+	// used for canary selection
+	rand.Seed(time.Now().UnixNano())
+
 	if *configVersion == true {
 		fmt.Println(Version)
 		os.Exit(0)
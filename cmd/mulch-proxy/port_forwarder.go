@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// UDP "sessions" (client address → VM) are closed after this idle time
+const portUDPSessionTimeout = 2 * time.Minute
+
+// TCP connection timeout to the VM
+const portTCPDialTimeout = 10 * time.Second
+
+// PortForwarder publishes TCP/UDP ports of VMs (see mulchd 'ports' VM
+// setting). Ports database is written by mulchd, and follow active
+// revisions of VMs, so only destinations change during a rebuild.
+type PortForwarder struct {
+	filename  string
+	listeners map[string]*portListener
+	mutex     sync.Mutex
+	log       *Log
+}
+
+// a listening published port
+type portListener struct {
+	port     *common.Port
+	allowNet *net.IPNet
+	mutex    sync.Mutex
+	tcp      net.Listener
+	udp      *net.UDPConn
+	closed   bool
+	log      *Log
+}
+
+// NewPortForwarder creates a new PortForwarder, use Reload to
+// (re)open ports
+func NewPortForwarder(filename string, log *Log) *PortForwarder {
+	return &PortForwarder{
+		filename:  filename,
+		listeners: make(map[string]*portListener),
+		log:       log,
+	}
+}
+
+func (pf *PortForwarder) load() (map[string]*common.Port, error) {
+	ports := make(map[string]*common.Port)
+
+	// no mulchd nearby (ex: proxy chain parent), no ports
+	if common.PathExist(pf.filename) == false {
+		return ports, nil
+	}
+
+	f, err := os.Open(pf.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&ports)
+	if err != nil {
+		return nil, err
+	}
+	return ports, nil
+}
+
+// Reload ports database, opening new ports, closing removed ones and
+// updating destinations of others
+func (pf *PortForwarder) Reload() error {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	ports, err := pf.load()
+	if err != nil {
+		return err
+	}
+
+	for key, listener := range pf.listeners {
+		if _, exists := ports[key]; !exists {
+			pf.log.Infof("closing port %s", key)
+			listener.close()
+			delete(pf.listeners, key)
+		}
+	}
+
+	for key, port := range ports {
+		allowNet, err := portAllowNet(port.AllowFrom)
+		if err != nil {
+			pf.log.Errorf("port %s: %s", key, err)
+			continue
+		}
+
+		listener, exists := pf.listeners[key]
+		if exists {
+			listener.update(port, allowNet)
+			continue
+		}
+
+		listener = &portListener{
+			port:     port,
+			allowNet: allowNet,
+			log:      pf.log,
+		}
+		err = listener.listen()
+		if err != nil {
+			pf.log.Errorf("unable to open port %s: %s", key, err)
+			continue
+		}
+		pf.log.Infof("port %s published for %s", key, port.VMName)
+		pf.listeners[key] = listener
+	}
+
+	pf.log.Infof("refresh: %d port(s)", len(pf.listeners))
+	return nil
+}
+
+// IP or CIDR to *net.IPNet (nil if empty)
+func portAllowNet(allowFrom string) (*net.IPNet, error) {
+	if allowFrom == "" {
+		return nil, nil
+	}
+	_, ipNet, err := net.ParseCIDR(allowFrom)
+	if err == nil {
+		return ipNet, nil
+	}
+	ip := net.ParseIP(allowFrom)
+	if ip == nil {
+		return nil, err
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (pl *portListener) update(port *common.Port, allowNet *net.IPNet) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if pl.port.DestinationHost != port.DestinationHost || pl.port.DestinationPort != port.DestinationPort {
+		pl.log.Infof("port %s now forwarded to %s", port.Key(), port.VMName)
+	}
+	pl.port = port
+	pl.allowNet = allowNet
+}
+
+// returns destination address, or an empty string if the source
+// is not allowed
+func (pl *portListener) target(source net.Addr) string {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	if pl.allowNet != nil {
+		var ip net.IP
+		switch addr := source.(type) {
+		case *net.TCPAddr:
+			ip = addr.IP
+		case *net.UDPAddr:
+			ip = addr.IP
+		}
+		if ip == nil || !pl.allowNet.Contains(ip) {
+			return ""
+		}
+	}
+	return net.JoinHostPort(pl.port.DestinationHost, strconv.Itoa(pl.port.DestinationPort))
+}
+
+func (pl *portListener) isClosed() bool {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	return pl.closed
+}
+
+func (pl *portListener) close() {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	pl.closed = true
+	if pl.tcp != nil {
+		pl.tcp.Close()
+	}
+	if pl.udp != nil {
+		pl.udp.Close()
+	}
+}
+
+func (pl *portListener) listen() error {
+	address := ":" + strconv.Itoa(pl.port.PublicPort)
+
+	switch pl.port.Protocol {
+	case common.PortProtocolUDP:
+		udpAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return err
+		}
+		pl.udp, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		go pl.serveUDP()
+	default:
+		var err error
+		pl.tcp, err = net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		go pl.serveTCP()
+	}
+	return nil
+}
+
+func (pl *portListener) serveTCP() {
+	for {
+		conn, err := pl.tcp.Accept()
+		if err != nil {
+			if pl.isClosed() {
+				return
+			}
+			pl.log.Errorf("port %s: %s", pl.port.Key(), err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go pl.forwardTCP(conn)
+	}
+}
+
+func (pl *portListener) forwardTCP(conn net.Conn) {
+	defer conn.Close()
+
+	target := pl.target(conn.RemoteAddr())
+	if target == "" {
+		pl.log.Tracef("port %s: refused connection from %s", pl.port.Key(), conn.RemoteAddr())
+		return
+	}
+
+	dest, err := net.DialTimeout("tcp", target, portTCPDialTimeout)
+	if err != nil {
+		pl.log.Errorf("port %s: %s", pl.port.Key(), err)
+		return
+	}
+	defer dest.Close()
+
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(dest, conn)
+		done <- true
+	}()
+	go func() {
+		io.Copy(conn, dest)
+		done <- true
+	}()
+	// one side is finished, closing both connections (deferred)
+	<-done
+}
+
+func (pl *portListener) serveUDP() {
+	sessions := make(map[string]*net.UDPConn)
+	var sessionsMutex sync.Mutex
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, client, err := pl.udp.ReadFromUDP(buffer)
+		if err != nil {
+			if pl.isClosed() {
+				return
+			}
+			pl.log.Errorf("port %s: %s", pl.port.Key(), err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		target := pl.target(client)
+		if target == "" {
+			continue
+		}
+
+		sessionsMutex.Lock()
+		dest, exists := sessions[client.String()]
+		if !exists || dest.RemoteAddr().String() != target {
+			if exists {
+				dest.Close()
+			}
+			dest, err = pl.newUDPSession(client, target, func(conn *net.UDPConn) {
+				sessionsMutex.Lock()
+				defer sessionsMutex.Unlock()
+				if sessions[client.String()] == conn {
+					delete(sessions, client.String())
+				}
+			})
+			if err != nil {
+				sessionsMutex.Unlock()
+				pl.log.Errorf("port %s: %s", pl.port.Key(), err)
+				continue
+			}
+			sessions[client.String()] = dest
+		}
+		sessionsMutex.Unlock()
+
+		dest.SetReadDeadline(time.Now().Add(portUDPSessionTimeout))
+		_, err = dest.Write(buffer[:n])
+		if err != nil {
+			pl.log.Tracef("port %s: %s", pl.port.Key(), err)
+		}
+	}
+}
+
+// "connects" a UDP socket to the VM, replies are sent back to the client
+// until the session is idle
+func (pl *portListener) newUDPSession(client *net.UDPAddr, target string, onClose func(*net.UDPConn)) (*net.UDPConn, error) {
+	destAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := net.DialUDP("udp", nil, destAddr)
+	if err != nil {
+		return nil, err
+	}
+	dest.SetReadDeadline(time.Now().Add(portUDPSessionTimeout))
+
+	go func() {
+		defer dest.Close()
+		defer onClose(dest)
+		buffer := make([]byte, 64*1024)
+		for {
+			n, err := dest.Read(buffer)
+			if err != nil {
+				return
+			}
+			_, err = pl.udp.WriteToUDP(buffer[:n], client)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return dest, nil
+}
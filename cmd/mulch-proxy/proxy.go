@@ -6,10 +6,12 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -26,6 +28,12 @@ const (
 	ProtoHTTPS = "https"
 )
 
+// Canary sticky session cookie
+const (
+	CanaryCookieName   = "mulch_canary"
+	CanaryCookieMaxAge = 24 * 60 * 60
+)
+
 // ProxyServer describe a Mulch proxy server
 type ProxyServer struct {
 	DomainDB    *DomainDatabase
@@ -45,6 +53,8 @@ type ProxyServerParams struct {
 	DirectoryURL          string
 	DomainDB              *DomainDatabase
 	ErrorHTMLTemplateFile string
+	MaintenanceHTMLPath   string
+	MaintenanceRetryAfter int
 	MulchdHTTPSDomain     string // (for mulchd)
 	ChainMode             int
 	ChainPSK              string
@@ -72,17 +82,22 @@ func (rt *errorHandlingRoundTripper) RoundTrip(req *http.Request) (*http.Respons
 	tr := http.DefaultTransport
 	res, err := tr.RoundTrip(req)
 	if err != nil {
+		// upstream VM is probably restarting (rebuild, …), so it's
+		// a temporary unavailability
 		rt.ProxyServer.Log.Errorf("%s: %s", rt.Domain.Name, err)
-		body, errG := rt.ProxyServer.genErrorPage(502, err.Error())
+		body, errG := rt.ProxyServer.genMaintenancePage(rt.Domain)
 		if errG != nil {
-			rt.ProxyServer.Log.Errorf("Error with the error page: %s", errG)
+			rt.ProxyServer.Log.Errorf("Error with the maintenance page: %s", errG)
 		}
+		header := make(http.Header, 0)
+		header.Set("Retry-After", strconv.Itoa(rt.ProxyServer.config.MaintenanceRetryAfter))
+		header.Set("Cache-Control", "no-store")
 		return &http.Response{
-			StatusCode:    http.StatusBadGateway,
+			StatusCode:    http.StatusServiceUnavailable,
 			Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
 			ContentLength: int64(len(body)),
 			Request:       req,
-			Header:        make(http.Header, 0),
+			Header:        header,
 		}, nil
 	}
 	return res, err
@@ -151,6 +166,29 @@ func (proxy *ProxyServer) genErrorPage(code int, message string) (string, error)
 	return expanded, nil
 }
 
+// genMaintenancePage will use templates/maintenance_<vm-name>.html if it
+// exists, templates/maintenance.html otherwise
+func (proxy *ProxyServer) genMaintenancePage(domain *common.Domain) (string, error) {
+	filename := path.Clean(proxy.config.MaintenanceHTMLPath + "/maintenance_" + domain.VMBaseName + ".html")
+	if !common.PathExist(filename) {
+		filename = path.Clean(proxy.config.MaintenanceHTMLPath + "/maintenance.html")
+	}
+
+	htmlBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return proxy.genErrorPage(http.StatusServiceUnavailable, "maintenance in progress")
+	}
+	html := string(htmlBytes)
+
+	variables := make(map[string]interface{})
+	variables["DOMAIN"] = domain.Name
+	variables["RETRY_AFTER"] = strconv.Itoa(proxy.config.MaintenanceRetryAfter)
+
+	expanded := common.StringExpandVariables(html, variables)
+
+	return expanded, nil
+}
+
 func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 	if host == proxy.config.MulchdHTTPSDomain && proxy.config.MulchdHTTPSDomain != "" {
 		proxy.Log.Trace("hostPolicy OK for MulchdHTTPSDomain")
@@ -175,8 +213,62 @@ func (proxy *ProxyServer) hostPolicy(ctx context.Context, host string) error {
 // 	rw.WriteHeader(http.StatusBadGateway)
 // }
 
+// pickCanary returns the canary that will serve this request, or nil if the
+// request is for the main (active) VM. Choice is sticky, using a cookie.
+func (proxy *ProxyServer) pickCanary(domain *common.Domain, proto string, res http.ResponseWriter, req *http.Request) *common.DomainCanary {
+	if len(domain.Canaries) == 0 || domain.Chained == true {
+		return nil
+	}
+
+	cookie, err := req.Cookie(CanaryCookieName)
+	if err == nil {
+		if cookie.Value == domain.VMName {
+			return nil
+		}
+		for _, canary := range domain.Canaries {
+			if cookie.Value == canary.VMName {
+				return canary
+			}
+		}
+		// unknown revision (deleted canary?), let's choose again
+	}
+
+	var selected *common.DomainCanary
+	vmName := domain.VMName
+
+	draw := rand.Intn(100)
+	for _, canary := range domain.Canaries {
+		if draw < canary.Weight {
+			selected = canary
+			vmName = canary.VMName
+			break
+		}
+		draw -= canary.Weight
+	}
+
+	http.SetCookie(res, &http.Cookie{
+		Name:     CanaryCookieName,
+		Value:    vmName,
+		Path:     "/",
+		MaxAge:   CanaryCookieMaxAge,
+		HttpOnly: true,
+		Secure:   proto == ProtoHTTPS,
+	})
+
+	return selected
+}
+
 func (proxy *ProxyServer) serveReverseProxy(domain *common.Domain, proto string, res http.ResponseWriter, req *http.Request, fromParent bool) {
-	url, _ := url.Parse(domain.TargetURL)
+	targetURL := domain.TargetURL
+	reverseProxy := domain.ReverseProxy
+
+	canary := proxy.pickCanary(domain, proto, res, req)
+	if canary != nil {
+		targetURL = canary.TargetURL
+		reverseProxy = canary.ReverseProxy
+	}
+
+	url, _ := url.Parse(targetURL)
 
 	req.URL.Host = url.Host
 	req.URL.Scheme = url.Scheme
@@ -208,7 +300,7 @@ func (proxy *ProxyServer) serveReverseProxy(domain *common.Domain, proto string,
 		req.Header.Set("X-Real-Ip", ip)
 	}
 
-	domain.ReverseProxy.ServeHTTP(res, req)
+	reverseProxy.ServeHTTP(res, req)
 }
 
 func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Request) {
@@ -264,6 +356,19 @@ func (proxy *ProxyServer) handleRequest(res http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	// maintenance? (chained domains are handled by the child)
+	if domain.Maintenance == true && domain.Chained == false {
+		body, errG := proxy.genMaintenancePage(domain)
+		if errG != nil {
+			proxy.Log.Errorf("Error with the maintenance page: %s", errG)
+		}
+		res.Header().Set("Retry-After", strconv.Itoa(proxy.config.MaintenanceRetryAfter))
+		res.Header().Set("Cache-Control", "no-store")
+		res.WriteHeader(http.StatusServiceUnavailable)
+		res.Write([]byte(body))
+		return
+	}
+
 	// redirect to another URL?
 	if domain.RedirectTo != "" {
 		newURI := proto + "://" + domain.RedirectTo + req.URL.String()
@@ -312,33 +417,42 @@ func (proxy *ProxyServer) RefreshReverseProxies() {
 		}
 
 		if domain.Chained == false {
-			domain.TargetURL = fmt.Sprintf("http://%s:%d", domain.DestinationHost, domain.DestinationPort)
+			domain.TargetURL = "http://" + net.JoinHostPort(domain.DestinationHost, strconv.Itoa(domain.DestinationPort))
 		}
+		domain.ReverseProxy = proxy.newReverseProxy(domain, domain.TargetURL, domain.VMName)
 
-		pURL, _ := url.Parse(domain.TargetURL)
-		domain.ReverseProxy = httputil.NewSingleHostReverseProxy(pURL)
-
-		// domain.reverseProxy.ErrorHandler = reverseProxyErrorHandler
-		domain.ReverseProxy.ModifyResponse = func(resp *http.Response) (err error) {
-			if proxy.config.ChainMode != ChainModeParent {
-				resp.Header.Set("X-Mulch", domain.VMName)
-			}
+		for _, canary := range domain.Canaries {
+			canary.TargetURL = "http://" + net.JoinHostPort(canary.DestinationHost, strconv.Itoa(canary.DestinationPort))
+			canary.ReverseProxy = proxy.newReverseProxy(domain, canary.TargetURL, canary.VMName)
+		}
+		count++
+	}
+	proxy.Log.Infof("refresh: %d domain(s)", count)
+}
 
-			if proxy.config.Debug {
-				ctx := resp.Request.Context()
-				proxy.Log.Tracef("< {%d} %d", ctx.Value(contextKeyID), resp.StatusCode)
-			}
+func (proxy *ProxyServer) newReverseProxy(domain *common.Domain, targetURL string, vmName string) *httputil.ReverseProxy {
+	pURL, _ := url.Parse(targetURL)
+	reverseProxy := httputil.NewSingleHostReverseProxy(pURL)
 
-			return nil
+	// domain.reverseProxy.ErrorHandler = reverseProxyErrorHandler
+	reverseProxy.ModifyResponse = func(resp *http.Response) (err error) {
+		if proxy.config.ChainMode != ChainModeParent {
+			resp.Header.Set("X-Mulch", vmName)
 		}
-		domain.ReverseProxy.Transport = &errorHandlingRoundTripper{
-			ProxyServer: proxy,
-			Domain:      domain,
-			Log:         proxy.Log,
+
+		if proxy.config.Debug {
+			ctx := resp.Request.Context()
+			proxy.Log.Tracef("< {%d} %d", ctx.Value(contextKeyID), resp.StatusCode)
 		}
-		count++
+
+		return nil
 	}
-	proxy.Log.Infof("refresh: %d domain(s)", count)
+	reverseProxy.Transport = &errorHandlingRoundTripper{
+		ProxyServer: proxy,
+		Domain:      domain,
+		Log:         proxy.Log,
+	}
+	return reverseProxy
 }
 
 // ReloadDomains reload domains config file
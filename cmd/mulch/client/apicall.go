@@ -31,6 +31,7 @@ type API struct {
 	APIKey    string
 	Trace     bool
 	Time      bool
+	Project   string
 }
 
 // APICall describes a call to the API
@@ -45,26 +46,35 @@ type APICall struct {
 	DisableSpecialMessages bool
 	PrintLogTarget         bool
 	files                  map[string]string
+	fileRanges             map[string]fileRange
+}
+
+// part of a file to upload
+type fileRange struct {
+	offset int64
+	length int64
 }
 
 // NewAPI create a new API instance
-func NewAPI(server string, apiKey string, trace bool, time bool) *API {
+func NewAPI(server string, apiKey string, trace bool, time bool, project string) *API {
 	return &API{
 		ServerURL: server,
 		APIKey:    apiKey,
 		Trace:     trace,
 		Time:      time,
+		Project:   project,
 	}
 }
 
 // NewCall create a new APICall
 func (api *API) NewCall(method string, path string, args map[string]string) *APICall {
 	return &APICall{
-		api:    api,
-		Method: method,
-		Path:   path,
-		Args:   args,
-		files:  make(map[string]string),
+		api:        api,
+		Method:     method,
+		Path:       path,
+		Args:       args,
+		files:      make(map[string]string),
+		fileRanges: make(map[string]fileRange),
 	}
 }
 
@@ -90,6 +100,19 @@ func (call *APICall) AddFile(fieldname string, filename string) error {
 	return nil
 }
 
+// AddFileRange adds a part of a file to the request (chunked upload)
+func (call *APICall) AddFileRange(fieldname string, filename string, offset int64, length int64) error {
+	err := call.AddFile(fieldname, filename)
+	if err != nil {
+		return err
+	}
+	call.fileRanges[fieldname] = fileRange{
+		offset: offset,
+		length: length,
+	}
+	return nil
+}
+
 // Do the actual API call
 func (call *APICall) Do() {
 	method := strings.ToUpper(call.Method)
@@ -106,6 +129,9 @@ func (call *APICall) Do() {
 	if call.api.Trace == true {
 		data.Add("trace", "true")
 	}
+	if call.api.Project != "" {
+		data.Add("project", call.api.Project)
+	}
 
 	var req *http.Request
 
@@ -156,7 +182,14 @@ func (call *APICall) Do() {
 						log.Fatal(errM)
 					}
 					defer file.Close()
-					if _, err = io.Copy(ff, file); err != nil {
+					if fr, exists := call.fileRanges[field]; exists {
+						if _, err = file.Seek(fr.offset, io.SeekStart); err != nil {
+							log.Fatal(err)
+						}
+						if _, err = io.CopyN(ff, file, fr.length); err != nil {
+							log.Fatal(err)
+						}
+					} else if _, err = io.Copy(ff, file); err != nil {
 						log.Fatal(err)
 					}
 				}
@@ -8,6 +8,7 @@ type RootConfig struct {
 	Aliases map[string]string
 	Trace   bool
 	Time    bool
+	Project string
 }
 
 // ServerConfig describes a server (from config file)
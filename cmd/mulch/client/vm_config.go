@@ -0,0 +1,61 @@
+package client
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// AddVMConfigFile adds a VM config file to the request, with all its
+// local includes (URL includes are resolved by the server)
+func (call *APICall) AddVMConfigFile(fieldname string, filename string) error {
+	err := call.AddFile(fieldname, filename)
+	if err != nil {
+		return err
+	}
+	return call.addVMConfigIncludes(filename, "", make(map[string]bool))
+}
+
+// includes are sent with a key: their cleaned path, relative to the
+// main config file, so same-named files of different directories are
+// not mixed up (mulchd computes the same keys, see vmConfigIncludeKey)
+func (call *APICall) addVMConfigIncludes(filename string, key string, seen map[string]bool) error {
+	var conf struct {
+		Include []string `toml:"include"`
+	}
+	_, err := toml.DecodeFile(filename, &conf)
+	if err != nil {
+		return err
+	}
+
+	for _, include := range conf.Include {
+		if strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://") {
+			continue
+		}
+		includeKey := path.Clean(include)
+		if !path.IsAbs(includeKey) {
+			includeKey = path.Join(path.Dir(key), includeKey)
+		}
+		if seen[includeKey] {
+			continue
+		}
+		seen[includeKey] = true
+
+		includePath := include
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(filepath.Dir(filename), include)
+		}
+
+		err := call.AddFile("include:"+includeKey, includePath)
+		if err != nil {
+			return err
+		}
+		err = call.addVMConfigIncludes(includePath, includeKey, seen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
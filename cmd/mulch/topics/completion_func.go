@@ -57,6 +57,15 @@ __internal_list_seeds() {
     fi
 }
 
+__internal_list_secrets() {
+    local mulch_output out
+    __mulch_get_server
+    if mulch_output=$(mulch --server $__mulch_current_server secret list --basic 2>/dev/null); then
+        out=($(echo "${mulch_output}"))
+        COMPREPLY=( $( compgen -W "${out[*]}" -- "$cur" ) )
+    fi
+}
+
 __internal_doaction() {
 	local prev_prev=${COMP_WORDS[COMP_CWORD-2]}
     if [ "$prev" =  "do" ]; then
@@ -75,11 +84,11 @@ __mulch_get_servers() {
 
 __custom_func() {
     case ${last_command} in
-        mulch_vm_create)
+        mulch_vm_create | mulch_vm_check)
             __internal_list_toml_files
             return
             ;;
-        mulch_ssh | mulch_vm_backup | mulch_vm_config | mulch_vm_delete | mulch_vm_infos | mulch_vm_lock | mulch_vm_rebuild | mulch_vm_redefine | mulch_vm_start | mulch_vm_stop | mulch_vm_unlock | mulch_vm_activate | mulch_vm_deactivate | mulch_log)
+        mulch_ssh | mulch_vm_backup | mulch_vm_config | mulch_vm_delete | mulch_vm_infos | mulch_vm_config_history | mulch_vm_config_show | mulch_vm_scripts | mulch_vm_lock | mulch_vm_maintenance | mulch_vm_canary | mulch_vm_resize | mulch_vm_tune | mulch_vm_to_seed | mulch_vm_rebuild | mulch_vm_redefine | mulch_vm_start | mulch_vm_stop | mulch_vm_unlock | mulch_vm_activate | mulch_vm_deactivate | mulch_log)
             __internal_list_vms
             return
             ;;
@@ -95,10 +104,14 @@ __custom_func() {
             __internal_doaction
             return
             ;;
-        mulch_seed_status | mulch_seed_refresh)
+        mulch_seed_status | mulch_seed_refresh | mulch_seed_rollback | mulch_seed_delete)
             __internal_list_seeds
             return
             ;;
+        mulch_secret_set | mulch_secret_delete)
+            __internal_list_secrets
+            return
+            ;;
         *)
             ;;
     esac
@@ -83,10 +83,11 @@ func doListCB(reader io.Reader, headers http.Header) {
 				line.Name,
 				line.User,
 				line.Description,
+				line.Schedule,
 			})
 		}
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "User", "Description"})
+		table.SetHeader([]string{"Name", "User", "Description", "Schedule"})
 		table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 		table.SetColWidth(50)
 		table.SetCenterSeparator("|")
@@ -0,0 +1,102 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var doHistoryFlagOutput bool
+
+// doHistoryCmd represents the "do history" command
+var doHistoryCmd = &cobra.Command{
+	Use:   "history <vm-name> <action>",
+	Short: "Show past runs of a 'do action'",
+	Long: `Show past runs of a 'do action' (manual runs with 'mulch do' and runs
+scheduled by mulchd, see 'schedule' setting in [[do-actions]]), with
+exit status and output.
+
+Note: to run an action on a VM named "history", use:
+mulch do -- history <action>
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		doHistoryFlagOutput, _ = cmd.Flags().GetBool("output")
+		revision, _ := cmd.Flags().GetString("revision")
+
+		call := client.GlobalAPI.NewCall("GET", "/vm/do-history/"+args[0], map[string]string{
+			"do_action": args[1],
+			"revision":  revision,
+		})
+		call.JSONCallback = doHistoryCB
+		call.Do()
+	},
+}
+
+func doHistoryCB(reader io.Reader, headers http.Header) {
+	var data common.APIVMDoHistoryEntries
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No history for this action.\n")
+		return
+	}
+
+	if doHistoryFlagOutput {
+		for _, line := range data {
+			fmt.Printf("--- %s (exit status %d) ---\n", line.Start.Format("2006-01-02 15:04:05"), line.ExitStatus)
+			fmt.Print(line.Output)
+		}
+		return
+	}
+
+	red := color.New(color.FgHiRed).SprintFunc()
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	strData := [][]string{}
+	for _, line := range data {
+		status := green(strconv.Itoa(line.ExitStatus))
+		if line.Error != "" {
+			status = red(strconv.Itoa(line.ExitStatus))
+		}
+
+		trigger := "manual"
+		if line.Scheduled {
+			trigger = "schedule"
+		}
+
+		strData = append(strData, []string{
+			line.Start.Format("2006-01-02 15:04:05"),
+			trigger,
+			line.Duration.String(),
+			status,
+			line.Error,
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Date", "Trigger", "Duration", "Status", "Error"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	doCmd.AddCommand(doHistoryCmd)
+	doHistoryCmd.Flags().BoolP("output", "o", false, "show runs output")
+	doHistoryCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -16,6 +16,9 @@ your keys. It must not be duplicated.
 
 The key will be displayed by this command but will NOT be visible anymore
 after. The only option left will be to look at the daemon key database directly.
+
+With the global -p option, the key is bound to this project: it will only
+see and manage VMs, backups and keys of the project.
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
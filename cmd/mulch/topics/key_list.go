@@ -44,10 +44,11 @@ func keyListCB(reader io.Reader, headers http.Header) {
 	for _, line := range data {
 		strData = append(strData, []string{
 			line.Comment,
+			line.Project,
 		})
 	}
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Comment"})
+	table.SetHeader([]string{"Comment", "Project"})
 	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 	table.SetCenterSeparator("|")
 	table.AppendBulk(strData)
@@ -0,0 +1,17 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// quotaCmd represents the quota command
+var quotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "API keys quotas",
+	Long: `Show and set resource quotas of API keys (vCPUs, RAM, disk and
+backups used by VMs owned by a key).`,
+}
+
+func init() {
+	rootCmd.AddCommand(quotaCmd)
+}
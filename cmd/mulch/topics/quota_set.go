@@ -0,0 +1,50 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// quotaSetCmd represents the "quota set" command
+var quotaSetCmd = &cobra.Command{
+	Use:   "set <key-comment>",
+	Short: "Set quota of an API key",
+	Long: `Set quota of an API key. The whole quota is replaced: omitted
+resources are unlimited, and a quota without any resource is removed.
+
+Quotas are checked on VM creation, resize and backup. Keys with a
+quota can't set quotas or create keys.
+
+Examples:
+  mulch quota set team-a --cpu 16 --ram 32G --disk 500G --backups 20
+  mulch quota set team-a
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cpu, _ := cmd.Flags().GetInt("cpu")
+		ram, _ := cmd.Flags().GetString("ram")
+		disk, _ := cmd.Flags().GetString("disk")
+		backups, _ := cmd.Flags().GetInt("backups")
+
+		params := map[string]string{
+			"key":     args[0],
+			"cpu":     strconv.Itoa(cpu),
+			"ram":     ram,
+			"disk":    disk,
+			"backups": strconv.Itoa(backups),
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/quota", params)
+		call.Do()
+	},
+}
+
+func init() {
+	quotaCmd.AddCommand(quotaSetCmd)
+	quotaSetCmd.Flags().Int("cpu", 0, "vCPU count")
+	quotaSetCmd.Flags().String("ram", "", "RAM size (ex: 32G)")
+	quotaSetCmd.Flags().String("disk", "", "disk size (ex: 500G)")
+	quotaSetCmd.Flags().Int("backups", 0, "backup count")
+}
@@ -0,0 +1,77 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// quotaShowCmd represents the "quota show" command
+var quotaShowCmd = &cobra.Command{
+	Use:   "show [key-comment]",
+	Short: "Show quota and usage of an API key",
+	Long: `Show quota and usage of an API key (your key by default).
+
+Usage counts all revisions of VMs owned by the key (the key that
+created them) and backups made with the key.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		params := map[string]string{}
+		if len(args) == 1 {
+			params["key"] = args[0]
+		}
+		call := client.GlobalAPI.NewCall("GET", "/quota", params)
+		call.JSONCallback = quotaShowCB
+		call.Do()
+	},
+}
+
+func quotaShowCB(reader io.Reader, headers http.Header) {
+	var data common.APIQuota
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	count := func(value int) string {
+		return strconv.Itoa(value)
+	}
+	size := func(mb int) string {
+		return (datasize.ByteSize(mb) * datasize.MB).HR()
+	}
+	limit := func(value int, format func(int) string) string {
+		if value == 0 {
+			return "unlimited"
+		}
+		return format(value)
+	}
+
+	fmt.Printf("key: %s (%d VM(s))\n", data.Key, data.VMs)
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Resource", "Used", "Quota"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk([][]string{
+		{"vCPUs", count(data.CPUs), limit(data.CPUsMax, count)},
+		{"RAM", size(data.RAMMB), limit(data.RAMMBMax, size)},
+		{"disk", size(data.DiskMB), limit(data.DiskMBMax, size)},
+		{"backups", count(data.Backups), limit(data.BackupsMax, count)},
+	})
+	table.Render()
+}
+
+func init() {
+	quotaCmd.AddCommand(quotaShowCmd)
+}
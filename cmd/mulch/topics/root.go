@@ -52,6 +52,7 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("trace", "t", false, "also show server TRACE messages (debug)")
 	rootCmd.PersistentFlags().BoolP("time", "d", false, "show server timestamps on messages")
 	rootCmd.PersistentFlags().StringP("server", "s", "", "selected server in the config file")
+	rootCmd.PersistentFlags().StringP("project", "p", "", "limit to this project (VMs, backups, keys)")
 	rootCmd.PersistentFlags().BoolP("dump-servers", "", false, "dump server list and exit")
 
 	rootCmd.PersistentFlags().BoolP("dump-server", "", false, "dump current server name (useful for completion)")
@@ -103,8 +104,8 @@ First server is the default.
 
 Alias is optionnal but cool, see 'mulch help completion' for informations.
 
-Global settings: trace, time
-Note: you can also use environment variables (TRACE, TIME, SERVER).
+Global settings: trace, time, project
+Note: you can also use environment variables (TRACE, TIME, SERVER, PROJECT).
 `, cfgFile)
 		os.Exit(1)
 	}
@@ -114,6 +115,7 @@ Note: you can also use environment variables (TRACE, TIME, SERVER).
 		client.GlobalConfig.Server.Key,
 		client.GlobalConfig.Trace,
 		client.GlobalConfig.Time,
+		client.GlobalConfig.Project,
 	)
 
 	setCompletion()
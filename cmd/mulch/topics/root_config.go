@@ -19,6 +19,7 @@ type tomlServerConfig struct {
 type tomlRootConfig struct {
 	Trace   bool
 	Time    bool
+	Project string
 	Default string
 	Server  []*tomlServerConfig
 }
@@ -32,10 +33,12 @@ func NewRootConfig(filename string) (*client.RootConfig, error) {
 	envTrace, _ := strconv.ParseBool(os.Getenv("TRACE"))
 	envTime, _ := strconv.ParseBool(os.Getenv("TIME"))
 	envServer := os.Getenv("SERVER")
+	envProject := os.Getenv("PROJECT")
 
 	tConfig := &tomlRootConfig{
 		Trace:   envTrace,
 		Time:    envTime,
+		Project: envProject,
 		Default: envServer,
 	}
 
@@ -69,6 +72,7 @@ func NewRootConfig(filename string) (*client.RootConfig, error) {
 	flagTrace := rootCmd.PersistentFlags().Lookup("trace")
 	flagTime := rootCmd.PersistentFlags().Lookup("time")
 	flagServer := rootCmd.PersistentFlags().Lookup("server")
+	flagProject := rootCmd.PersistentFlags().Lookup("project")
 
 	if flagTrace.Changed {
 		trace, _ := strconv.ParseBool(flagTrace.Value.String())
@@ -79,6 +83,10 @@ func NewRootConfig(filename string) (*client.RootConfig, error) {
 		tConfig.Time = time
 	}
 
+	if flagProject.Changed {
+		tConfig.Project = flagProject.Value.String()
+	}
+
 	if flagServer.Changed {
 		tConfig.Default = flagServer.Value.String()
 	}
@@ -122,6 +130,7 @@ func NewRootConfig(filename string) (*client.RootConfig, error) {
 
 	rootConfig.Trace = tConfig.Trace
 	rootConfig.Time = tConfig.Time
+	rootConfig.Project = tConfig.Project
 
 	if rootCmd.PersistentFlags().Lookup("dump-servers").Changed {
 		for _, server := range tConfig.Server {
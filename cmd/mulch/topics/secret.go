@@ -0,0 +1,19 @@
+package topics
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// secretCmd represents the secret command
+var secretCmd = &cobra.Command{
+	Use:   "secret",
+	Short: "Secrets management",
+	Long: `Manage secrets stored (encrypted) by mulchd.
+
+Secrets are referenced in VM configs env values using ${secret:name}, and
+resolved only when the VM is built.`,
+}
+
+func init() {
+	rootCmd.AddCommand(secretCmd)
+}
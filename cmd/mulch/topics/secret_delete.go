@@ -0,0 +1,26 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// secretDeleteCmd represents the "secret delete" command
+var secretDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete a secret",
+	Long: `Delete a secret. A secret used by a VM can't be deleted.
+
+See 'secret list' to get secret names.
+`,
+	Args:    cobra.ExactArgs(1),
+	Aliases: []string{"remove"},
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("DELETE", "/secret/"+args[0], map[string]string{})
+		call.Do()
+	},
+}
+
+func init() {
+	secretCmd.AddCommand(secretDeleteCmd)
+}
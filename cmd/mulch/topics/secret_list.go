@@ -0,0 +1,80 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+var secretListFlagBasic bool
+
+// secretListCmd represents the "secret list" command
+var secretListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List secrets",
+	Long:  `List secrets (values are never shown).`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		secretListFlagBasic, _ = cmd.Flags().GetBool("basic")
+		if secretListFlagBasic == true {
+			client.GetExitMessage().Disable()
+		}
+
+		call := client.GlobalAPI.NewCall("GET", "/secret", map[string]string{})
+		call.JSONCallback = secretListCB
+		call.Do()
+	},
+}
+
+func secretListCB(reader io.Reader, headers http.Header) {
+	var data common.APISecretListEntries
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if secretListFlagBasic {
+		for _, line := range data {
+			fmt.Println(line.Name)
+		}
+		return
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No secret found. See 'secret set'.\n")
+		return
+	}
+
+	strData := [][]string{}
+	for _, line := range data {
+		strData = append(strData, []string{
+			line.Name,
+			line.Project,
+			line.Modified.Format(time.RFC3339),
+			line.AuthorKey,
+			strings.Join(line.UsedBy, ", "),
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Name", "Project", "Modified", "Author", "Used by"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	secretCmd.AddCommand(secretListCmd)
+	secretListCmd.Flags().BoolP("basic", "b", false, "show basic list, without any formating")
+}
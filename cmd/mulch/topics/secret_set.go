@@ -0,0 +1,64 @@
+package topics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// secretSetCmd represents the "secret set" command
+var secretSetCmd = &cobra.Command{
+	Use:   "set <name> [value]",
+	Short: "Create or update a secret",
+	Long: `Create or update a secret. If no value is given, it's read from
+standard input (prompted without echo on a terminal), so it does
+not end in your shell history.
+
+Secrets belong to a project (project of the key, or -p option), and
+are only available to VMs of this project. Secrets created without
+project are only available to VMs without project.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var value string
+		if len(args) == 2 {
+			value = args[1]
+		} else {
+			value = secretReadValue()
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/secret", map[string]string{
+			"name":  args[0],
+			"value": value,
+		})
+		call.Do()
+	},
+}
+
+func secretReadValue() string {
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Print("value: ")
+		value, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return string(value)
+	}
+
+	value, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return strings.TrimRight(string(value), "\r\n")
+}
+
+func init() {
+	secretCmd.AddCommand(secretSetCmd)
+}
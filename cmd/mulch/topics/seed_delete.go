@@ -0,0 +1,26 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// seedDeleteCmd represents the "seed delete" command
+var seedDeleteCmd = &cobra.Command{
+	Use:   "delete <seed-name>",
+	Short: "Delete an uploaded seed",
+	Long: `Delete an uploaded seed and all its versions.
+
+Seeds defined in mulchd configuration must be removed from the
+configuration file instead.`,
+	Args:    cobra.ExactArgs(1),
+	Aliases: []string{"remove"},
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("DELETE", "/seed/"+args[0], map[string]string{})
+		call.Do()
+	},
+}
+
+func init() {
+	seedCmd.AddCommand(seedDeleteCmd)
+}
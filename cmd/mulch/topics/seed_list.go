@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
@@ -58,21 +59,28 @@ func seedsCB(reader io.Reader, headers http.Header) {
 		strData := [][]string{}
 		red := color.New(color.FgHiRed).SprintFunc()
 		green := color.New(color.FgHiGreen).SprintFunc()
-		for _, line := range data {
+		for _, item := range seedListTree(data) {
+			line := item.entry
 			state := red("not-ready")
 			if line.Ready == true {
 				state = green("ready")
 			}
 
+			name := line.Name
+			if item.depth > 0 {
+				name = strings.Repeat("  ", item.depth-1) + "└─ " + name
+			}
+
 			strData = append(strData, []string{
-				line.Name,
+				name,
 				state,
 				line.LastModified.Format(time.RFC3339),
 				(datasize.ByteSize(line.Size) * datasize.B).HR(),
+				strings.Join(line.UsedBy, ", "),
 			})
 		}
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Ready", "Image date", "Size"})
+		table.SetHeader([]string{"Name", "Ready", "Image date", "Size", "Used by"})
 		table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 		table.SetCenterSeparator("|")
 		table.AppendBulk(strData)
@@ -80,6 +88,52 @@ func seedsCB(reader io.Reader, headers http.Header) {
 	}
 }
 
+type seedListTreeItem struct {
+	entry common.APISeedListEntry
+	depth int
+}
+
+// seedListTree orders seeds as a tree (children after their parent)
+func seedListTree(data common.APISeedListEntries) []seedListTreeItem {
+	exists := make(map[string]bool)
+	for _, line := range data {
+		exists[line.Name] = true
+	}
+
+	children := make(map[string][]common.APISeedListEntry)
+	var roots []common.APISeedListEntry
+	for _, line := range data {
+		if line.Parent == "" || !exists[line.Parent] || line.Parent == line.Name {
+			roots = append(roots, line)
+			continue
+		}
+		children[line.Parent] = append(children[line.Parent], line)
+	}
+
+	var items []seedListTreeItem
+	seen := make(map[string]bool)
+	var walk func(line common.APISeedListEntry, depth int)
+	walk = func(line common.APISeedListEntry, depth int) {
+		if seen[line.Name] {
+			return
+		}
+		seen[line.Name] = true
+		items = append(items, seedListTreeItem{entry: line, depth: depth})
+		for _, child := range children[line.Name] {
+			walk(child, depth+1)
+		}
+	}
+	for _, line := range roots {
+		walk(line, 0)
+	}
+
+	// seeds in a dependency cycle
+	for _, line := range data {
+		walk(line, 0)
+	}
+	return items
+}
+
 func init() {
 	seedCmd.AddCommand(seedListCmd)
 	seedListCmd.Flags().BoolP("basic", "b", false, "show basic list, without any formating")
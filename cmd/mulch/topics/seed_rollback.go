@@ -0,0 +1,27 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// seedRollbackCmd represents the "seed rollback" command
+var seedRollbackCmd = &cobra.Command{
+	Use:   "rollback <seed-name>",
+	Short: "Rollback a seed to its previous version",
+	Long: `Replace the current image of a seed with the previous kept version.
+
+For URL seeds, the refused upstream image will not be downloaded again
+by automatic refreshes (only by a forced 'seed refresh').`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/seed/"+args[0], map[string]string{
+			"action": "rollback",
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	seedCmd.AddCommand(seedRollbackCmd)
+}
@@ -0,0 +1,89 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+	"github.com/spf13/cobra"
+)
+
+// images are sent in chunks, so a failed upload can be resumed
+const seedUploadChunkSize = 64 * 1024 * 1024
+
+// seedUploadCmd represents the "seed upload" command
+var seedUploadCmd = &cobra.Command{
+	Use:   "upload <seed-name> <image.qcow2>",
+	Short: "Upload a custom seed image",
+	Long: `Upload a qcow2 image as a new seed (or a new version of an uploaded seed).
+
+If the upload is interrupted, run the same command again with --resume.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		seedName := args[0]
+		filename := args[1]
+		resume, _ := cmd.Flags().GetBool("resume")
+
+		stat, err := os.Stat(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		total := stat.Size()
+
+		var offset int64
+		if resume {
+			call := client.GlobalAPI.NewCall("GET", "/seed/"+seedName, map[string]string{})
+			call.JSONCallback = func(reader io.Reader, headers http.Header) {
+				var data common.APISeedStatus
+				dec := json.NewDecoder(reader)
+				err := dec.Decode(&data)
+				if err != nil {
+					log.Fatal(err.Error())
+				}
+				offset = data.UploadOffset
+			}
+			call.Do()
+			fmt.Printf("resuming upload at %s\n", (datasize.ByteSize(offset) * datasize.B).HR())
+		}
+
+		for {
+			length := int64(seedUploadChunkSize)
+			if offset+length > total {
+				length = total - offset
+			}
+
+			call := client.GlobalAPI.NewCall("POST", "/seed", map[string]string{
+				"name":   seedName,
+				"offset": strconv.FormatInt(offset, 10),
+				"total":  strconv.FormatInt(total, 10),
+			})
+			err := call.AddFileRange("file", filename, offset, length)
+			if err != nil {
+				log.Fatal(err)
+			}
+			call.Do()
+
+			offset += length
+			if offset >= total {
+				break
+			}
+			fmt.Printf("uploaded %s / %s (%d%%)\n",
+				(datasize.ByteSize(offset) * datasize.B).HR(),
+				(datasize.ByteSize(total) * datasize.B).HR(),
+				offset*100/total,
+			)
+		}
+	},
+}
+
+func init() {
+	seedCmd.AddCommand(seedUploadCmd)
+	seedUploadCmd.Flags().BoolP("resume", "r", false, "resume an interrupted upload")
+}
@@ -0,0 +1,42 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmCanaryCmd represents the "vm canary" command
+var vmCanaryCmd = &cobra.Command{
+	Use:   "canary <vm-name>",
+	Short: "Send a part of the traffic to another VM revision",
+	Long: `Send a part of the traffic (weight, in %) of the active VM revision
+to an inactive revision. Visitors will stick to the same revision (cookie).
+
+Use a weight of 0 to disable the canary, or 'vm activate' to promote it.
+
+Example:
+  mulch vm canary myvm --revision 5 --weight 10
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		weight, _ := cmd.Flags().GetInt("weight")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":   "canary",
+			"revision": revision,
+			"weight":   strconv.Itoa(weight),
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmCanaryCmd)
+	vmCanaryCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmCanaryCmd.Flags().IntP("weight", "w", 10, "traffic weight (%)")
+	vmCanaryCmd.MarkFlagRequired("revision")
+}
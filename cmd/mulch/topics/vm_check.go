@@ -0,0 +1,35 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmCheckCmd represents the "vm check" command
+var vmCheckCmd = &cobra.Command{
+	Use:   "check <config.toml>",
+	Short: "Check a VM config file (dry-run)",
+	Long: `Check a VM description file without creating anything: config
+validity, script reachability, seed readiness, domain conflicts and
+host capacity.
+
+See 'vm redefine --diff' to see what a new config will change for an
+existing VM.
+`,
+	Args:    cobra.ExactArgs(1),
+	Aliases: []string{"plan"},
+	Run: func(cmd *cobra.Command, args []string) {
+		call := client.GlobalAPI.NewCall("POST", "/vm-check", map[string]string{})
+		err := call.AddVMConfigFile("config", args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmCheckCmd)
+}
@@ -1,6 +1,8 @@
 package topics
 
 import (
+	"strconv"
+
 	"github.com/OnitiFR/mulch/cmd/mulch/client"
 	"github.com/spf13/cobra"
 )
@@ -11,13 +13,19 @@ var vmConfigCmd = &cobra.Command{
 	Short: "Get config of a VM",
 	Long: `Return the config file used for VM creation.
 
+Use --expanded to get the config with all includes resolved.
+
+See 'vm config history' and 'vm config show' for previous versions.
+
 See 'vm list' for VM Names.
 `,
 	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		revision, _ := cmd.Flags().GetString("revision")
+		expanded, _ := cmd.Flags().GetBool("expanded")
 		call := client.GlobalAPI.NewCall("GET", "/vm/config/"+args[0], map[string]string{
 			"revision": revision,
+			"expanded": strconv.FormatBool(expanded),
 		})
 		call.Do()
 	},
@@ -26,4 +34,5 @@ See 'vm list' for VM Names.
 func init() {
 	vmCmd.AddCommand(vmConfigCmd)
 	vmConfigCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmConfigCmd.Flags().BoolP("expanded", "e", false, "show config with includes resolved")
 }
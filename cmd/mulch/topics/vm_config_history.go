@@ -0,0 +1,80 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// vmConfigHistoryCmd represents the "vm config history" command
+var vmConfigHistoryCmd = &cobra.Command{
+	Use:   "history <vm-name>",
+	Short: "Show config versions of a VM",
+	Long: `Show all versions of the VM config (one per create or redefine),
+with author and message.
+
+See 'vm config show --version' to get a version, and
+'vm redefine --to-version' to go back to it.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("GET", "/vm/config-history/"+args[0], map[string]string{
+			"revision": revision,
+		})
+		call.JSONCallback = vmConfigHistoryCB
+		call.Do()
+	},
+}
+
+func vmConfigHistoryCB(reader io.Reader, headers http.Header) {
+	var data common.APIVMConfigVersionEntries
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No config history for this VM.\n")
+		return
+	}
+
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	strData := [][]string{}
+	for _, line := range data {
+		version := strconv.Itoa(line.Version)
+		if line.Current {
+			version = green(version + "*")
+		}
+
+		strData = append(strData, []string{
+			version,
+			line.Date.Format("2006-01-02 15:04:05"),
+			line.AuthorKey,
+			line.Message,
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Version", "Date", "Author", "Message"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	vmConfigCmd.AddCommand(vmConfigHistoryCmd)
+	vmConfigHistoryCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -0,0 +1,36 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmConfigShowCmd represents the "vm config show" command
+var vmConfigShowCmd = &cobra.Command{
+	Use:   "show <vm-name>",
+	Short: "Show a version of a VM config",
+	Long: `Return a specific version of the VM config file (see 'vm config history'
+for versions), or the current one if no version is given.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		expanded, _ := cmd.Flags().GetBool("expanded")
+		version, _ := cmd.Flags().GetString("version")
+		call := client.GlobalAPI.NewCall("GET", "/vm/config/"+args[0], map[string]string{
+			"revision": revision,
+			"expanded": strconv.FormatBool(expanded),
+			"version":  version,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmConfigCmd.AddCommand(vmConfigShowCmd)
+	vmConfigShowCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmConfigShowCmd.Flags().BoolP("expanded", "e", false, "show config with includes resolved")
+	vmConfigShowCmd.Flags().StringP("version", "v", "", "config version")
+}
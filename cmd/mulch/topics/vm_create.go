@@ -28,6 +28,7 @@ from another VM (-R).
 		inactive, _ := cmd.Flags().GetBool("inactive")
 		keepOnFailure, _ := cmd.Flags().GetBool("keep-on-failure")
 		lock, _ := cmd.Flags().GetBool("lock")
+		message, _ := cmd.Flags().GetString("message")
 
 		call := client.GlobalAPI.NewCall("POST", "/vm", map[string]string{
 			"restore":            restore,
@@ -36,8 +37,9 @@ from another VM (-R).
 			"inactive":           strconv.FormatBool(inactive),
 			"keep_on_failure":    strconv.FormatBool(keepOnFailure),
 			"lock":               strconv.FormatBool(lock),
+			"message":            message,
 		})
-		err := call.AddFile("config", args[0])
+		err := call.AddVMConfigFile("config", args[0])
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -58,4 +60,5 @@ func init() {
 	vmCreateCmd.Flags().BoolP("inactive", "i", false, "do not set this instance as active")
 	vmCreateCmd.Flags().BoolP("keep-on-failure", "k", false, "keep VM on script failure (useful for debug)")
 	vmCreateCmd.Flags().BoolP("lock", "l", false, "lock VM after creation")
+	vmCreateCmd.Flags().StringP("message", "m", "", "message for the first config version")
 }
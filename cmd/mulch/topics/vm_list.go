@@ -72,21 +72,35 @@ func vmListCB(reader io.Reader, headers http.Header) {
 				locked = yellow("locked")
 			}
 
+			health := line.Health
+			switch line.Health {
+			case "healthy":
+				health = green(line.Health)
+			case "unhealthy":
+				health = red(line.Health)
+			}
+
 			name := line.Name
 			if line.Active == false {
 				name = grey(name)
 			}
 
+			revision := strconv.Itoa(line.Revision)
+			if line.Canary > 0 {
+				revision += yellow(fmt.Sprintf(" (canary %d%%)", line.Canary))
+			}
+
 			strData = append(strData, []string{
 				name,
-				strconv.Itoa(line.Revision),
+				revision,
 				state,
 				locked,
+				health,
 				yellow(line.WIP),
 			})
 		}
 		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Rev", "State", "Locked", "Operation"})
+		table.SetHeader([]string{"Name", "Rev", "State", "Locked", "Health", "Operation"})
 		table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
 		table.SetCenterSeparator("|")
 		table.AppendBulk(strData)
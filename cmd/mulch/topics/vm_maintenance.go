@@ -0,0 +1,47 @@
+package topics
+
+import (
+	"log"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmMaintenanceCmd represents the "vm maintenance" command
+var vmMaintenanceCmd = &cobra.Command{
+	Use:   "maintenance <vm-name> on|off",
+	Short: "Enable/disable VM maintenance mode",
+	Long: `Enable or disable maintenance mode for a VM (by its name). In
+maintenance mode, the reverse proxy will serve a maintenance page (HTTP 503)
+for all VM domains.
+
+Maintenance mode is also enabled automatically during VM rebuilds.
+
+See 'vm list' for VM Names.
+`,
+	Args:      cobra.ExactArgs(2),
+	ValidArgs: []string{"on", "off"},
+	Run: func(cmd *cobra.Command, args []string) {
+		var action string
+		switch args[1] {
+		case "on":
+			action = "maintenance-on"
+		case "off":
+			action = "maintenance-off"
+		default:
+			log.Fatalf("invalid mode '%s' (on or off)", args[1])
+		}
+
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":   action,
+			"revision": revision,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmMaintenanceCmd)
+	vmMaintenanceCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -10,7 +10,7 @@ import (
 
 // vmRedefineCmd represents the "vm redefine" command
 var vmRedefineCmd = &cobra.Command{
-	Use:   "redefine <vm-name> <config.toml>",
+	Use:   "redefine <vm-name> [config.toml]",
 	Short: "Redefine a VM",
 	Long: `Redefine ("update") an existing VM with a new configuration file.
 
@@ -22,20 +22,38 @@ not match your old content, for instance.
 
 Remember: you can get current VM configuration file using "vm config <vm-name>",
 it's an easy way to modify config before VM redefinition.
+
+Use --to-version to go back to a previous config version (see
+'vm config history'), and --message to explain your change.
+
+Use --diff to check the new configuration and see what will change
+(resources, domains, scripts, env, do-actions) without redefining the VM.
 `,
-	Args: cobra.ExactArgs(2),
+	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
 		force, _ := cmd.Flags().GetBool("force")
 		revision, _ := cmd.Flags().GetString("revision")
+		diff, _ := cmd.Flags().GetBool("diff")
+		toVersion, _ := cmd.Flags().GetString("to-version")
+		message, _ := cmd.Flags().GetString("message")
+
+		if (len(args) == 2) == (toVersion != "") {
+			log.Fatal("a config file or --to-version is needed (but not both)")
+		}
 
 		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
-			"action":   "redefine",
-			"force":    strconv.FormatBool(force),
-			"revision": revision,
+			"action":     "redefine",
+			"force":      strconv.FormatBool(force),
+			"revision":   revision,
+			"diff":       strconv.FormatBool(diff),
+			"to_version": toVersion,
+			"message":    message,
 		})
-		err := call.AddFile("config", args[1])
-		if err != nil {
-			log.Fatal(err)
+		if len(args) == 2 {
+			err := call.AddVMConfigFile("config", args[1])
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 		call.Do()
 	},
@@ -45,4 +63,7 @@ func init() {
 	vmCmd.AddCommand(vmRedefineCmd)
 	vmRedefineCmd.Flags().BoolP("force", "f", false, "force redefine on a locked VM")
 	vmRedefineCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmRedefineCmd.Flags().BoolP("diff", "", false, "show changes only, don't redefine")
+	vmRedefineCmd.Flags().StringP("to-version", "", "", "go back to this config version")
+	vmRedefineCmd.Flags().StringP("message", "m", "", "reason of the change (kept in config history)")
 }
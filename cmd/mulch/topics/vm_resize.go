@@ -0,0 +1,55 @@
+package topics
+
+import (
+	"strconv"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmResizeCmd represents the "vm resize" command
+var vmResizeCmd = &cobra.Command{
+	Use:   "resize <vm-name>",
+	Short: "Change CPU, RAM or disk size of a VM, without rebuild",
+	Long: `Change vCPU count, RAM size or system disk size of a VM. Changes are
+applied live when possible (vCPU hotplug, memory balloon, disk resize and
+in-guest filesystem growth), others are applied on next VM start (you will
+be warned). VM config is updated, so the next rebuild will be consistent.
+
+Disk can only grow. Use a '+' prefix for a relative size.
+
+Examples:
+  mulch vm resize myvm --ram 4G --cpu 2
+  mulch vm resize myvm --disk +10G
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		cpu, _ := cmd.Flags().GetInt("cpu")
+		ram, _ := cmd.Flags().GetString("ram")
+		disk, _ := cmd.Flags().GetString("disk")
+
+		params := map[string]string{
+			"action":   "resize",
+			"revision": revision,
+			"ram":      ram,
+			"disk":     disk,
+		}
+		if cpu > 0 {
+			params["cpu"] = strconv.Itoa(cpu)
+		}
+
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], params)
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmResizeCmd)
+	vmResizeCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmResizeCmd.Flags().Int("cpu", 0, "vCPU count")
+	vmResizeCmd.Flags().String("ram", "", "RAM size (ex: 4G)")
+	vmResizeCmd.Flags().String("disk", "", "system disk size (ex: 30G or +10G)")
+}
@@ -0,0 +1,87 @@
+package topics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+)
+
+// vmScriptsCmd represents the "vm scripts" command
+var vmScriptsCmd = &cobra.Command{
+	Use:   "scripts <vm-name>",
+	Short: "Show script revisions used by a VM",
+	Long: `Show the exact revision (SHA256) of each script run in the VM
+(prepare, install, backup, restore), and whether it was pinned in the
+config file using the 'user@script.sh#sha256=…' syntax. For git sources,
+the resolved commit is also shown.
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("GET", "/vm/scripts/"+args[0], map[string]string{
+			"revision": revision,
+		})
+		call.JSONCallback = vmScriptsCB
+		call.Do()
+	},
+}
+
+func vmScriptsCB(reader io.Reader, headers http.Header) {
+	var data common.APIVMScriptEntries
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&data)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if len(data) == 0 {
+		fmt.Printf("No script revision recorded for this VM.\n")
+		return
+	}
+
+	green := color.New(color.FgHiGreen).SprintFunc()
+
+	strData := [][]string{}
+	for _, line := range data {
+		pinned := ""
+		if line.Pinned {
+			pinned = green("yes")
+		}
+
+		commit := line.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+
+		strData = append(strData, []string{
+			line.Step,
+			line.As + "@" + line.URL,
+			line.SHA256,
+			commit,
+			pinned,
+			line.Date.Format("2006-01-02 15:04:05"),
+		})
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Step", "Script", "SHA256", "Commit", "Pinned", "Date"})
+	table.SetBorders(tablewriter.Border{Left: true, Top: false, Right: true, Bottom: false})
+	table.SetCenterSeparator("|")
+	table.AppendBulk(strData)
+	table.Render()
+}
+
+func init() {
+	vmCmd.AddCommand(vmScriptsCmd)
+	vmScriptsCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -0,0 +1,36 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// vmToSeedCmd represents the "vm to-seed" command
+var vmToSeedCmd = &cobra.Command{
+	Use:   "to-seed <vm-name> <seed-name>",
+	Short: "Capture a VM as a new seed",
+	Long: `Copy the disk of a VM to a new seed (or a new version of an
+uploaded seed). The VM is stopped during the copy and restarted, then
+the image is generalized (cloud-init state, SSH host keys, machine-id)
+using the to-seed.sh template.
+
+The server needs virt-customize (libguestfs-tools).
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], map[string]string{
+			"action":   "to-seed",
+			"seed":     args[1],
+			"revision": revision,
+		})
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmToSeedCmd)
+	vmToSeedCmd.Flags().StringP("revision", "r", "", "revision number")
+}
@@ -0,0 +1,66 @@
+package topics
+
+import (
+	"github.com/OnitiFR/mulch/cmd/mulch/client"
+	"github.com/spf13/cobra"
+)
+
+// VM limits flags, and related VM config settings
+var vmTuneFlags = map[string]string{
+	"cpu-shares":       "cpu_shares",
+	"cpu-quota":        "cpu_quota",
+	"disk-read-bytes":  "disk_read_bytes_sec",
+	"disk-write-bytes": "disk_write_bytes_sec",
+	"disk-read-iops":   "disk_read_iops_sec",
+	"disk-write-iops":  "disk_write_iops_sec",
+	"net-in":           "net_inbound_sec",
+	"net-out":          "net_outbound_sec",
+}
+
+// vmTuneCmd represents the "vm tune" command
+var vmTuneCmd = &cobra.Command{
+	Use:   "tune <vm-name>",
+	Short: "Change resource limits of a VM",
+	Long: `Change CPU, disk IO and network limits of a VM, live if the VM is
+running. Only given limits are changed, use 0 to remove a limit. VM config
+is updated, so the next rebuild will be consistent.
+
+See 'vm infos' for current limits.
+
+Examples:
+  mulch vm tune myvm --cpu-shares 512 --cpu-quota 50
+  mulch vm tune myvm --disk-write-bytes 20MB --disk-write-iops 500
+  mulch vm tune myvm --net-out 0
+
+See 'vm list' for VM Names.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revision, _ := cmd.Flags().GetString("revision")
+		params := map[string]string{
+			"action":   "tune",
+			"revision": revision,
+		}
+		for flag, setting := range vmTuneFlags {
+			if cmd.Flags().Changed(flag) {
+				value, _ := cmd.Flags().GetString(flag)
+				params["limit:"+setting] = value
+			}
+		}
+		call := client.GlobalAPI.NewCall("POST", "/vm/"+args[0], params)
+		call.Do()
+	},
+}
+
+func init() {
+	vmCmd.AddCommand(vmTuneCmd)
+	vmTuneCmd.Flags().StringP("revision", "r", "", "revision number")
+	vmTuneCmd.Flags().String("cpu-shares", "", "CPU relative weight (default: 1024)")
+	vmTuneCmd.Flags().String("cpu-quota", "", "CPU quota (% of each vCPU)")
+	vmTuneCmd.Flags().String("disk-read-bytes", "", "disk read limit (per second, ex: 50MB)")
+	vmTuneCmd.Flags().String("disk-write-bytes", "", "disk write limit (per second, ex: 20MB)")
+	vmTuneCmd.Flags().String("disk-read-iops", "", "disk read IOPS limit")
+	vmTuneCmd.Flags().String("disk-write-iops", "", "disk write IOPS limit")
+	vmTuneCmd.Flags().String("net-in", "", "network inbound limit (per second, ex: 10MB)")
+	vmTuneCmd.Flags().String("net-out", "", "network outbound limit (per second, ex: 5MB)")
+}
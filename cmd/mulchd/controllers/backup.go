@@ -19,7 +19,7 @@ func ListBackupsController(req *server.Request) {
 	req.Response.Header().Set("Content-Type", "application/json")
 	backupNames := req.App.BackupsDB.GetNames()
 
-	vmFilter := req.HTTP.FormValue("vm")
+	vmFilter := req.VMName(req.HTTP.FormValue("vm"))
 
 	if vmFilter != "" {
 		if req.App.VMDB.GetCountForName(vmFilter) == 0 {
@@ -44,6 +44,10 @@ func ListBackupsController(req *server.Request) {
 			continue
 		}
 
+		if !req.InProject(backup.VM.Config.Project) {
+			continue
+		}
+
 		infos, err := req.App.Libvirt.VolumeInfos(backupName, req.App.Libvirt.Pools.Backups)
 		if err != nil {
 			req.App.Log.Error(err.Error())
@@ -75,7 +79,7 @@ func ListBackupsController(req *server.Request) {
 
 func deleteBackup(backupName string, req *server.Request) error {
 	backup := req.App.BackupsDB.GetByName(backupName)
-	if backup == nil {
+	if backup == nil || !req.InProject(backup.VM.Config.Project) {
 		return fmt.Errorf("backup '%s' not found in database", backupName)
 	}
 
@@ -141,7 +145,7 @@ func DownloadBackupController(req *server.Request) {
 	}
 
 	backup := req.App.BackupsDB.GetByName(backupName)
-	if backup == nil {
+	if backup == nil || !req.InProject(backup.VM.Config.Project) {
 		errB := fmt.Errorf("backup '%s' not found in database", backupName)
 		req.App.Log.Error(errB.Error())
 		http.Error(req.Response, errB.Error(), 500)
@@ -216,7 +220,9 @@ func UploadBackupController(req *server.Request) {
 		Created:   time.Now(),
 		AuthorKey: req.APIKey.Comment,
 		VM: &server.VM{
-			Config: &server.VMConfig{},
+			Config: &server.VMConfig{
+				Project: req.Project(),
+			},
 		},
 	}
 
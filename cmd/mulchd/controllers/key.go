@@ -17,9 +17,13 @@ func ListKeysController(req *server.Request) {
 
 	var retData common.APIKeyListEntries
 	for _, key := range keys {
+		if !req.InProject(key.Project) {
+			continue
+		}
 
 		retData = append(retData, common.APIKeyListEntry{
 			Comment: key.Comment,
+			Project: key.Project,
 		})
 	}
 
@@ -41,9 +45,23 @@ func NewKeyController(req *server.Request) {
 	keyComment := req.HTTP.FormValue("comment")
 	keyComment = strings.TrimSpace(keyComment)
 
+	// a new key would escape the quota
+	if req.APIKey.Quota != nil {
+		req.Stream.Failure("keys with a quota can't create keys")
+		return
+	}
+
+	// keys are created in the current project (if any)
+	project := req.Project()
+	if _, exists := req.App.Config.Projects[project]; project != "" && !exists {
+		req.Stream.Failuref("unknown project '%s'", project)
+		return
+	}
+
 	req.Stream.Info("creating key")
 
-	key, err := req.App.APIKeysDB.AddNew(keyComment)
+	// new keys inherit the quota of their creator
+	key, err := req.App.APIKeysDB.AddNew(keyComment, project, req.APIKey.Quota)
 	if err != nil {
 		req.Stream.Failuref("Cannot create Key: %s", err)
 		return
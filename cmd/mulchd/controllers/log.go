@@ -7,6 +7,7 @@ import (
 	"strconv"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
 )
 
 const logControllerHistoryMaxLines = 3000
@@ -15,6 +16,10 @@ const logControllerHistoryMaxLines = 3000
 func LogController(req *server.Request) {
 	req.StartStream()
 	target := req.HTTP.FormValue("target")
+	if target != common.MessageAllTargets {
+		target = req.QualifiedName(target)
+	}
+	// project requests only receive messages of project VMs (see Hub)
 	req.SetTarget(target)
 
 	// nothing to do, just wait forever…
@@ -26,6 +31,9 @@ func GetLogHistoryController(req *server.Request) {
 	req.Response.Header().Set("Content-Type", "application/json")
 
 	target := req.HTTP.FormValue("target")
+	if target != common.MessageAllTargets {
+		target = req.QualifiedName(target)
+	}
 	linesStr := req.HTTP.FormValue("lines")
 
 	lines, err := strconv.Atoi(linesStr)
@@ -36,7 +44,7 @@ func GetLogHistoryController(req *server.Request) {
 		return
 	}
 
-	messages := req.App.LogHistory.Search(lines, target)
+	messages := req.App.LogHistory.Search(lines, target, req.Project())
 
 	enc := json.NewEncoder(req.Response)
 	err = enc.Encode(messages)
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+)
+
+// GetQuotaController shows quota and usage of an API key (the
+// caller's key by default)
+func GetQuotaController(req *server.Request) {
+	keyComment := req.HTTP.FormValue("key")
+	if keyComment == "" {
+		keyComment = req.APIKey.Comment
+	}
+
+	key := req.App.APIKeysDB.GetByComment(keyComment)
+	if key == nil || !req.InProject(key.Project) {
+		req.App.Log.Errorf("key '%s' not found", keyComment)
+		http.Error(req.Response, "key not found", 404)
+		return
+	}
+
+	used, vmCount, backups, err := req.App.QuotaUsage(keyComment)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	retData := common.APIQuota{
+		Key:     keyComment,
+		VMs:     vmCount,
+		CPUs:    used.CPUs,
+		RAMMB:   used.RAMMB,
+		DiskMB:  used.DiskMB,
+		Backups: backups,
+	}
+	if key.Quota != nil {
+		retData.CPUsMax = key.Quota.CPUs
+		retData.RAMMBMax = key.Quota.RAMMB
+		retData.DiskMBMax = key.Quota.DiskMB
+		retData.BackupsMax = key.Quota.Backups
+	}
+
+	req.Response.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// SetQuotaController sets (or removes) the quota of an API key
+func SetQuotaController(req *server.Request) {
+	req.StartStream()
+	keyComment := strings.TrimSpace(req.HTTP.FormValue("key"))
+
+	if req.APIKey.Project != "" {
+		req.Stream.Failure("project keys can't set quotas")
+		return
+	}
+
+	if req.APIKey.Quota != nil {
+		req.Stream.Failure("keys with a quota can't set quotas")
+		return
+	}
+
+	quota, err := quotaParse(req)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+
+	err = req.App.APIKeysDB.SetQuota(keyComment, quota)
+	if err != nil {
+		req.Stream.Failuref("unable to set quota: %s", err)
+		return
+	}
+
+	req.App.Log.Infof("quota of key '%s' updated by %s", keyComment, req.APIKey.Comment)
+	if quota == nil {
+		req.Stream.Successf("quota of key '%s' removed", keyComment)
+		return
+	}
+	req.Stream.Successf("quota of key '%s' saved", keyComment)
+}
+
+// parse quota form values (nil quota if everything is unlimited)
+func quotaParse(req *server.Request) (*server.APIKeyQuota, error) {
+	var err error
+	quota := &server.APIKeyQuota{}
+
+	parseInt := func(name string, dest *int) {
+		value := req.HTTP.FormValue(name)
+		if value == "" || err != nil {
+			return
+		}
+		*dest, err = strconv.Atoi(value)
+		if err == nil && *dest < 0 {
+			err = fmt.Errorf("invalid %s value '%s'", name, value)
+		}
+	}
+
+	parseSize := func(name string, dest *int) {
+		value := req.HTTP.FormValue(name)
+		if value == "" || err != nil {
+			return
+		}
+		var size datasize.ByteSize
+		err = size.UnmarshalText([]byte(value))
+		if err != nil {
+			err = fmt.Errorf("invalid %s size '%s': %s", name, value, err)
+			return
+		}
+		*dest = int(size.Bytes() / 1024 / 1024)
+	}
+
+	parseInt("cpu", &quota.CPUs)
+	parseSize("ram", &quota.RAMMB)
+	parseSize("disk", &quota.DiskMB)
+	parseInt("backups", &quota.Backups)
+	if err != nil {
+		return nil, err
+	}
+
+	if *quota == (server.APIKeyQuota{}) {
+		return nil, nil
+	}
+	return quota, nil
+}
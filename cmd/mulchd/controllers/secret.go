@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/OnitiFR/mulch/cmd/mulchd/server"
+	"github.com/OnitiFR/mulch/common"
+)
+
+// ListSecretsController list secrets (names only, never values)
+func ListSecretsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	users := server.GetSecretUsers(req.App.VMDB)
+
+	var retData common.APISecretListEntries
+	for _, secret := range req.App.SecretsDB.List() {
+		if !req.InProject(secret.Project) {
+			continue
+		}
+		retData = append(retData, common.APISecretListEntry{
+			Name:      secret.ID(),
+			Project:   secret.Project,
+			Modified:  secret.Modified,
+			AuthorKey: secret.AuthorKey,
+			UsedBy:    users[secret.ID()],
+		})
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err := enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
+// SetSecretController creates or updates a secret
+func SetSecretController(req *server.Request) {
+	req.StartStream()
+	name := strings.TrimSpace(req.HTTP.FormValue("name"))
+	value := req.HTTP.FormValue("value")
+
+	// secrets are created in the request project (if any)
+	project := req.Project()
+	if strings.Contains(name, server.ProjectVMSeparator) {
+		project, name = server.SplitProjectVMName(name)
+		if !req.InProject(project) {
+			req.Stream.Failuref("secret must be in project '%s'", req.Project())
+			return
+		}
+	}
+	if _, exists := req.App.Config.Projects[project]; project != "" && !exists {
+		req.Stream.Failuref("unknown project '%s'", project)
+		return
+	}
+
+	err := req.App.SecretsDB.Set(project, name, value, req.APIKey.Comment)
+	if err != nil {
+		req.Stream.Failuref("unable to set secret: %s", err)
+		return
+	}
+
+	id := server.ProjectVMName(project, name)
+	req.App.Log.Infof("secret '%s' updated by %s", id, req.APIKey.Comment)
+	req.Stream.Successf("secret '%s' saved", id)
+}
+
+// DeleteSecretController deletes a secret, if no VM uses it
+func DeleteSecretController(req *server.Request) {
+	req.StartStream()
+	name := req.QualifiedName(req.SubPath)
+
+	secret := req.App.SecretsDB.Get(name)
+	if secret == nil || !req.InProject(secret.Project) {
+		req.Stream.Failuref("secret '%s' not found", name)
+		return
+	}
+
+	users := server.GetSecretUsers(req.App.VMDB)[name]
+	if len(users) > 0 {
+		req.Stream.Failuref("secret '%s' is used by: %s", name, strings.Join(users, ", "))
+		return
+	}
+
+	err := req.App.SecretsDB.Delete(name)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+
+	req.App.Log.Infof("secret '%s' deleted by %s", name, req.APIKey.Comment)
+	req.Stream.Successf("secret '%s' successfully deleted", name)
+}
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
@@ -17,6 +19,8 @@ func ListSeedController(req *server.Request) {
 
 	var retData common.APISeedListEntries
 
+	users := req.App.Seeder.GetUsers()
+
 	for _, name := range req.App.Seeder.GetNames() {
 		seed, err := req.App.Seeder.GetByName(name)
 		if err != nil {
@@ -26,11 +30,22 @@ func ListSeedController(req *server.Request) {
 			return
 		}
 
+		// only show VMs of the request project
+		var usedBy []string
+		for _, vmID := range users[name] {
+			project, _ := server.SplitProjectVMName(vmID)
+			if req.InProject(project) {
+				usedBy = append(usedBy, vmID)
+			}
+		}
+
 		retData = append(retData, common.APISeedListEntry{
 			Name:         name,
 			Ready:        seed.Ready,
 			Size:         seed.Size,
 			LastModified: seed.LastModified,
+			Parent:       seed.Parent,
+			UsedBy:       usedBy,
 		})
 	}
 
@@ -65,15 +80,27 @@ func GetSeedStatusController(req *server.Request) {
 		return
 	}
 
+	var versions []string
+	for _, version := range seed.Versions {
+		versions = append(versions, fmt.Sprintf("%s (%s)", version.ID, version.SHA256))
+	}
+
 	data := &common.APISeedStatus{
-		Name:       seedName,
-		File:       seed.GetVolumeName(),
-		Ready:      seed.Ready,
-		URL:        seed.URL,
-		Seeder:     seed.Seeder,
-		Size:       seed.Size,
-		Status:     seed.Status,
-		StatusTime: seed.StatusTime,
+		Name:         seedName,
+		File:         seed.GetVolumeName(),
+		Ready:        seed.Ready,
+		URL:          seed.URL,
+		Seeder:       seed.Seeder,
+		Size:         seed.Size,
+		SHA256:       seed.SHA256,
+		Versions:     versions,
+		Parent:       seed.Parent,
+		UsedBy:       req.App.Seeder.GetUsers()[seedName],
+		Uploaded:     seed.Uploaded,
+		AuthorKey:    seed.AuthorKey,
+		UploadOffset: seed.UploadOffset,
+		Status:       seed.Status,
+		StatusTime:   seed.StatusTime,
 	}
 
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -85,9 +112,21 @@ func GetSeedStatusController(req *server.Request) {
 	}
 }
 
+// seeds are shared by all projects, only global keys can change them
+func seedCheckGlobalKey(req *server.Request) bool {
+	if req.APIKey.Project != "" {
+		req.Stream.Failure("project keys can't change seeds")
+		return false
+	}
+	return true
+}
+
 // ActionSeedController redirect to the correct action for the seed
 func ActionSeedController(req *server.Request) {
 	req.StartStream()
+	if !seedCheckGlobalKey(req) {
+		return
+	}
 
 	action := req.HTTP.FormValue("action")
 	seedName := req.SubPath
@@ -110,6 +149,13 @@ func ActionSeedController(req *server.Request) {
 		} else {
 			req.Stream.Successf("refresh completed (%s)", after.Sub(before))
 		}
+	case "rollback":
+		err := req.App.Seeder.Rollback(seed, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("rollback failed: %s", err)
+		} else {
+			req.Stream.Successf("seed '%s' rolled back to version %s", seed.Name, seed.CurrentVersion())
+		}
 	default:
 		req.Stream.Failuref("missing or invalid action ('%s')", action)
 		return
@@ -131,3 +177,118 @@ func seedRefresh(req *server.Request, seed *server.Seed) error {
 	}
 	return nil
 }
+
+// UploadSeedController receives a chunk of a seed image
+func UploadSeedController(req *server.Request) {
+	req.StartStream()
+	if !seedCheckGlobalKey(req) {
+		return
+	}
+
+	seedName := req.HTTP.FormValue("name")
+	offset, err := strconv.ParseInt(req.HTTP.FormValue("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		req.Stream.Failuref("invalid offset '%s'", req.HTTP.FormValue("offset"))
+		return
+	}
+	total, err := strconv.ParseInt(req.HTTP.FormValue("total"), 10, 64)
+	if err != nil || total < 0 {
+		req.Stream.Failuref("invalid total size '%s'", req.HTTP.FormValue("total"))
+		return
+	}
+
+	file, _, err := req.HTTP.FormFile("file")
+	if err != nil {
+		req.Stream.Failuref("error with 'file' field: %s", err)
+		return
+	}
+	defer file.Close()
+
+	req.SetTarget(seedName)
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "upload",
+		Ressource:     "seed",
+		RessourceName: seedName,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	done, err := req.App.Seeder.UploadChunk(seedName, offset, total, file, req.APIKey.Comment, req.Stream)
+	if err != nil {
+		req.Stream.Failuref("unable to upload seed: %s", err)
+		return
+	}
+
+	if done {
+		req.Stream.Successf("seed '%s' uploaded successfully", seedName)
+	}
+}
+
+// DeleteSeedController deletes an uploaded seed
+func DeleteSeedController(req *server.Request) {
+	req.StartStream()
+	if !seedCheckGlobalKey(req) {
+		return
+	}
+	seedName := req.SubPath
+
+	req.SetTarget(seedName)
+
+	operation := req.App.Operations.Add(&server.Operation{
+		Origin:        req.APIKey.Comment,
+		Action:        "delete",
+		Ressource:     "seed",
+		RessourceName: seedName,
+	})
+	defer req.App.Operations.Remove(operation)
+
+	err := req.App.Seeder.Delete(seedName, req.Stream)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+
+	req.Stream.Successf("seed '%s' successfully deleted", seedName)
+}
+
+// MirrorSeedController serves a seed image to another mulchd (HTTP Range
+// requests are supported, so downloads can be resumed)
+func MirrorSeedController(req *server.Request) {
+	if req.App.Config.SeedMirrorServe == false {
+		msg := "seed mirror is disabled on this server"
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	seedName := req.SubPath
+	seed, err := req.App.Seeder.GetByName(seedName)
+	if err != nil || seed.Ready == false || seed.URL == "" {
+		msg := fmt.Sprintf("seed '%s' not available", seedName)
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	volPath, err := req.App.Seeder.GetVolumePath(seed)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+
+	file, err := os.Open(volPath)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+		return
+	}
+	defer file.Close()
+
+	req.App.Log.Infof("serving seed '%s' to mirror peer (key: %s)", seedName, req.APIKey.Comment)
+
+	req.Response.Header().Set("Content-Type", "application/octet-stream")
+	req.Response.Header().Set(server.SeedMirrorURLHeader, seed.URL)
+	http.ServeContent(req.Response, req.HTTP, seed.GetVolumeName(), seed.LastModified, file)
+}
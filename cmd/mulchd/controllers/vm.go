@@ -4,15 +4,17 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
-	"path"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/OnitiFR/mulch/cmd/mulchd/server"
 	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -20,6 +22,7 @@ func getEntryFromRequest(vmName string, req *server.Request) (*server.VMDatabase
 	var entry *server.VMDatabaseEntry
 	var err error
 
+	vmName = req.VMName(vmName)
 	action := req.HTTP.FormValue("action")
 	revisionParams := req.HTTP.FormValue("revision")
 
@@ -50,9 +53,56 @@ func getEntryFromRequest(vmName string, req *server.Request) (*server.VMDatabase
 		}
 	}
 
+	if !vmInRequestProject(vmName, req) {
+		return nil, fmt.Errorf("VM '%s' not found in project '%s'", vmName, req.Project())
+	}
+
 	return entry, nil
 }
 
+// returns true if VM (all revisions) is accessible by the request (projects)
+func vmInRequestProject(vmName string, req *server.Request) bool {
+	if req.Project() == "" {
+		return true
+	}
+	for _, name := range req.App.VMDB.GetNames() {
+		if name.Name != vmName {
+			continue
+		}
+		vm, err := req.App.VMDB.GetByName(name)
+		if err != nil || !req.InProject(vm.Config.Project) {
+			return false
+		}
+	}
+	return true
+}
+
+// getConfigIncludes returns local include files sent by the client
+// ("include:<path>" file fields)
+func getConfigIncludes(req *server.Request) (server.VMConfigIncludes, error) {
+	includes := make(server.VMConfigIncludes)
+	if req.HTTP.MultipartForm == nil {
+		return includes, nil
+	}
+
+	for field, headers := range req.HTTP.MultipartForm.File {
+		if !strings.HasPrefix(field, "include:") || len(headers) == 0 {
+			continue
+		}
+		file, err := headers[0].Open()
+		if err != nil {
+			return nil, fmt.Errorf("'%s' file field: %s", field, err)
+		}
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("'%s' file field: %s", field, err)
+		}
+		includes[strings.TrimPrefix(field, "include:")] = string(content)
+	}
+	return includes, nil
+}
+
 // VMControllerConfigCheck will validate TOML sent in the 'config' request field
 // and check if VM is a duplicate
 func VMControllerConfigCheck(req *server.Request) (*server.VMConfig, string, error) {
@@ -62,7 +112,12 @@ func VMControllerConfigCheck(req *server.Request) (*server.VMConfig, string, err
 	}
 	filename := header.Filename
 
-	conf, err := server.NewVMConfigFromTomlReader(configFile, req.Stream)
+	includes, err := getConfigIncludes(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conf, err := server.NewVMConfigFromTomlReaderWithIncludes(configFile, includes, req.App, req.Stream)
 	if err != nil {
 		return nil, "", fmt.Errorf("decoding config: %s", err)
 	}
@@ -76,6 +131,44 @@ func VMControllerConfigCheck(req *server.Request) (*server.VMConfig, string, err
 	return conf, filename, nil
 }
 
+// CheckVMConfigController checks (plans) a VM config sent in the 'config'
+// request field, without creating anything
+func CheckVMConfigController(req *server.Request) {
+	req.StartStream()
+
+	configFile, header, err := req.HTTP.FormFile("config")
+	if err != nil {
+		req.Stream.Failuref("'config' file field: %s", err)
+		return
+	}
+	req.Stream.Tracef("reading '%s' config file", header.Filename)
+
+	includes, err := getConfigIncludes(req)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+
+	conf, err := server.NewVMConfigFromTomlReaderWithIncludes(configFile, includes, req.App, req.Stream)
+	if err != nil {
+		req.Stream.Failuref("decoding config: %s", err)
+		return
+	}
+
+	if !req.InProject(conf.Project) {
+		req.Stream.Failuref("VM must be in project '%s' (see 'project' setting)", req.Project())
+		return
+	}
+	req.Stream.Successf("config is valid, all scripts are reachable")
+
+	err = server.VMConfigPlan(conf, nil, req.App, req.Stream)
+	if err != nil {
+		req.Stream.Failure(err.Error())
+		return
+	}
+	req.Stream.Successf("VM '%s' can be created", conf.Name)
+}
+
 // NewVMAsyncController creates asynchronously a new VM and
 // use a callback URL when finished (success or failure)
 func NewVMAsyncController(req *server.Request) {
@@ -151,7 +244,7 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 	req.Stream.Tracef("reading '%s' config file", filename)
 
 	restore := req.HTTP.FormValue("restore")
-	restoreVM := req.HTTP.FormValue("restore-vm")
+	restoreVM := req.VMName(req.HTTP.FormValue("restore-vm"))
 	inactive := req.HTTP.FormValue("inactive")
 	keepOnFailure := req.HTTP.FormValue("keep_on_failure")
 	lock := req.HTTP.FormValue("lock")
@@ -172,6 +265,21 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 		return nil, errors.New(msg)
 	}
 
+	if !req.InProject(conf.Project) {
+		msg := fmt.Sprintf("VM must be in project '%s' (see 'project' setting)", req.Project())
+		req.Stream.Failure(msg)
+		return nil, errors.New(msg)
+	}
+
+	if restore != "" {
+		backup := req.App.BackupsDB.GetByName(restore)
+		if backup != nil && !req.InProject(backup.VM.Config.Project) {
+			msg := fmt.Sprintf("backup '%s' not found", restore)
+			req.Stream.Failure(msg)
+			return nil, errors.New(msg)
+		}
+	}
+
 	operation := req.App.Operations.Add(&server.Operation{
 		Origin:        req.APIKey.Comment,
 		Action:        "create",
@@ -191,6 +299,9 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 	// restore from a new backup
 	if restoreVM != "" {
 		entry, err := req.App.VMDB.GetActiveEntryByName(restoreVM)
+		if err == nil && !vmInRequestProject(restoreVM, req) {
+			err = fmt.Errorf("VM '%s' not found in project '%s'", restoreVM, req.Project())
+		}
 		if err != nil {
 			msg := fmt.Sprintf("Cannot find VM to backup: %s", err)
 			req.Stream.Failuref(msg)
@@ -212,13 +323,21 @@ func NewVMController(req *server.Request) (*server.VM, error) {
 	}
 
 	before := time.Now()
-	vm, vmName, err := server.NewVM(conf, active, allowScriptFailure, req.APIKey.Comment, req.App, req.Stream)
+	vm, vmName, err := server.NewVM(conf, active, allowScriptFailure, req.APIKey.Comment, req.APIKey.Quota, req.App, req.Stream)
 	if err != nil {
 		msg := fmt.Sprintf("Cannot create VM: %s", err)
 		req.Stream.Failuref(msg)
 		return nil, errors.New(msg)
 	}
 
+	version, err := req.App.ConfigHistory.Add(vmName.Name, vm.Config, req.APIKey.Comment, req.HTTP.FormValue("message"))
+	if err != nil {
+		// non-fatal
+		req.Stream.Errorf("Cannot save config history: %s", err)
+	}
+	vm.Config.Version = version
+	req.App.VMDB.Update()
+
 	if lock == common.TrueStr {
 		err = server.VMLockUnlock(vmName, true, req.App.VMDB)
 		if err != nil {
@@ -242,7 +361,12 @@ func ListVMsController(req *server.Request) {
 		basicListing = true
 	}
 
-	vmNames := req.App.VMDB.GetNames()
+	var vmNames []*server.VMName
+	for _, vmName := range req.App.VMDB.GetNames() {
+		if vmInRequestProject(vmName.Name, req) {
+			vmNames = append(vmNames, vmName)
+		}
+	}
 
 	if basicListing {
 		var retData common.APIVMBasicListEntries
@@ -318,6 +442,8 @@ func ListVMsController(req *server.Request) {
 				WIP:       string(vm.WIP),
 				SuperUser: vm.App.Config.MulchSuperUser,
 				AppUser:   vm.Config.AppUser,
+				Health:    req.App.HealthMonitor.GetHealth(vmName, vm),
+				Canary:    vm.CanaryWeight,
 			})
 		}
 
@@ -364,7 +490,7 @@ func ActionVMController(req *server.Request) {
 	if action != "do" {
 		// 'do' actions can send "private" special messages to client (like
 		// _MULCH_OPEN_URL) so don't broadcast output to vmName target
-		req.SetTarget(vmName)
+		req.SetTarget(req.VMName(vmName))
 	} else {
 		operationAction = "do:" + req.HTTP.FormValue("do_action")
 	}
@@ -398,9 +524,42 @@ func ActionVMController(req *server.Request) {
 		} else {
 			req.Stream.Successf("%s is now unlocked", entry.Name)
 		}
+	case "maintenance-on", "maintenance-off":
+		enabled := (action == "maintenance-on")
+		if vm.Maintenance == enabled {
+			req.Stream.Warningf("%s maintenance mode is already %t", entry.Name, enabled)
+		}
+		err := server.VMMaintenance(entry.Name, enabled, req.App.VMDB)
+		if err != nil {
+			req.Stream.Failuref("unable to change maintenance mode of %s: %s", entry.Name, err)
+		} else if enabled {
+			req.Stream.Successf("%s is now in maintenance mode", entry.Name)
+		} else {
+			req.Stream.Successf("%s is no more in maintenance mode", entry.Name)
+		}
+	case "canary":
+		weight, err := strconv.Atoi(req.HTTP.FormValue("weight"))
+		if err != nil {
+			req.Stream.Failuref("invalid weight: %s", err)
+			return
+		}
+		err = req.App.VMDB.SetCanaryWeight(entry.Name, weight)
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else if weight == 0 {
+			req.Stream.Successf("%s is no more a canary", entry.Name)
+		} else {
+			req.Stream.Successf("%s now receives %d%% of the traffic", entry.Name, weight)
+		}
 	case "start":
+		res := server.VMConfigResources(vm.Config, true)
+		err := req.App.CheckCapacity(&server.VMResources{CPUs: res.CPUs, RAMMB: res.RAMMB}, false, req.Stream)
+		if err != nil {
+			req.Stream.Failuref("unable to start %s: %s", entry.Name, err)
+			return
+		}
 		req.Stream.Infof("starting %s", vmName)
-		err := server.VMStartByName(entry.Name, vm.SecretUUID, req.App, req.Stream)
+		err = server.VMStartByName(entry.Name, vm.SecretUUID, req.App, req.Stream)
 		if err != nil {
 			req.Stream.Failuref("unable to start %s: %s", entry.Name, err)
 		} else {
@@ -440,13 +599,49 @@ func ActionVMController(req *server.Request) {
 		} else {
 			req.Stream.Successf("rebuild completed (%s)", after.Sub(before))
 		}
+	case "to-seed":
+		if !seedCheckGlobalKey(req) {
+			return
+		}
+		seedName := req.HTTP.FormValue("seed")
+		before := time.Now()
+		err := server.VMToSeed(entry.Name, seedName, req.APIKey.Comment, req.App, req.Stream)
+		after := time.Now()
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else {
+			req.Stream.Successf("seed '%s' created from %s (%s)", seedName, entry.Name, after.Sub(before))
+		}
 	case "redefine":
+		if req.HTTP.FormValue("diff") == common.TrueStr {
+			err := RedefineVMDiff(req, vm)
+			if err != nil {
+				req.Stream.Failuref("error: %s", err)
+			} else {
+				req.Stream.Successf("VM %s was not redefined (diff only)", entry.Name)
+			}
+			break
+		}
 		err := RedefineVM(req, vm, entry.Active)
 		if err != nil {
 			req.Stream.Failuref("error: %s", err)
 		} else {
 			req.Stream.Successf("VM %s redefined (may the sysadmin gods be with you)", entry.Name)
 		}
+	case "resize":
+		err := ResizeVM(req, entry.Name)
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else {
+			req.Stream.Successf("VM %s resized", entry.Name)
+		}
+	case "tune":
+		err := TuneVM(req, entry.Name)
+		if err != nil {
+			req.Stream.Failuref("error: %s", err)
+		} else {
+			req.Stream.Successf("VM %s tuned", entry.Name)
+		}
 	case "activate":
 		err := req.App.VMDB.SetActiveRevision(entry.Name.Name, entry.Name.Revision)
 		if err != nil {
@@ -468,7 +663,7 @@ func ActionVMController(req *server.Request) {
 func DeleteVMController(req *server.Request) {
 	req.StartStream()
 	vmName := req.SubPath
-	req.SetTarget(vmName)
+	req.SetTarget(req.VMName(vmName))
 
 	entry, err := getEntryFromRequest(vmName, req)
 	if err != nil {
@@ -565,54 +760,75 @@ func DoActionVM(req *server.Request, vm *server.VM, vmName *server.VMName) error
 		return errors.New("VM should be up and running")
 	}
 
-	stream, errG := server.GetContentFromURL(action.ScriptURL)
-	if errG != nil {
-		return fmt.Errorf("unable to get script '%s': %s", action.ScriptURL, errG)
+	// recorded in the action history, as scheduled runs
+	result := server.VMDoActionRun(
+		vm,
+		vmName,
+		action,
+		arguments,
+		server.DoActionManual,
+		req.Response.(http.CloseNotifier).CloseNotify(),
+		req.App,
+		req.Stream,
+	)
+	if result.Error != "" {
+		return errors.New(result.Error)
 	}
-	defer stream.Close()
 
-	SSHSuperUserAuth, err := req.App.SSHPairDB.GetPublicKeyAuth(server.SSHSuperUserPair)
-	if err != nil {
-		return err
-	}
+	req.Stream.Successf("script returned 0 (%s)", result.Duration)
+	return nil
+}
 
-	before := time.Now()
+// GetVMConfigController return a VM config file content
+func GetVMConfigController(req *server.Request) {
+	vmName := req.SubPath
 
-	run := &server.Run{
-		Caption: "do",
-		SSHConn: &server.SSHConnection{
-			User: vm.App.Config.MulchSuperUser,
-			Host: vm.LastIP,
-			Port: 22,
-			Auths: []ssh.AuthMethod{
-				SSHSuperUserAuth,
-			},
-			Log: req.Stream,
-		},
-		Tasks: []*server.RunTask{
-			&server.RunTask{
-				ScriptName:   path.Base(action.ScriptURL),
-				ScriptReader: stream,
-				As:           action.User,
-				Arguments:    arguments,
-			},
-		},
-		Log:          req.Stream,
-		CloseChannel: req.Response.(http.CloseNotifier).CloseNotify(),
+	if vmName == "" {
+		msg := fmt.Sprintf("no VM name given")
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
 	}
-	err = run.Go()
+	entry, err := getEntryFromRequest(vmName, req)
 	if err != nil {
-		return err
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 404)
+		return
 	}
 
-	after := time.Now()
+	fileContent := entry.VM.Config.FileContent
+	expandedContent := entry.VM.Config.ExpandedContent
 
-	req.Stream.Successf("script returned 0 (%s)", after.Sub(before))
-	return nil
+	if versionStr := req.HTTP.FormValue("version"); versionStr != "" {
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			msg := fmt.Sprintf("invalid version '%s'", versionStr)
+			req.App.Log.Error(msg)
+			http.Error(req.Response, msg, 400)
+			return
+		}
+		old, err := req.App.ConfigHistory.GetVersion(entry.Name.Name, version)
+		if err != nil {
+			req.App.Log.Error(err.Error())
+			http.Error(req.Response, err.Error(), 404)
+			return
+		}
+		fileContent = old.FileContent
+		expandedContent = old.ExpandedContent
+	}
+
+	req.Response.Header().Set("Content-Type", "text/plain")
+	if req.HTTP.FormValue("expanded") == common.TrueStr && expandedContent != "" {
+		req.Println(expandedContent)
+	} else {
+		req.Println(fileContent)
+	}
 }
 
-// GetVMConfigController return a VM config file content
-func GetVMConfigController(req *server.Request) {
+// GetVMConfigHistoryController return all config versions of a VM
+func GetVMConfigHistoryController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
 	vmName := req.SubPath
 
 	if vmName == "" {
@@ -621,15 +837,33 @@ func GetVMConfigController(req *server.Request) {
 		http.Error(req.Response, msg, 400)
 		return
 	}
+
 	entry, err := getEntryFromRequest(vmName, req)
 	if err != nil {
-		req.App.Log.Error(err.Error())
-		http.Error(req.Response, err.Error(), 404)
+		msg := fmt.Sprintf("VM '%s' not found", vmName)
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
 		return
 	}
 
-	req.Response.Header().Set("Content-Type", "text/plain")
-	req.Println(entry.VM.Config.FileContent)
+	var retData common.APIVMConfigVersionEntries
+
+	for _, version := range req.App.ConfigHistory.Get(entry.Name.Name) {
+		retData = append(retData, common.APIVMConfigVersionEntry{
+			Version:   version.Version,
+			Date:      version.Date,
+			AuthorKey: version.AuthorKey,
+			Message:   version.Message,
+			Current:   version.Version == entry.VM.Config.Version,
+		})
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
 }
 
 // GetVMInfosController return VM informations
@@ -672,9 +906,22 @@ func GetVMInfosController(req *server.Request) {
 		domains = append(domains, domain.Name)
 	}
 
+	var ports []string
+	for _, port := range vm.Config.Ports {
+		ports = append(ports, port.String())
+	}
+
+	limits, err := server.VMGetLimits(entry.Name, req.App)
+	if err != nil {
+		// show configured limits instead
+		req.App.Log.Errorf("unable to get %s limits: %s", entry.Name, err)
+		limits = &vm.Config.Limits
+	}
+
 	data := &common.APIVMInfos{
 		Name:                entry.Name.Name,
 		Revision:            entry.Name.Revision,
+		Project:             vm.Config.Project,
 		Up:                  running,
 		Active:              entry.Active,
 		Seed:                vm.Config.Seed,
@@ -685,6 +932,7 @@ func GetVMInfosController(req *server.Request) {
 		BackupDiskSizeMB:    (vm.Config.BackupDiskSize / 1024 / 1024),
 		Hostname:            vm.Config.Hostname,
 		Domains:             domains,
+		Ports:               ports,
 		SuperUser:           vm.App.Config.MulchSuperUser,
 		AppUser:             vm.Config.AppUser,
 		AuthorKey:           vm.AuthorKey,
@@ -693,7 +941,9 @@ func GetVMInfosController(req *server.Request) {
 		LastRebuildDowntime: vm.LastRebuildDowntime,
 		Locked:              vm.Locked,
 		AssignedIPv4:        vm.AssignedIPv4,
+		AssignedIPv6:        vm.AssignedIPv6,
 		AssignedMAC:         vm.AssignedMAC,
+		Limits:              limits.Strings(),
 	}
 
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -705,6 +955,49 @@ func GetVMInfosController(req *server.Request) {
 	}
 }
 
+// GetVMScriptsController return script revisions used by a VM
+func GetVMScriptsController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	vmName := req.SubPath
+
+	if vmName == "" {
+		msg := fmt.Sprintf("no VM name given")
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	entry, err := getEntryFromRequest(vmName, req)
+	if err != nil {
+		msg := fmt.Sprintf("VM '%s' not found", vmName)
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	var retData common.APIVMScriptEntries
+
+	for _, script := range entry.VM.Scripts {
+		retData = append(retData, common.APIVMScriptEntry{
+			Step:   script.Step,
+			URL:    script.URL,
+			As:     script.As,
+			SHA256: script.SHA256,
+			Commit: script.Commit,
+			Pinned: script.Pinned,
+			Date:   script.Date,
+		})
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
 // GetVMDoActionsController return VM do-action list
 func GetVMDoActionsController(req *server.Request) {
 	req.Response.Header().Set("Content-Type", "application/json")
@@ -734,6 +1027,7 @@ func GetVMDoActionsController(req *server.Request) {
 			Name:        action.Name,
 			User:        action.User,
 			Description: action.Description,
+			Schedule:    action.Schedule,
 		})
 	}
 
@@ -749,8 +1043,58 @@ func GetVMDoActionsController(req *server.Request) {
 	}
 }
 
+// GetVMDoHistoryController return past runs of a VM do-action
+func GetVMDoHistoryController(req *server.Request) {
+	req.Response.Header().Set("Content-Type", "application/json")
+
+	vmName := req.SubPath
+	actionName := req.HTTP.FormValue("do_action")
+
+	if vmName == "" || actionName == "" {
+		msg := fmt.Sprintf("no VM name or action name given")
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 400)
+		return
+	}
+
+	entry, err := getEntryFromRequest(vmName, req)
+	if err != nil {
+		msg := fmt.Sprintf("VM '%s' not found", vmName)
+		req.App.Log.Error(msg)
+		http.Error(req.Response, msg, 404)
+		return
+	}
+
+	var retData common.APIVMDoHistoryEntries
+
+	// output is masked when stored, but secrets may have been added since
+	for _, run := range req.App.DoHistoryDB.Get(entry.Name.Name, actionName) {
+		retData = append(retData, common.APIVMDoHistoryEntry{
+			Start:      run.Start,
+			Duration:   run.Duration,
+			Scheduled:  run.Scheduled,
+			ExitStatus: run.ExitStatus,
+			Error:      req.App.SecretsDB.Mask(run.Error),
+			Output:     req.App.SecretsDB.Mask(run.Output),
+		})
+	}
+
+	enc := json.NewEncoder(req.Response)
+	err = enc.Encode(&retData)
+	if err != nil {
+		req.App.Log.Error(err.Error())
+		http.Error(req.Response, err.Error(), 500)
+	}
+}
+
 // BackupVM launch the backup process
 func BackupVM(req *server.Request, vmName *server.VMName) (string, error) {
+	release, err := req.App.ReserveBackupQuota(req.APIKey.Comment)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
 	return server.VMBackup(vmName, req.APIKey.Comment, req.App, req.Stream, server.BackupCompressAllow)
 }
 
@@ -766,29 +1110,143 @@ func RebuildVMv2(req *server.Request, vm *server.VM, vmName *server.VMName) erro
 	return server.VMRebuild(vmName, lock == common.TrueStr, req.APIKey.Comment, req.App, req.Stream)
 }
 
-// RedefineVM replace VM config file with a new one, for next rebuild
-func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
-	if vm.Locked == true && req.HTTP.FormValue("force") != common.TrueStr {
-		return errors.New("VM is locked (see --force)")
-	}
-
-	if vm.WIP != server.VMOperationNone {
-		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+// read and check the new config sent for a redefine (or the config
+// version requested with 'to_version')
+func redefineGetConfig(req *server.Request, vm *server.VM) (*server.VMConfig, error) {
+	if toVersion := req.HTTP.FormValue("to_version"); toVersion != "" {
+		version, err := strconv.Atoi(toVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version '%s'", toVersion)
+		}
+		old, err := req.App.ConfigHistory.GetVersion(vm.Config.Name, version)
+		if err != nil {
+			return nil, err
+		}
+		req.Stream.Infof("using config version %d (%s, by %s)", old.Version, old.Date.Format("2006-01-02 15:04"), old.AuthorKey)
+		conf, err := server.NewVMConfigFromVersion(old, req.App, req.Stream)
+		if err != nil {
+			return nil, fmt.Errorf("decoding config: %s", err)
+		}
+		return conf, nil
 	}
 
 	configFile, header, err := req.HTTP.FormFile("config")
 	if err != nil {
-		return fmt.Errorf("'config' file field: %s", err)
+		return nil, fmt.Errorf("'config' file field: %s", err)
 	}
 	req.Stream.Tracef("reading '%s' config file", header.Filename)
 
-	conf, err := server.NewVMConfigFromTomlReader(configFile, req.Stream)
+	includes, err := getConfigIncludes(req)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := server.NewVMConfigFromTomlReaderWithIncludes(configFile, includes, req.App, req.Stream)
 	if err != nil {
-		return fmt.Errorf("decoding config: %s", err)
+		return nil, fmt.Errorf("decoding config: %s", err)
 	}
 
 	if conf.Name != vm.Config.Name {
-		return fmt.Errorf("VM name does not match")
+		return nil, fmt.Errorf("VM name does not match")
+	}
+	if !req.InProject(conf.Project) {
+		return nil, fmt.Errorf("VM can't be moved out of project '%s'", req.Project())
+	}
+	return conf, nil
+}
+
+// ResizeVM changes CPU, RAM and disk size of a VM (see server.VMResize)
+func ResizeVM(req *server.Request, vmName *server.VMName) error {
+	var cpuCount int
+	var ramSize, diskSize uint64
+	var err error
+
+	if cpuStr := req.HTTP.FormValue("cpu"); cpuStr != "" {
+		cpuCount, err = strconv.Atoi(cpuStr)
+		if err != nil || cpuCount < 1 {
+			return fmt.Errorf("invalid CPU count '%s'", cpuStr)
+		}
+	}
+
+	if ramStr := req.HTTP.FormValue("ram"); ramStr != "" {
+		var size datasize.ByteSize
+		err = size.UnmarshalText([]byte(ramStr))
+		if err != nil {
+			return fmt.Errorf("invalid RAM size '%s': %s", ramStr, err)
+		}
+		ramSize = size.Bytes()
+	}
+
+	if diskStr := req.HTTP.FormValue("disk"); diskStr != "" {
+		var size datasize.ByteSize
+		err = size.UnmarshalText([]byte(strings.TrimPrefix(diskStr, "+")))
+		if err != nil {
+			return fmt.Errorf("invalid disk size '%s': %s", diskStr, err)
+		}
+		diskSize = size.Bytes()
+		if strings.HasPrefix(diskStr, "+") {
+			vm, errG := req.App.VMDB.GetByName(vmName)
+			if errG != nil {
+				return errG
+			}
+			diskSize += vm.Config.DiskSize
+		}
+	}
+
+	if cpuCount == 0 && ramSize == 0 && diskSize == 0 {
+		return errors.New("nothing to resize (see --cpu, --ram and --disk)")
+	}
+
+	return server.VMResize(vmName, cpuCount, ramSize, diskSize, req.APIKey.Comment, req.App, req.Stream)
+}
+
+// TuneVM changes resource limits of a VM (see server.VMTune)
+func TuneVM(req *server.Request, vmName *server.VMName) error {
+	settings := make(map[string]string)
+	for key, values := range req.HTTP.Form {
+		if strings.HasPrefix(key, "limit:") && len(values) > 0 {
+			settings[strings.TrimPrefix(key, "limit:")] = values[0]
+		}
+	}
+	return server.VMTune(vmName, settings, req.APIKey.Comment, req.App, req.Stream)
+}
+
+// RedefineVMDiff shows what a redefine would change, without changing
+// anything (plan + config diff)
+func RedefineVMDiff(req *server.Request, vm *server.VM) error {
+	conf, err := redefineGetConfig(req, vm)
+	if err != nil {
+		return err
+	}
+
+	err = server.VMConfigPlan(conf, vm.Config, req.App, req.Stream)
+	if err != nil {
+		return err
+	}
+
+	diff := server.VMConfigDiff(vm.Config, conf)
+	if len(diff) == 0 {
+		req.Stream.Info("no change")
+	}
+	for _, line := range diff {
+		req.Stream.Info(line)
+	}
+	return nil
+}
+
+// RedefineVM replace VM config file with a new one, for next rebuild
+func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
+	if vm.Locked == true && req.HTTP.FormValue("force") != common.TrueStr {
+		return errors.New("VM is locked (see --force)")
+	}
+
+	if vm.WIP != server.VMOperationNone {
+		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	conf, err := redefineGetConfig(req, vm)
+	if err != nil {
+		return err
 	}
 
 	if active {
@@ -796,10 +1254,26 @@ func RedefineVM(req *server.Request, vm *server.VM, active bool) error {
 		if err != nil {
 			return err
 		}
+		err = server.CheckPortsConflicts(req.App.VMDB, conf.Ports, conf.Name, req.App.Config)
+		if err != nil {
+			return err
+		}
 	}
 
 	// change author
 	vm.AuthorKey = req.APIKey.Comment
+	vm.LastConfigUpdate = time.Now()
+
+	message := req.HTTP.FormValue("message")
+	if message == "" && req.HTTP.FormValue("to_version") != "" {
+		message = "back to version " + req.HTTP.FormValue("to_version")
+	}
+
+	conf.Version, err = req.App.ConfigHistory.Add(conf.Name, conf, req.APIKey.Comment, message)
+	if err != nil {
+		return fmt.Errorf("unable to save config history: %s", err)
+	}
+	req.Stream.Infof("config version %d", conf.Version)
 
 	oldActions := vm.Config.DoActions
 
@@ -49,18 +49,36 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetVMConfigController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/config-history/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMConfigHistoryController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /vm/infos/*",
 		Type:    server.RouteTypeCustom,
 		Handler: controllers.GetVMInfosController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/scripts/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMScriptsController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /vm/do-actions/*",
 		Type:    server.RouteTypeCustom,
 		Handler: controllers.GetVMDoActionsController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /vm/do-history/*",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetVMDoHistoryController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "POST /vm",
 		Type:    server.RouteTypeStream,
@@ -73,6 +91,12 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.NewVMAsyncController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "POST /vm-check",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.CheckVMConfigController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "POST /vm/*",
 		Type:    server.RouteTypeStream,
@@ -103,12 +127,31 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.GetSeedStatusController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "POST /seed",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.UploadSeedController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "POST /seed/*",
 		Type:    server.RouteTypeStream,
 		Handler: controllers.ActionSeedController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "DELETE /seed/*",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.DeleteSeedController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:        "GET /seed-mirror/*",
+		Type:         server.RouteTypeCustom,
+		NoProtoCheck: true,
+		Handler:      controllers.MirrorSeedController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /backup",
 		Type:    server.RouteTypeCustom,
@@ -144,6 +187,36 @@ func AddRoutes(app *server.App) {
 		Handler: controllers.NewKeyController,
 	}, server.RouteAPI)
 
+	app.AddRoute(&server.Route{
+		Route:   "GET /quota",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.GetQuotaController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "POST /quota",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.SetQuotaController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "GET /secret",
+		Type:    server.RouteTypeCustom,
+		Handler: controllers.ListSecretsController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "POST /secret",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.SetSecretController,
+	}, server.RouteAPI)
+
+	app.AddRoute(&server.Route{
+		Route:   "DELETE /secret/*",
+		Type:    server.RouteTypeStream,
+		Handler: controllers.DeleteSecretController,
+	}, server.RouteAPI)
+
 	app.AddRoute(&server.Route{
 		Route:   "GET /sshpair",
 		Type:    server.RouteTypeCustom,
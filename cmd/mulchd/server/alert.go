@@ -16,6 +16,7 @@ type Alert struct {
 	Type    string
 	Subject string
 	Content string
+	Project string // optional, see ConfigProject.AlertRecipients
 }
 
 // Alert.Type values
@@ -29,6 +30,7 @@ const alertScriptDirectory = "alerts"
 // AlertSender will be attached to the application
 type AlertSender struct {
 	scriptsPath string
+	projects    map[string]ConfigProject
 	log         *Log
 }
 
@@ -53,11 +55,12 @@ func listScripts(scriptsPath string) ([]string, error) {
 }
 
 // NewAlertSender creates a new AlertSender
-func NewAlertSender(configPath string, log *Log) (*AlertSender, error) {
+func NewAlertSender(configPath string, projects map[string]ConfigProject, log *Log) (*AlertSender, error) {
 	scriptsPath := path.Clean(configPath + "/" + alertScriptDirectory)
 
 	sender := &AlertSender{
 		scriptsPath: scriptsPath,
+		projects:    projects,
 		log:         log,
 	}
 
@@ -86,6 +89,8 @@ func (sender *AlertSender) Send(alert *Alert) error {
 	varMap["SUBJECT"] = alert.Subject
 	varMap["CONTENT"] = alert.Content
 	varMap["DATETIME"] = time.Now().Format(time.RFC3339)
+	varMap["PROJECT"] = alert.Project
+	varMap["RECIPIENTS"] = strings.Join(sender.projects[alert.Project].AlertRecipients, ",")
 
 	scriptsWithError := make([]string, 0)
 
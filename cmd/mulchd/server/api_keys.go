@@ -20,6 +20,16 @@ type APIKey struct {
 	Key        string
 	SSHPrivate string
 	SSHPublic  string
+	Project    string // empty = global key
+	Quota      *APIKeyQuota
+}
+
+// APIKeyQuota limits resources owned by an API key (zero = unlimited)
+type APIKeyQuota struct {
+	CPUs    int
+	RAMMB   int
+	DiskMB  int
+	Backups int
 }
 
 // APIKeyDatabase describes a persistent API Key database
@@ -44,7 +54,7 @@ func NewAPIKeyDatabase(filename string, log *Log, rand *rand.Rand) (*APIKeyDatab
 		}
 	} else {
 		log.Warningf("no API keys database found, creating a new one with a default key")
-		key, err := db.AddNew("default-key")
+		key, err := db.AddNew("default-key", "", nil)
 		if err != nil {
 			return nil, err
 		}
@@ -143,8 +153,9 @@ func (db *APIKeyDatabase) genKey() string {
 	return RandString(apiKeyMinLength, db.rand)
 }
 
-// AddNew generates a new key and adds it to the database
-func (db *APIKeyDatabase) AddNew(comment string) (*APIKey, error) {
+// AddNew generates a new key and adds it to the database, a project
+// key only gives access to the project VMs and backups
+func (db *APIKeyDatabase) AddNew(comment string, project string, quota *APIKeyQuota) (*APIKey, error) {
 
 	for _, key := range db.keys {
 		if key.Comment == comment {
@@ -162,6 +173,11 @@ func (db *APIKeyDatabase) AddNew(comment string) (*APIKey, error) {
 		Key:        db.genKey(),
 		SSHPrivate: priv,
 		SSHPublic:  pub,
+		Project:    project,
+	}
+	if quota != nil {
+		keyQuota := *quota
+		key.Quota = &keyQuota
 	}
 	db.keys = append(db.keys, key)
 
@@ -189,3 +205,23 @@ func (db *APIKeyDatabase) GetByPubKey(pub string) (*APIKey, error) {
 
 	return nil, nil
 }
+
+// GetByComment returns an API key by its comment, or nil if not found
+func (db *APIKeyDatabase) GetByComment(comment string) *APIKey {
+	for _, key := range db.keys {
+		if key.Comment == comment {
+			return key
+		}
+	}
+	return nil
+}
+
+// SetQuota sets (or removes, with a nil quota) the quota of an API key
+func (db *APIKeyDatabase) SetQuota(comment string, quota *APIKeyQuota) error {
+	key := db.GetByComment(comment)
+	if key == nil {
+		return fmt.Errorf("key '%s' not found", comment)
+	}
+	key.Quota = quota
+	return db.Save()
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/OnitiFR/mulch/common"
@@ -24,8 +26,9 @@ const (
 	AppStorageDisks   = "mulch-disks"
 	AppStorageBackups = "mulch-backups"
 
-	AppNetwork  = "mulch"
-	AppNWFilter = "mulch-filter"
+	AppNetwork      = "mulch"
+	AppNWFilter     = "mulch-filter"
+	AppNWFilterIPv6 = "mulch-filter-ipv6"
 )
 
 // AppInternalServerPost for "phone home" internal HTTP server
@@ -50,8 +53,14 @@ type App struct {
 	SSHPairDB      *SSHPairDatabase
 	VMDB           *VMDatabase
 	VMStateDB      *VMStateDatabase
+	HealthMonitor  *HealthMonitor
 	BackupsDB      *BackupDatabase
+	AutoRebuildDB  *AutoRebuildDatabase
+	DoHistoryDB    *DoHistoryDatabase
+	ConfigHistory  *VMConfigHistoryDatabase
 	APIKeysDB      *APIKeyDatabase
+	SecretsDB      *SecretDatabase
+	ScriptCache    *ScriptCache
 	AlertSender    *AlertSender
 	Seeder         *SeedDatabase
 	routesInternal map[string][]*Route
@@ -59,6 +68,8 @@ type App struct {
 	sshClients     map[net.Addr]*sshServerClient
 	Operations     *OperationList
 	ProxyReloader  *ProxyReloader
+	capacityMutex  sync.Mutex
+	pendingBackups map[string]int // per API key, see ReserveBackupQuota
 }
 
 // NewApp creates a new application
@@ -69,6 +80,7 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		Rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
 		routesInternal: make(map[string][]*Route),
 		routesAPI:      make(map[string][]*Route),
+		pendingBackups: make(map[string]int),
 	}
 
 	if os.Getenv("TMPDIR") == "" {
@@ -119,6 +131,31 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, err
 	}
 
+	err = app.initSecretsDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.initAutoRebuildDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.initDoHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.initConfigHistoryDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.initScriptCache()
+	if err != nil {
+		return nil, err
+	}
+
 	err = app.initLibvirtStorage()
 	if err != nil {
 		return nil, err
@@ -134,7 +171,7 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 		return nil, err
 	}
 
-	app.AlertSender, err = NewAlertSender(app.Config.configPath, app.Log)
+	app.AlertSender, err = NewAlertSender(app.Config.configPath, app.Config.Projects, app.Log)
 	if err != nil {
 		return nil, err
 	}
@@ -159,8 +196,13 @@ func NewApp(config *AppConfig, trace bool) (*App, error) {
 
 	go app.VMStateDB.Run()
 
+	app.HealthMonitor = NewHealthMonitor(app)
+	go app.HealthMonitor.Run()
+
 	go AutoRebuildSchedule(app)
 
+	go NewDoActionScheduler(app).Run()
+
 	return app, nil
 }
 
@@ -189,6 +231,11 @@ func (app *App) initSSHPairDB() error {
 		pairdb.AddNew(SSHProxyPair)
 	}
 
+	if pairdb.GetByName(SSHGitPair) == nil {
+		app.Log.Info("generating git deploy key pair")
+		pairdb.AddNew(SSHGitPair)
+	}
+
 	app.SSHPairDB = pairdb
 
 	app.Log.Infof("found %d SSH pair(s) in database %s", app.SSHPairDB.Count(), dbPath)
@@ -198,6 +245,7 @@ func (app *App) initSSHPairDB() error {
 func (app *App) initVMDB() error {
 	dbPath := app.Config.DataPath + "/mulch-vm-v2.db"
 	domainDbPath := app.Config.DataPath + "/mulch-proxy-domains.db"
+	portDbPath := app.Config.DataPath + "/mulch-proxy-ports.db"
 
 	dbPathV1 := app.Config.DataPath + "/mulch-vm.db"
 	if common.PathExist(dbPathV1) && !common.PathExist(dbPath) {
@@ -217,7 +265,7 @@ func (app *App) initVMDB() error {
 	}
 
 	app.ProxyReloader = NewProxyReloader(app)
-	vmdb, err := NewVMDatabase(dbPath, domainDbPath, app.ProxyReloader.Request, app.Config)
+	vmdb, err := NewVMDatabase(dbPath, domainDbPath, portDbPath, app.ProxyReloader.Request, app.Config, app.Log)
 	if err != nil {
 		return err
 	}
@@ -388,11 +436,20 @@ func (app *App) initLibvirtNetwork() error {
 		return fmt.Errorf("initLibvirtNetwork: %s", err)
 	}
 
+	if len(netcfg.IPs) == 0 || (netcfg.IPs[0].Family != "" && netcfg.IPs[0].Family != "ipv4") {
+		return fmt.Errorf("initLibvirtNetwork: network '%s' first IP must be an IPv4 one", netcfg.Name)
+	}
+
 	app.Log.Info(fmt.Sprintf("network '%s': %s (%s)", netcfg.Name, netcfg.IPs[0].Address, netcfg.Bridge.Name))
 
 	app.Libvirt.Network = net
 	app.Libvirt.NetworkXML = netcfg
 
+	err = app.checkNetworkIPv6()
+	if err != nil {
+		return fmt.Errorf("initLibvirtNetwork: %s", err)
+	}
+
 	// clean DHCP leases
 	err = app.Libvirt.RebuildDHCPStaticLeases(app)
 	if err != nil {
@@ -408,6 +465,16 @@ func (app *App) initLibvirtNWFilter() error {
 		app.Config.GetTemplateFilepath("nwfilter.xml"),
 		app.Log)
 
+	if err != nil {
+		return fmt.Errorf("initLibvirtNWFilter: %s", err)
+	}
+
+	// references the previous one, so must be created after
+	_, err = app.Libvirt.GetOrCreateNWFilter(
+		AppNWFilterIPv6,
+		app.Config.GetTemplateFilepath("nwfilter-ipv6.xml"),
+		app.Log)
+
 	if err != nil {
 		return fmt.Errorf("initLibvirtNWFilter: %s", err)
 	}
@@ -596,6 +663,72 @@ func (app *App) Status() (*common.APIStatus, error) {
 	ret.FreeBackupMB = int(backupsInfos.Available / 1024 / 1024)
 	ret.ProvisionedDisksMB = provisionedDisks
 	ret.AllocatedDisksMB = allocatedDisks
+	ret.GitDeployKey = strings.TrimSpace(app.SSHPairDB.GetByName(SSHGitPair).Public)
 
 	return &ret, nil
 }
+
+func (app *App) initAutoRebuildDB() error {
+	dbPath := app.Config.DataPath + "/mulch-auto-rebuild.db"
+
+	db, err := NewAutoRebuildDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	app.AutoRebuildDB = db
+	return nil
+}
+
+func (app *App) initDoHistoryDB() error {
+	dbPath := app.Config.DataPath + "/mulch-do-history.db"
+
+	db, err := NewDoHistoryDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	app.DoHistoryDB = db
+	return nil
+}
+
+func (app *App) initConfigHistoryDB() error {
+	dbPath := app.Config.DataPath + "/mulch-config-history.db"
+
+	db, err := NewVMConfigHistoryDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	app.ConfigHistory = db
+	return nil
+}
+
+func (app *App) initScriptCache() error {
+	cachePath := app.Config.DataPath + "/scripts"
+	gitPath := app.Config.DataPath + "/git"
+
+	git, err := NewGitSources(gitPath, app.SSHPairDB.GetByName(SSHGitPair))
+	if err != nil {
+		return err
+	}
+
+	cache, err := NewScriptCache(cachePath, git)
+	if err != nil {
+		return err
+	}
+	app.ScriptCache = cache
+	return nil
+}
+
+func (app *App) initSecretsDB() error {
+	dbPath := app.Config.DataPath + "/mulch-secrets.db"
+	keyPath := app.Config.DataPath + "/mulch-secrets.key"
+
+	db, err := NewSecretDatabase(dbPath, keyPath)
+	if err != nil {
+		return err
+	}
+	app.SecretsDB = db
+
+	// never show secret values in logs
+	app.Hub.SetMasker(db.Mask)
+	return nil
+}
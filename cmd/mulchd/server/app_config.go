@@ -1,12 +1,16 @@
 package server
 
 import (
+	"encoding/hex"
 	"fmt"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/c2h5oh/datasize"
 )
 
 // Reverse Proxy Chaining modes
@@ -16,6 +20,19 @@ const (
 	ProxyChainModeParent = 2
 )
 
+// Overcommit policies
+const (
+	OvercommitPolicyReject = "reject"
+	OvercommitPolicyWarn   = "warn"
+)
+
+// IPv6 modes (only used if mulch network have an IPv6 prefix)
+const (
+	IPv6ModeDisabled = "disabled"
+	IPv6ModePrivate  = "private"
+	IPv6ModePublic   = "public"
+)
+
 // AppConfig describes the general configuration of an App
 type AppConfig struct {
 	// address where the API server will listen
@@ -43,6 +60,10 @@ type AppConfig struct {
 	// SSH proxy listen address
 	ProxyListenSSH string
 
+	// mulch-proxy HTTP/HTTPS listen addresses (reserved ports)
+	ProxyListenHTTP  string
+	ProxyListenHTTPS string
+
 	// Extra (limited) SSH keys
 	ProxySSHExtraKeysFile string
 
@@ -65,9 +86,48 @@ type AppConfig struct {
 	// Everyday VM auto-rebuild time ("HH:MM")
 	AutoRebuildTime string
 
+	// Maximum number of simultaneous auto-rebuilds
+	AutoRebuildMaxParallel int
+
+	// Random delay added before each auto-rebuild
+	AutoRebuildJitter time.Duration
+
+	// Daily auto-rebuild summary alert time ("HH:MM", empty = disabled)
+	AutoRebuildSummaryTime string
+
+	// Overcommit ratios (VM resources / host resources, 0 = unchecked)
+	OvercommitCPURatio  float64
+	OvercommitRAMRatio  float64
+	OvercommitDiskRatio float64
+
+	// Overcommit policy (reject or warn)
+	OvercommitPolicy string
+
+	// IPv6 mode for VMs (disabled, private or public)
+	IPv6Mode string
+
+	// mulch-proxy reaches VMs using IPv6 (when available)
+	ProxyUpstreamIPv6 bool
+
 	// Seeds
 	Seeds map[string]ConfigSeed
 
+	// Number of previous seed images to keep
+	SeedKeepVersions int
+
+	// Seed download bandwidth limit (per second, 0 = unlimited)
+	SeedDownloadRateLimit datasize.ByteSize
+
+	// Serve our seeds to other mulchd servers
+	SeedMirrorServe bool
+
+	// Download seeds from another mulchd server first (API URL and key)
+	SeedMirrorURL string
+	SeedMirrorKey string
+
+	// Projects (VMs, backups and keys grouping)
+	Projects map[string]ConfigProject
+
 	// global mulchd configuration path
 	configPath string
 }
@@ -76,31 +136,84 @@ type AppConfig struct {
 type ConfigSeed struct {
 	URL    string
 	Seeder string
+
+	// image verification (URL seeds only)
+	SHA256       string
+	ChecksumURL  string
+	SignatureURL string
+	GPGKeyring   string
+}
+
+// ConfigProject describes a project and its defaults for VMs
+type ConfigProject struct {
+	Env              map[string]string
+	PreparePrefixURL string
+	InstallPrefixURL string
+	BackupPrefixURL  string
+	RestorePrefixURL string
+
+	// given to alert scripts (RECIPIENTS variable)
+	AlertRecipients []string
+
+	// extra SSH keys, limited to project VMs
+	SSHExtraKeysFile string
 }
 
 type tomlAppConfig struct {
-	Listen                string
-	ListenHTTPSDomain     string `toml:"listen_https_domain"`
-	LibVirtURI            string `toml:"libvirt_uri"`
-	StoragePath           string `toml:"storage_path"`
-	DataPath              string `toml:"data_path"`
-	TempPath              string `toml:"temp_path"`
-	VMPrefix              string `toml:"vm_prefix"`
-	ProxyListenSSH        string `toml:"proxy_listen_ssh"`
-	ProxySSHExtraKeysFile string `toml:"proxy_ssh_extra_keys_file"`
-	ProxyChainMode        string `toml:"proxy_chain_mode"`
-	ProxyChainParentURL   string `toml:"proxy_chain_parent_url"`
-	ProxyChainChildURL    string `toml:"proxy_chain_child_url"`
-	ProxyChainPSK         string `toml:"proxy_chain_psk"`
-	MulchSuperUser        string `toml:"mulch_super_user"`
-	AutoRebuildTime       string `toml:"auto_rebuild_time"`
-	Seed                  []tomlConfigSeed
+	Listen                 string
+	ListenHTTPSDomain      string            `toml:"listen_https_domain"`
+	LibVirtURI             string            `toml:"libvirt_uri"`
+	StoragePath            string            `toml:"storage_path"`
+	DataPath               string            `toml:"data_path"`
+	TempPath               string            `toml:"temp_path"`
+	VMPrefix               string            `toml:"vm_prefix"`
+	ProxyListenSSH         string            `toml:"proxy_listen_ssh"`
+	ProxyListenHTTP        string            `toml:"proxy_listen_http"`
+	ProxyListenHTTPS       string            `toml:"proxy_listen_https"`
+	ProxySSHExtraKeysFile  string            `toml:"proxy_ssh_extra_keys_file"`
+	ProxyChainMode         string            `toml:"proxy_chain_mode"`
+	ProxyChainParentURL    string            `toml:"proxy_chain_parent_url"`
+	ProxyChainChildURL     string            `toml:"proxy_chain_child_url"`
+	ProxyChainPSK          string            `toml:"proxy_chain_psk"`
+	MulchSuperUser         string            `toml:"mulch_super_user"`
+	AutoRebuildTime        string            `toml:"auto_rebuild_time"`
+	AutoRebuildMaxParallel int               `toml:"auto_rebuild_max_parallel"`
+	AutoRebuildJitter      string            `toml:"auto_rebuild_jitter"`
+	AutoRebuildSummaryTime string            `toml:"auto_rebuild_summary_time"`
+	OvercommitCPURatio     float64           `toml:"overcommit_cpu_ratio"`
+	OvercommitRAMRatio     float64           `toml:"overcommit_ram_ratio"`
+	OvercommitDiskRatio    float64           `toml:"overcommit_disk_ratio"`
+	OvercommitPolicy       string            `toml:"overcommit_policy"`
+	IPv6Mode               string            `toml:"ipv6_mode"`
+	ProxyUpstreamIPv6      bool              `toml:"proxy_upstream_ipv6"`
+	SeedKeepVersions       int               `toml:"seed_keep_versions"`
+	SeedDownloadRateLimit  datasize.ByteSize `toml:"seed_download_rate_limit"`
+	SeedMirrorServe        bool              `toml:"seed_mirror_serve"`
+	SeedMirrorURL          string            `toml:"seed_mirror_url"`
+	SeedMirrorKey          string            `toml:"seed_mirror_key"`
+	Seed                   []tomlConfigSeed
+	Project                []tomlConfigProject
 }
 
 type tomlConfigSeed struct {
-	Name   string
-	URL    string
-	Seeder string
+	Name         string
+	URL          string
+	Seeder       string
+	SHA256       string `toml:"sha256"`
+	ChecksumURL  string `toml:"checksum_url"`
+	SignatureURL string `toml:"signature_url"`
+	GPGKeyring   string `toml:"gpg_keyring"`
+}
+
+type tomlConfigProject struct {
+	Name             string
+	Env              [][]string
+	PreparePrefixURL string   `toml:"prepare_prefix_url"`
+	InstallPrefixURL string   `toml:"install_prefix_url"`
+	BackupPrefixURL  string   `toml:"backup_prefix_url"`
+	RestorePrefixURL string   `toml:"restore_prefix_url"`
+	AlertRecipients  []string `toml:"alert_recipients"`
+	SSHExtraKeysFile string   `toml:"ssh_extra_keys_file"`
 }
 
 // NewAppConfigFromTomlFile return a AppConfig using
@@ -112,20 +225,32 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig := &AppConfig{
 		configPath: configPath,
 		Seeds:      make(map[string]ConfigSeed),
+		Projects:   make(map[string]ConfigProject),
 	}
 
 	// defaults (if not in the file)
 	tConfig := &tomlAppConfig{
-		Listen:                ":8686",
-		LibVirtURI:            "qemu:///system",
-		StoragePath:           "./var/storage", // example: /srv/mulch
-		DataPath:              "./var/data",    // example: /var/lib/mulch
-		TempPath:              "",
-		VMPrefix:              "mulch-",
-		ProxyListenSSH:        ":8022",
-		ProxySSHExtraKeysFile: "",
-		MulchSuperUser:        "admin",
-		AutoRebuildTime:       "23:30",
+		Listen:                 ":8686",
+		LibVirtURI:             "qemu:///system",
+		StoragePath:            "./var/storage", // example: /srv/mulch
+		DataPath:               "./var/data",    // example: /var/lib/mulch
+		TempPath:               "",
+		VMPrefix:               "mulch-",
+		ProxyListenSSH:         ":8022",
+		ProxyListenHTTP:        ":80",
+		ProxyListenHTTPS:       ":443",
+		ProxySSHExtraKeysFile:  "",
+		MulchSuperUser:         "admin",
+		AutoRebuildTime:        "23:30",
+		AutoRebuildMaxParallel: 1,
+		AutoRebuildJitter:      "0s",
+		AutoRebuildSummaryTime: "07:00",
+		OvercommitCPURatio:     4,
+		OvercommitRAMRatio:     1,
+		OvercommitDiskRatio:    2,
+		OvercommitPolicy:       OvercommitPolicyWarn,
+		IPv6Mode:               IPv6ModePrivate,
+		SeedKeepVersions:       3,
 	}
 
 	meta, err := toml.DecodeFile(filename, tConfig)
@@ -169,6 +294,8 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.MulchSuperUser = tConfig.MulchSuperUser
 
 	appConfig.ProxyListenSSH = tConfig.ProxyListenSSH
+	appConfig.ProxyListenHTTP = tConfig.ProxyListenHTTP
+	appConfig.ProxyListenHTTPS = tConfig.ProxyListenHTTPS
 	appConfig.ProxySSHExtraKeysFile = tConfig.ProxySSHExtraKeysFile
 
 	switch tConfig.ProxyChainMode {
@@ -186,19 +313,68 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 	appConfig.ProxyChainChildURL = tConfig.ProxyChainChildURL
 	appConfig.ProxyChainPSK = tConfig.ProxyChainPSK
 
-	partsAr := strings.Split(tConfig.AutoRebuildTime, ":")
-	if len(partsAr) != 2 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': wrong format (HH:MM needed)", tConfig.AutoRebuildTime)
+	if _, _, err := ParseHourMinute(tConfig.AutoRebuildTime); err != nil {
+		return nil, fmt.Errorf("auto_rebuild_time: %s", err)
 	}
-	hour, err := strconv.Atoi(partsAr[0])
-	if err != nil || hour > 23 || hour < 0 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': invalid hour", tConfig.AutoRebuildTime)
+	appConfig.AutoRebuildTime = tConfig.AutoRebuildTime
+
+	if tConfig.AutoRebuildMaxParallel < 1 {
+		return nil, fmt.Errorf("auto_rebuild_max_parallel: need at least 1")
 	}
-	minute, err := strconv.Atoi(partsAr[1])
-	if err != nil || minute > 59 || minute < 0 {
-		return nil, fmt.Errorf("auto_rebuild_time: '%s': invalid minute", tConfig.AutoRebuildTime)
+	appConfig.AutoRebuildMaxParallel = tConfig.AutoRebuildMaxParallel
+
+	appConfig.AutoRebuildJitter, err = time.ParseDuration(tConfig.AutoRebuildJitter)
+	if err != nil || appConfig.AutoRebuildJitter < 0 {
+		return nil, fmt.Errorf("auto_rebuild_jitter: invalid duration '%s'", tConfig.AutoRebuildJitter)
 	}
-	appConfig.AutoRebuildTime = tConfig.AutoRebuildTime
+
+	if tConfig.AutoRebuildSummaryTime != "" {
+		if _, _, err := ParseHourMinute(tConfig.AutoRebuildSummaryTime); err != nil {
+			return nil, fmt.Errorf("auto_rebuild_summary_time: %s", err)
+		}
+	}
+	appConfig.AutoRebuildSummaryTime = tConfig.AutoRebuildSummaryTime
+
+	if tConfig.OvercommitCPURatio < 0 || tConfig.OvercommitRAMRatio < 0 || tConfig.OvercommitDiskRatio < 0 {
+		return nil, fmt.Errorf("overcommit ratios can't be negative")
+	}
+	appConfig.OvercommitCPURatio = tConfig.OvercommitCPURatio
+	appConfig.OvercommitRAMRatio = tConfig.OvercommitRAMRatio
+	appConfig.OvercommitDiskRatio = tConfig.OvercommitDiskRatio
+
+	switch tConfig.OvercommitPolicy {
+	case OvercommitPolicyReject, OvercommitPolicyWarn:
+		appConfig.OvercommitPolicy = tConfig.OvercommitPolicy
+	default:
+		return nil, fmt.Errorf("unknown overcommit_policy value '%s'", tConfig.OvercommitPolicy)
+	}
+
+	switch tConfig.IPv6Mode {
+	case IPv6ModeDisabled, IPv6ModePrivate, IPv6ModePublic:
+		appConfig.IPv6Mode = tConfig.IPv6Mode
+	default:
+		return nil, fmt.Errorf("unknown ipv6_mode value '%s'", tConfig.IPv6Mode)
+	}
+	appConfig.ProxyUpstreamIPv6 = tConfig.ProxyUpstreamIPv6
+
+	if tConfig.SeedKeepVersions < 0 {
+		return nil, fmt.Errorf("seed_keep_versions: invalid value %d", tConfig.SeedKeepVersions)
+	}
+	appConfig.SeedKeepVersions = tConfig.SeedKeepVersions
+
+	appConfig.SeedDownloadRateLimit = tConfig.SeedDownloadRateLimit
+	appConfig.SeedMirrorServe = tConfig.SeedMirrorServe
+
+	if tConfig.SeedMirrorURL != "" {
+		if _, err := url.ParseRequestURI(tConfig.SeedMirrorURL); err != nil {
+			return nil, fmt.Errorf("seed_mirror_url: %s", err)
+		}
+		if tConfig.SeedMirrorKey == "" {
+			return nil, fmt.Errorf("seed_mirror_url needs a seed_mirror_key")
+		}
+	}
+	appConfig.SeedMirrorURL = tConfig.SeedMirrorURL
+	appConfig.SeedMirrorKey = tConfig.SeedMirrorKey
 
 	for _, seed := range tConfig.Seed {
 		if seed.Name == "" {
@@ -219,11 +395,68 @@ func NewAppConfigFromTomlFile(configPath string) (*AppConfig, error) {
 			return nil, fmt.Errorf("seed '%s': must have either 'url' or 'seeder' parameter", seed.Name)
 		}
 
+		verify := seed.SHA256 != "" || seed.ChecksumURL != "" || seed.SignatureURL != ""
+		if verify && seed.URL == "" {
+			return nil, fmt.Errorf("seed '%s': image verification is only available for URL seeds", seed.Name)
+		}
+		if seed.SHA256 != "" && seed.ChecksumURL != "" {
+			return nil, fmt.Errorf("seed '%s': use either 'sha256' or 'checksum_url' parameter", seed.Name)
+		}
+		if seed.SHA256 != "" {
+			if _, err := hex.DecodeString(seed.SHA256); err != nil || len(seed.SHA256) != 64 {
+				return nil, fmt.Errorf("seed '%s': invalid sha256 value", seed.Name)
+			}
+		}
+		if seed.SignatureURL != "" {
+			if seed.ChecksumURL == "" {
+				return nil, fmt.Errorf("seed '%s': 'signature_url' needs a 'checksum_url'", seed.Name)
+			}
+			if seed.GPGKeyring == "" {
+				return nil, fmt.Errorf("seed '%s': 'signature_url' needs a 'gpg_keyring'", seed.Name)
+			}
+		}
+
 		appConfig.Seeds[seed.Name] = ConfigSeed{
-			URL:    seed.URL,
-			Seeder: seed.Seeder,
+			URL:          seed.URL,
+			Seeder:       seed.Seeder,
+			SHA256:       strings.ToLower(seed.SHA256),
+			ChecksumURL:  seed.ChecksumURL,
+			SignatureURL: seed.SignatureURL,
+			GPGKeyring:   seed.GPGKeyring,
+		}
+
+	}
+
+	for _, project := range tConfig.Project {
+		if project.Name == "" || !IsValidName(project.Name) {
+			return nil, fmt.Errorf("'%s' is not a valid project name", project.Name)
+		}
+
+		_, exists := appConfig.Projects[project.Name]
+		if exists == true {
+			return nil, fmt.Errorf("project name '%s' already defined", project.Name)
+		}
+
+		env := make(map[string]string)
+		for _, line := range project.Env {
+			if len(line) != 2 {
+				return nil, fmt.Errorf("project '%s': invalid 'env' line, need two values (key, val), found %d", project.Name, len(line))
+			}
+			if !IsValidName(line[0]) {
+				return nil, fmt.Errorf("project '%s': invalid 'env' name '%s'", project.Name, line[0])
+			}
+			env[line[0]] = line[1]
 		}
 
+		appConfig.Projects[project.Name] = ConfigProject{
+			Env:              env,
+			PreparePrefixURL: project.PreparePrefixURL,
+			InstallPrefixURL: project.InstallPrefixURL,
+			BackupPrefixURL:  project.BackupPrefixURL,
+			RestorePrefixURL: project.RestorePrefixURL,
+			AlertRecipients:  project.AlertRecipients,
+			SSHExtraKeysFile: project.SSHExtraKeysFile,
+		}
 	}
 
 	return appConfig, nil
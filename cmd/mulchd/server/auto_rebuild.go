@@ -2,9 +2,17 @@ package server
 
 import (
 	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// autoRebuildCatchUp is the delay during which a missed rebuild (mulchd
+// restart, for instance) is still started
+const autoRebuildCatchUp = 2 * time.Hour
+
 // AutoRebuildSchedule will schedule auto-rebuilds
 func AutoRebuildSchedule(app *App) {
 	app.VMStateDB.WaitRestore()
@@ -12,50 +20,231 @@ func AutoRebuildSchedule(app *App) {
 	// seeder rebuilds and other mulchd startup stuff.
 	time.Sleep(15 * time.Minute)
 
+	scheduler := &autoRebuildScheduler{
+		app:     app,
+		pending: make(map[string]bool),
+		slots:   make(chan bool, app.Config.AutoRebuildMaxParallel),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
 	for {
-		now := time.Now().Format("15:04")
-		if app.Config.AutoRebuildTime == now {
-			autoRebuildStart(app)
-		}
+		scheduler.tick(time.Now())
 		time.Sleep(time.Minute)
 	}
 }
 
-func autoRebuildStart(app *App) {
-	vmNames := app.VMDB.GetNames()
-	for _, vmName := range vmNames {
-		err := autoRebuildVM(vmName, app)
+type autoRebuildScheduler struct {
+	app     *App
+	pending map[string]bool // VM names (waiting for jitter/slot, or rebuilding)
+	slots   chan bool       // max parallel rebuilds
+	rand    *rand.Rand
+	mutex   sync.Mutex
+}
+
+func (sched *autoRebuildScheduler) tick(now time.Time) {
+	app := sched.app
+
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	for _, vmName := range app.VMDB.GetNames() {
+		if sched.pending[vmName.Name] {
+			continue
+		}
+
+		entry, err := app.VMDB.GetEntryByName(vmName)
 		if err != nil {
-			app.Log.Errorf("error rebuilding %s: %s", vmName, err)
-			app.AlertSender.Send(&Alert{
-				Type:    AlertTypeBad,
-				Subject: "Auto-rebuild",
-				Content: fmt.Sprintf("error rebuilding %s, see server log", vmName.ID()),
+			continue
+		}
+
+		// we currently rebuild only active VMs
+		if entry.Active == false || entry.VM.Config.AutoRebuild == "" {
+			continue
+		}
+
+		due, err := autoRebuildIsDue(entry.VM, now, app)
+		if err != nil {
+			app.Log.Errorf("auto-rebuild %s: %s", vmName, err)
+			continue
+		}
+		if !due {
+			continue
+		}
+
+		vm := entry.VM
+		modified := vm.InitDate
+		if vm.LastConfigUpdate.After(modified) {
+			modified = vm.LastConfigUpdate
+		}
+		skipModified := vm.Config.AutoRebuildSkipModified
+		if skipModified > 0 && now.Sub(modified) < skipModified {
+			app.Log.Infof("auto-rebuild: skipping %s, modified %s ago", vmName, now.Sub(modified).Truncate(time.Minute))
+			sched.record(&AutoRebuildRun{
+				VMName:  vmName.Name,
+				Start:   now,
+				Skipped: fmt.Sprintf("modified %s ago", now.Sub(modified).Truncate(time.Minute)),
 			})
+			continue
 		}
+
+		var jitter time.Duration
+		if app.Config.AutoRebuildJitter > 0 {
+			jitter = time.Duration(sched.rand.Int63n(int64(app.Config.AutoRebuildJitter)))
+		}
+
+		sched.pending[vmName.Name] = true
+		go sched.rebuild(vmName, jitter)
+	}
+
+	if len(sched.pending) == 0 {
+		sched.sendSummaryIfNeeded(now)
 	}
 }
 
-func autoRebuildVM(vmName *VMName, app *App) error {
-	entry, err := app.VMDB.GetEntryByName(vmName)
+func (sched *autoRebuildScheduler) record(run *AutoRebuildRun) {
+	err := sched.app.AutoRebuildDB.Add(run)
 	if err != nil {
-		return err
+		sched.app.Log.Errorf("auto-rebuild database: %s", err)
 	}
+}
 
-	// we currently rebuild only active VMs
-	if entry.Active == false {
-		return nil
+func (sched *autoRebuildScheduler) rebuild(vmName *VMName, jitter time.Duration) {
+	app := sched.app
+
+	defer func() {
+		sched.mutex.Lock()
+		delete(sched.pending, vmName.Name)
+		sched.mutex.Unlock()
+	}()
+
+	time.Sleep(jitter)
+
+	sched.slots <- true
+	defer func() { <-sched.slots }()
+
+	run := &AutoRebuildRun{
+		VMName: vmName.Name,
+		Start:  time.Now(),
 	}
 
-	running, _ := VMIsRunning(vmName, app)
-	if running == false {
-		// VM is down, this is not an error (i guess?)
-		return nil
+	skipped, err := autoRebuildVM(vmName, app)
+	run.Duration = time.Now().Sub(run.Start)
+
+	if skipped != "" {
+		app.Log.Infof("auto-rebuild: skipping %s, %s", vmName, skipped)
+		run.Skipped = skipped
+	} else if err != nil {
+		run.Error = err.Error()
+		app.Log.Errorf("error rebuilding %s: %s", vmName, err)
+		project := ""
+		if vm, errG := app.VMDB.GetByName(vmName); errG == nil {
+			project = vm.Config.Project
+		}
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Auto-rebuild",
+			Content: fmt.Sprintf("error rebuilding %s, see server log", vmName.ID()),
+			Project: project,
+		})
+	} else if vm, errG := app.VMDB.GetActiveByName(vmName.Name); errG == nil {
+		run.Duration = vm.LastRebuildDuration
+		run.Downtime = vm.LastRebuildDowntime
+	}
+
+	sched.record(run)
+}
+
+func (sched *autoRebuildScheduler) sendSummaryIfNeeded(now time.Time) {
+	app := sched.app
+
+	if app.Config.AutoRebuildSummaryTime == "" {
+		return
+	}
+
+	hour, minute, _ := ParseHourMinute(app.Config.AutoRebuildSummaryTime)
+	summaryTime := lastDailyOccurrence(now, hour, minute)
+	if app.AutoRebuildDB.GetLastSummary().After(summaryTime) {
+		return
 	}
 
-	vm, err := app.VMDB.GetByName(vmName)
+	runs, err := app.AutoRebuildDB.PopSummary()
 	if err != nil {
-		return err
+		app.Log.Errorf("auto-rebuild database: %s", err)
+		return
+	}
+	if len(runs) == 0 {
+		return
+	}
+
+	var lines []string
+	failures := 0
+	for _, run := range runs {
+		switch {
+		case run.Skipped != "":
+			lines = append(lines, fmt.Sprintf("%s: skipped (%s)", run.VMName, run.Skipped))
+		case run.Error != "":
+			failures++
+			lines = append(lines, fmt.Sprintf("%s: FAILED (%s)", run.VMName, run.Error))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: OK (duration %s, downtime %s)", run.VMName, run.Duration.Truncate(time.Second), run.Downtime.Truncate(time.Second)))
+		}
+	}
+
+	alertType := AlertTypeGood
+	if failures > 0 {
+		alertType = AlertTypeBad
+	}
+
+	app.AlertSender.Send(&Alert{
+		Type:    alertType,
+		Subject: fmt.Sprintf("Auto-rebuild summary (%d run(s), %d failure(s))", len(runs), failures),
+		Content: strings.Join(lines, "\n"),
+	})
+}
+
+// autoRebuildIsDue returns true if the VM must be rebuilt now
+func autoRebuildIsDue(vm *VM, now time.Time, app *App) (bool, error) {
+	var slot, deadline time.Time
+
+	switch {
+	case IsCronExpression(vm.Config.AutoRebuild):
+		spec, err := ParseCronSpec(vm.Config.AutoRebuild)
+		if err != nil {
+			return false, err
+		}
+		slot = spec.Prev(now)
+		deadline = slot.Add(autoRebuildCatchUp)
+	case vm.Config.AutoRebuildWindow != "":
+		start, duration, err := ParseTimeWindow(vm.Config.AutoRebuildWindow)
+		if err != nil {
+			return false, err
+		}
+		slot = lastDailyOccurrence(now, start/60, start%60)
+		deadline = slot.Add(duration)
+	default:
+		hour, minute, err := ParseHourMinute(app.Config.AutoRebuildTime)
+		if err != nil {
+			return false, err
+		}
+		slot = lastDailyOccurrence(now, hour, minute)
+		deadline = slot.Add(autoRebuildCatchUp)
+	}
+
+	if slot.IsZero() || now.After(deadline) {
+		return false, nil
+	}
+
+	// already done (or rebuilt by hand) since this slot?
+	if vm.InitDate.After(slot) {
+		return false, nil
+	}
+	lastRun := app.AutoRebuildDB.GetLastRun(vm.Config.Name)
+	if lastRun != nil && !lastRun.Start.Before(slot) {
+		return false, nil
+	}
+
+	if IsCronExpression(vm.Config.AutoRebuild) {
+		return true, nil
 	}
 
 	// Depending on the rebuild order and rebuild duration,
@@ -65,10 +254,29 @@ func autoRebuildVM(vmName *VMName, app *App) error {
 	// day, but we're not there).
 	timeMargin := 12 * time.Hour
 
-	if !IsRebuildNeeded(vm.Config.AutoRebuild, vm.InitDate.Add(-timeMargin)) {
-		return nil
+	return IsRebuildNeeded(vm.Config.AutoRebuild, vm.InitDate.Add(-timeMargin)), nil
+}
+
+// autoRebuildVM returns a reason if the rebuild was skipped
+func autoRebuildVM(vmName *VMName, app *App) (string, error) {
+	entry, err := app.VMDB.GetEntryByName(vmName)
+	if err != nil {
+		return "", err
 	}
 
+	// may have changed during jitter
+	if entry.Active == false {
+		return "no longer active", nil
+	}
+
+	running, _ := VMIsRunning(vmName, app)
+	if running == false {
+		// VM is down, this is not an error (i guess?)
+		return "VM is down", nil
+	}
+
+	vm := entry.VM
+
 	log := NewLog(vm.Config.Name, app.Hub, app.LogHistory)
 	log.Infof("auto-rebuilding %s", vmName)
 
@@ -89,7 +297,7 @@ func autoRebuildVM(vmName *VMName, app *App) error {
 		log.Infof("auto-rebuild successful for %s", vmName)
 	}
 
-	return errR
+	return "", errR
 }
 
 // IsRebuildNeeded return true if lastRebuild is older than rebuildSetting
@@ -111,3 +319,55 @@ func IsRebuildNeeded(rebuildSetting string, lastRebuild time.Time) bool {
 	}
 	return rebuild
 }
+
+// ParseHourMinute parses a "HH:MM" string
+func ParseHourMinute(str string) (int, int, error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("'%s': wrong format (HH:MM needed)", str)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour > 23 || hour < 0 {
+		return 0, 0, fmt.Errorf("'%s': invalid hour", str)
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil || minute > 59 || minute < 0 {
+		return 0, 0, fmt.Errorf("'%s': invalid minute", str)
+	}
+	return hour, minute, nil
+}
+
+// ParseTimeWindow parses a "HH:MM-HH:MM" string and returns the
+// start (minutes after midnight) and the duration of the window. A
+// window may span midnight ("23:00-02:00").
+func ParseTimeWindow(str string) (int, time.Duration, error) {
+	parts := strings.Split(str, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("'%s': wrong format (HH:MM-HH:MM needed)", str)
+	}
+	startH, startM, err := ParseHourMinute(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+	endH, endM, err := ParseHourMinute(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start := startH*60 + startM
+	end := endH*60 + endM
+	length := end - start
+	if length <= 0 {
+		length += 24 * 60
+	}
+	return start, time.Duration(length) * time.Minute, nil
+}
+
+// returns the latest hour:minute time before or equal to now
+func lastDailyOccurrence(now time.Time, hour int, minute int) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if t.After(now) {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t
+}
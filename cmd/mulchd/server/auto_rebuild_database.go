@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AutoRebuildRun is the result of an auto-rebuild attempt
+type AutoRebuildRun struct {
+	VMName   string
+	Start    time.Time
+	Duration time.Duration
+	Downtime time.Duration
+	Skipped  string // reason, if skipped
+	Error    string
+}
+
+// autoRebuildData is what we store on disk
+type autoRebuildData struct {
+	LastRuns    map[string]*AutoRebuildRun // by VM name
+	Summary     []*AutoRebuildRun          // runs since last summary
+	LastSummary time.Time
+}
+
+// AutoRebuildDatabase is a persistent record of auto-rebuild runs, so
+// a mulchd restart does not skip (or replay) a rebuild
+type AutoRebuildDatabase struct {
+	filename string
+	db       *autoRebuildData
+	mutex    sync.Mutex
+}
+
+// NewAutoRebuildDatabase instanciates a new AutoRebuildDatabase
+func NewAutoRebuildDatabase(filename string) (*AutoRebuildDatabase, error) {
+	db := &AutoRebuildDatabase{
+		filename: filename,
+		db: &autoRebuildData{
+			LastRuns: make(map[string]*AutoRebuildRun),
+		},
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(db.filename); err == nil {
+		err = db.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the file to check if it's writable
+	err := db.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// This is done internaly, because it must be done with the mutex locked,
+// but we can't lock it here, since save() is called by functions that
+// are already locking the mutex.
+func (db *AutoRebuildDatabase) save() error {
+	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(db.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *AutoRebuildDatabase) load() error {
+	f, err := os.Open(db.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	requiredMode, err := strconv.ParseInt("0600", 8, 32)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode() != os.FileMode(requiredMode) {
+		return fmt.Errorf("%s: only the owner should be able to read/write this file (mode 0600)", db.filename)
+	}
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(db.db)
+	if err != nil {
+		return err
+	}
+
+	if db.db.LastRuns == nil {
+		db.db.LastRuns = make(map[string]*AutoRebuildRun)
+	}
+	return nil
+}
+
+// GetLastRun returns the last auto-rebuild run of a VM (or nil)
+func (db *AutoRebuildDatabase) GetLastRun(vmName string) *AutoRebuildRun {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.db.LastRuns[vmName]
+}
+
+// Add a new run in the database
+func (db *AutoRebuildDatabase) Add(run *AutoRebuildRun) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.db.LastRuns[run.VMName] = run
+	db.db.Summary = append(db.db.Summary, run)
+
+	return db.save()
+}
+
+// GetLastSummary returns the date of the last summary
+func (db *AutoRebuildDatabase) GetLastSummary() time.Time {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.db.LastSummary
+}
+
+// PopSummary returns all runs since last summary and resets the list
+func (db *AutoRebuildDatabase) PopSummary() ([]*AutoRebuildRun, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	runs := db.db.Summary
+	db.db.Summary = nil
+	db.db.LastSummary = time.Now()
+
+	return runs, db.save()
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHourMinute(t *testing.T) {
+	tests := []struct {
+		str       string
+		hour, min int
+		wantErr   bool
+	}{
+		{str: "03:30", hour: 3, min: 30},
+		{str: "0:00", hour: 0, min: 0},
+		{str: "23:59", hour: 23, min: 59},
+		{str: "24:00", wantErr: true},
+		{str: "12:60", wantErr: true},
+		{str: "-1:00", wantErr: true},
+		{str: "12", wantErr: true},
+		{str: "12:30:00", wantErr: true},
+		{str: "ab:cd", wantErr: true},
+	}
+
+	for _, test := range tests {
+		hour, min, err := ParseHourMinute(test.str)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.str, err)
+			continue
+		}
+		if hour != test.hour || min != test.min {
+			t.Errorf("'%s': got %d:%d, want %d:%d", test.str, hour, min, test.hour, test.min)
+		}
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		str      string
+		start    int
+		duration time.Duration
+		wantErr  bool
+	}{
+		{str: "01:00-05:00", start: 60, duration: 4 * time.Hour},
+		{str: "01:00 - 01:30", start: 60, duration: 30 * time.Minute},
+		{str: "23:00-02:00", start: 23 * 60, duration: 3 * time.Hour},
+		{str: "03:00-03:00", start: 3 * 60, duration: 24 * time.Hour},
+		{str: "01:00", wantErr: true},
+		{str: "01:00-25:00", wantErr: true},
+		{str: "01:00-02:00-03:00", wantErr: true},
+	}
+
+	for _, test := range tests {
+		start, duration, err := ParseTimeWindow(test.str)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected", test.str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.str, err)
+			continue
+		}
+		if start != test.start || duration != test.duration {
+			t.Errorf("'%s': got %d/%s, want %d/%s", test.str, start, duration, test.start, test.duration)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VMResources are host resources used (or requested) by a VM
+type VMResources struct {
+	CPUs   int
+	RAMMB  int
+	DiskMB int
+}
+
+// VMConfigResources returns resources needed by a VM config. Persistent
+// data disks are skipped if they already exist (new revision of a VM).
+func VMConfigResources(config *VMConfig, withPersistentDisks bool) *VMResources {
+	res := &VMResources{
+		CPUs:   config.CPUCount,
+		RAMMB:  int(config.RAMSize / 1024 / 1024),
+		DiskMB: int(config.DiskSize / 1024 / 1024),
+	}
+	for _, disk := range config.Disks {
+		if disk.Persist && !withPersistentDisks {
+			continue
+		}
+		res.DiskMB += int(disk.Size / 1024 / 1024)
+	}
+	return res
+}
+
+// sum of the n largest values
+func capacityTopSum(values []int, n int) int {
+	sort.Sort(sort.Reverse(sort.IntSlice(values)))
+	sum := 0
+	for i := 0; i < n && i < len(values); i++ {
+		sum += values[i]
+	}
+	return sum
+}
+
+// CheckCapacity checks that the host can hold extra resources, using
+// overcommit ratios of mulchd config. CPU and RAM are counted for
+// running VMs (and VMs being created), disks for all VMs. Unless the
+// request replaces an existing VM (rebuild, new revision), some room is
+// kept to rebuild auto_rebuild_max_parallel VMs at once, since a rebuild
+// briefly runs two revisions of the same VM. Depending on the overcommit
+// policy, an error is returned or a warning is logged.
+func (app *App) CheckCapacity(extra *VMResources, replace bool, log *Log) error {
+	app.capacityMutex.Lock()
+	defer app.capacityMutex.Unlock()
+
+	return app.checkCapacity(extra, replace, log)
+}
+
+// CheckCapacityAndAdd checks capacity (and the owner quota, if not nil)
+// for a new VM and adds it to the maternity DB in the same step, so
+// concurrent creations are counted
+func (app *App) CheckCapacityAndAdd(vm *VM, vmName *VMName, replace bool, quota *APIKeyQuota, log *Log) error {
+	app.capacityMutex.Lock()
+	defer app.capacityMutex.Unlock()
+
+	// existing persistent disks of another revision are already charged
+	extra := VMConfigResources(vm.Config, !replace)
+
+	if quota != nil {
+		err := app.checkQuota(vm.Owner(), quota, extra, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := app.checkCapacity(extra, replace, log)
+	if err != nil {
+		return err
+	}
+	return app.VMDB.AddToMaternity(vm, vmName)
+}
+
+func (app *App) checkCapacity(extra *VMResources, replace bool, log *Log) error {
+	conn, err := app.Libvirt.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	infos, err := conn.GetNodeInfo()
+	if err != nil {
+		return err
+	}
+
+	poolInfos, err := app.Libvirt.Pools.Disks.GetInfo()
+	if err != nil {
+		return err
+	}
+
+	var used VMResources
+	var runningCPUs, runningRAM, disks []int
+	seenDisks := make(map[string]bool)
+
+	addRunning := func(res *VMResources) {
+		used.CPUs += res.CPUs
+		used.RAMMB += res.RAMMB
+		runningCPUs = append(runningCPUs, res.CPUs)
+		runningRAM = append(runningRAM, res.RAMMB)
+	}
+
+	for _, vmName := range app.VMDB.GetNames() {
+		vm, errG := app.VMDB.GetByName(vmName)
+		if errG != nil {
+			return errG
+		}
+
+		res := VMConfigResources(vm.Config, false)
+		for _, disk := range vm.Config.Disks {
+			volName := vmGenDataDiskName(vmName, disk)
+			if disk.Persist && !seenDisks[volName] {
+				seenDisks[volName] = true
+				res.DiskMB += int(disk.Size / 1024 / 1024)
+			}
+		}
+		used.DiskMB += res.DiskMB
+		disks = append(disks, res.DiskMB)
+
+		if running, _ := VMIsRunning(vmName, app); running {
+			addRunning(res)
+		}
+	}
+
+	for _, entry := range app.VMDB.GetMaternityEntries() {
+		res := VMConfigResources(entry.VM.Config, true)
+		used.DiskMB += res.DiskMB
+		addRunning(res)
+	}
+
+	var reserve VMResources
+	if !replace {
+		n := app.Config.AutoRebuildMaxParallel
+		reserve.CPUs = capacityTopSum(append(runningCPUs, extra.CPUs), n)
+		reserve.RAMMB = capacityTopSum(append(runningRAM, extra.RAMMB), n)
+		reserve.DiskMB = capacityTopSum(append(disks, extra.DiskMB), n)
+	}
+
+	var problems []string
+	check := func(name string, unit string, used int, extra int, reserve int, total int, ratio float64) {
+		if ratio == 0 || extra == 0 {
+			return
+		}
+		limit := int(float64(total) * ratio)
+		if used+extra+reserve > limit {
+			problems = append(problems, fmt.Sprintf(
+				"%s: %d%s requested, %d%s used, %d%s kept for rebuilds, limit is %d%s (%d%s × %.2f)",
+				name, extra, unit, used, unit, reserve, unit, limit, unit, total, unit, ratio))
+		}
+	}
+
+	check("CPU", "", used.CPUs, extra.CPUs, reserve.CPUs, int(infos.Cpus), app.Config.OvercommitCPURatio)
+	check("RAM", "MB", used.RAMMB, extra.RAMMB, reserve.RAMMB, int(infos.Memory/1024), app.Config.OvercommitRAMRatio)
+	check("disk", "MB", used.DiskMB, extra.DiskMB, reserve.DiskMB, int(poolInfos.Capacity/1024/1024), app.Config.OvercommitDiskRatio)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	msg := "host capacity exceeded (" + strings.Join(problems, "; ") + ")"
+	if app.Config.OvercommitPolicy == OvercommitPolicyWarn {
+		log.Warning(msg)
+		return nil
+	}
+	return errors.New(msg)
+}
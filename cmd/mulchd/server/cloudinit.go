@@ -2,9 +2,11 @@ package server
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -29,12 +31,48 @@ func cloudInitUserData(templateFile string, variables map[string]interface{}) ([
 	return []byte(expanded), nil
 }
 
-func cloudInitExtraEnv(envMap map[string]string) string {
-	res := ""
-	for key, val := range envMap {
-		res = res + fmt.Sprintf("export %s=\"%s\"; ", key, val)
+// secrets references are resolved here, and only here: values using
+// secrets are returned apart (secretEnv), since they're written to a
+// file only readable by the app user and the super user
+func cloudInitExtraEnv(envMap map[string]string, project string, secrets *SecretDatabase) (string, string, error) {
+	var keys []string
+	for key := range envMap {
+		keys = append(keys, key)
 	}
-	return res
+	sort.Strings(keys)
+
+	env := ""
+	secretEnv := ""
+	for _, key := range keys {
+		val := envMap[key]
+		if len(SecretReferences(val)) == 0 {
+			env = env + fmt.Sprintf("export %s=%s; ", key, cloudInitShellQuote(val))
+			continue
+		}
+		val, err := secrets.Resolve(val, project)
+		if err != nil {
+			return "", "", fmt.Errorf("env '%s': %s", key, err)
+		}
+		secretEnv = secretEnv + fmt.Sprintf("export %s=%s\n", key, cloudInitShellQuote(val))
+	}
+	return env, secretEnv, nil
+}
+
+// quotes a value for a POSIX shell; multi-line values are rebuilt with
+// printf, since mulch.env content is a YAML block of the template
+func cloudInitShellQuote(val string) string {
+	quote := func(str string) string {
+		return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+	}
+
+	if !strings.ContainsAny(val, "\r\n") {
+		return quote(val)
+	}
+
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, "\r", `\r`, -1)
+	val = strings.Replace(val, "\n", `\n`, -1)
+	return `"$(printf '%b' ` + quote(val) + `)"`
 }
 
 // CloudInitDataGen will return CloudInit meta-data and user-data
@@ -59,6 +97,8 @@ func CloudInitDataGen(vm *VM, vmName *VMName, app *App) (string, string, error)
 		domains = append(domains, domain.Name)
 	}
 
+	project, shortName := SplitProjectVMName(vmName.Name)
+
 	// 1 - create cidata file contents
 	metaData := cloudInitMetaData(vm.SecretUUID, vm.Config.Hostname)
 
@@ -70,7 +110,8 @@ func CloudInitDataGen(vm *VM, vmName *VMName, app *App) (string, string, error)
 	userDataVariables["_MULCH_SUPER_USER"] = app.Config.MulchSuperUser
 	userDataVariables["_TIMEZONE"] = vm.Config.Timezone
 	userDataVariables["_APP_USER"] = vm.Config.AppUser
-	userDataVariables["_VM_NAME"] = vmName.Name
+	userDataVariables["_VM_NAME"] = shortName
+	userDataVariables["_PROJECT"] = project
 	userDataVariables["_VM_REVISION"] = vmName.Revision
 	userDataVariables["_KEY_DESC"] = vm.AuthorKey
 	userDataVariables["_MULCH_VERSION"] = Version
@@ -78,7 +119,33 @@ func CloudInitDataGen(vm *VM, vmName *VMName, app *App) (string, string, error)
 	userDataVariables["_DOMAINS"] = strings.Join(domains, ",")
 	userDataVariables["_DOMAIN_FIRST"] = firstDomain
 	userDataVariables["_MULCH_PROXY_IP"] = mulchIP
-	userDataVariables["__EXTRA_ENV"] = cloudInitExtraEnv(vm.Config.Env)
+	userDataVariables["_MAC"] = vm.AssignedMAC
+
+	// static IPv6, applied by mulch-ipv6 service (empty = no IPv6)
+	userDataVariables["_IPV6"] = ""
+	userDataVariables["_IPV6_PREFIX_LEN"] = ""
+	userDataVariables["_IPV6_GATEWAY"] = ""
+	if vm.AssignedIPv6 != "" {
+		prefix, err := app.NetworkIPv6Prefix()
+		if err != nil {
+			return "", "", err
+		}
+		if prefix != nil {
+			ones, _ := prefix.Mask.Size()
+			userDataVariables["_IPV6"] = vm.AssignedIPv6
+			userDataVariables["_IPV6_PREFIX_LEN"] = strconv.Itoa(ones)
+			userDataVariables["_IPV6_GATEWAY"] = app.NetworkIPv6().Address
+		}
+	}
+
+	extraEnv, secretEnv, err := cloudInitExtraEnv(vm.Config.Env, vm.Config.Project, app.SecretsDB)
+	if err != nil {
+		return "", "", err
+	}
+	userDataVariables["__EXTRA_ENV"] = extraEnv
+	// base64, so any value is safe in the YAML template
+	userDataVariables["_SECRET_ENV_B64"] = base64.StdEncoding.EncodeToString([]byte(secretEnv))
+	userDataVariables["__DISKS"] = cloudInitDataDisks(vm.Config)
 
 	userData, err := cloudInitUserData(userDataTemplate, userDataVariables)
 	if err != nil {
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSpec is a parsed standard 5-fields cron expression
+// (minute, hour, day of month, month, day of week)
+type CronSpec struct {
+	minutes  map[int]bool
+	hours    map[int]bool
+	doms     map[int]bool
+	months   map[int]bool
+	dows     map[int]bool
+	domStar  bool
+	dowStar  bool
+	original string
+}
+
+// cronMaxLookup limits Prev() search (leap years, 31th of February, …)
+const cronMaxLookup = 5 * 366 * 24 * time.Hour
+
+// IsCronExpression returns true if str looks like a cron expression
+// (and not a keyword like "daily")
+func IsCronExpression(str string) bool {
+	return len(strings.Fields(str)) == 5
+}
+
+// ParseCronSpec parses a cron expression like "30 3 * * 1-5"
+func ParseCronSpec(expr string) (*CronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", expr)
+	}
+
+	// like Vixie cron, "*/n" is still a star for day fields
+	spec := &CronSpec{
+		original: expr,
+		domStar:  strings.HasPrefix(fields[2], "*"),
+		dowStar:  strings.HasPrefix(fields[4], "*"),
+	}
+
+	var err error
+	if spec.minutes, err = cronParseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("cron minute field: %s", err)
+	}
+	if spec.hours, err = cronParseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("cron hour field: %s", err)
+	}
+	if spec.doms, err = cronParseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("cron day of month field: %s", err)
+	}
+	if spec.months, err = cronParseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("cron month field: %s", err)
+	}
+	if spec.dows, err = cronParseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("cron day of week field: %s", err)
+	}
+	// 7 is also sunday
+	if spec.dows[7] {
+		spec.dows[0] = true
+	}
+
+	return spec, nil
+}
+
+// supports: *, */n, a, a/n (same as a-max/n), a-b, a-b/n and lists (a,b-c)
+func cronParseField(field string, min int, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		hasStep := false
+		if pos := strings.Index(part, "/"); pos != -1 {
+			var err error
+			step, err = strconv.Atoi(part[pos+1:])
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:pos]
+			hasStep = true
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.Split(part, "-")
+			if len(bounds) > 2 {
+				return nil, fmt.Errorf("invalid range '%s'", part)
+			}
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s'", bounds[0])
+			}
+			to = from
+			if hasStep {
+				to = max
+			}
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid value '%s'", bounds[1])
+				}
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("'%s' is out of range (%d-%d)", part, min, max)
+		}
+
+		for i := from; i <= to; i += step {
+			values[i] = true
+		}
+	}
+	return values, nil
+}
+
+func (spec *CronSpec) matchDay(t time.Time) bool {
+	if !spec.months[int(t.Month())] {
+		return false
+	}
+
+	dom := spec.doms[t.Day()]
+	dow := spec.dows[int(t.Weekday())]
+
+	// usual cron behavior: if both fields are restricted, any match is OK
+	if !spec.domStar && !spec.dowStar {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Match returns true if t matches the expression (to the minute)
+func (spec *CronSpec) Match(t time.Time) bool {
+	return spec.matchDay(t) && spec.hours[t.Hour()] && spec.minutes[t.Minute()]
+}
+
+// Prev returns the latest time matching the expression, before or
+// equal to t (zero time if nothing was found)
+func (spec *CronSpec) Prev(t time.Time) time.Time {
+	limit := t.Add(-cronMaxLookup)
+	t = t.Truncate(time.Minute)
+
+	for t.After(limit) {
+		if !spec.matchDay(t) {
+			// last minute of the previous day
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()).Add(-time.Minute)
+			continue
+		}
+		if !spec.hours[t.Hour()] {
+			// last minute of the previous hour
+			t = t.Add(-time.Duration(t.Minute()+1) * time.Minute)
+			continue
+		}
+		if !spec.minutes[t.Minute()] {
+			t = t.Add(-time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (spec *CronSpec) String() string {
+	return spec.original
+}
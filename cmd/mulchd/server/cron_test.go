@@ -0,0 +1,152 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCronParseField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		wantErr  bool
+	}{
+		{field: "5", min: 0, max: 59, want: []int{5}},
+		{field: "1,3,5", min: 0, max: 59, want: []int{1, 3, 5}},
+		{field: "10-12", min: 0, max: 59, want: []int{10, 11, 12}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "5/15", min: 0, max: 59, want: []int{5, 20, 35, 50}},
+		{field: "10-20/5", min: 0, max: 59, want: []int{10, 15, 20}},
+		{field: "1-3,20/2", min: 0, max: 23, want: []int{1, 2, 3, 20, 22}},
+		{field: "*/10", min: 1, max: 31, want: []int{1, 11, 21, 31}},
+		{field: "60", min: 0, max: 59, wantErr: true},
+		{field: "0", min: 1, max: 12, wantErr: true},
+		{field: "5-1", min: 0, max: 59, wantErr: true},
+		{field: "1-2-3", min: 0, max: 59, wantErr: true},
+		{field: "*/0", min: 0, max: 59, wantErr: true},
+		{field: "a", min: 0, max: 59, wantErr: true},
+		{field: "", min: 0, max: 59, wantErr: true},
+	}
+
+	for _, test := range tests {
+		values, err := cronParseField(test.field, test.min, test.max)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected", test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.field, err)
+			continue
+		}
+		want := make(map[int]bool)
+		for _, v := range test.want {
+			want[v] = true
+		}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("'%s': got %v, want %v", test.field, values, want)
+		}
+	}
+}
+
+func TestCronSpecMatch(t *testing.T) {
+	date := func(str string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04", str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// 2020-07-05 is a sunday
+	tests := []struct {
+		expr string
+		time string
+		want bool
+	}{
+		{"30 3 * * *", "2020-07-05 03:30", true},
+		{"30 3 * * *", "2020-07-05 03:31", false},
+		{"5/15 * * * *", "2020-07-05 10:20", true},
+		{"5/15 * * * *", "2020-07-05 10:05", true},
+		{"5/15 * * * *", "2020-07-05 10:15", false},
+		{"0 3 * * 1-5", "2020-07-05 03:00", false},
+		{"0 3 * * 1-5", "2020-07-06 03:00", true},
+		{"0 3 * * 7", "2020-07-05 03:00", true},
+		{"0 3 * * 0", "2020-07-05 03:00", true},
+		{"0 3 * * 6-7", "2020-07-05 03:00", true},
+		// dom or dow, when both are restricted
+		{"0 3 1 * 1", "2020-07-01 03:00", true},
+		{"0 3 1 * 1", "2020-07-06 03:00", true},
+		{"0 3 1 * 1", "2020-07-07 03:00", false},
+		// dom and dow, when one of them is a star
+		{"0 3 1 * *", "2020-07-06 03:00", false},
+		{"0 3 */2 * 1", "2020-07-06 03:00", false},
+		{"0 3 */2 * 1", "2020-07-13 03:00", true},
+		{"0 3 * 2 *", "2020-07-05 03:00", false},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseCronSpec(test.expr)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.expr, err)
+			continue
+		}
+		if got := spec.Match(date(test.time)); got != test.want {
+			t.Errorf("'%s' at %s: got %t, want %t", test.expr, test.time, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8"} {
+		if _, err := ParseCronSpec(expr); err == nil {
+			t.Errorf("'%s': error expected", expr)
+		}
+	}
+}
+
+func TestCronSpecPrev(t *testing.T) {
+	date := func(str string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04", str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	tests := []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"30 3 * * *", "2020-07-05 03:30", "2020-07-05 03:30"},
+		{"30 3 * * *", "2020-07-05 03:29", "2020-07-04 03:30"},
+		{"5/15 * * * *", "2020-07-05 10:04", "2020-07-05 09:50"},
+		{"0 3 * * 1-5", "2020-07-05 12:00", "2020-07-03 03:00"},
+		{"0 0 1 * *", "2020-03-15 12:00", "2020-03-01 00:00"},
+		{"0 0 29 2 *", "2021-03-01 00:00", "2020-02-29 00:00"},
+		{"0 3 1 * 1", "2020-07-05 12:00", "2020-07-01 03:00"},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseCronSpec(test.expr)
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.expr, err)
+			continue
+		}
+		got := spec.Prev(date(test.from))
+		if !got.Equal(date(test.want)) {
+			t.Errorf("'%s' from %s: got %s, want %s", test.expr, test.from, got, test.want)
+		}
+	}
+
+	// impossible date
+	spec, err := ParseCronSpec("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := spec.Prev(date("2020-07-05 12:00")); !got.IsZero() {
+		t.Errorf("31th of February: got %s, want zero time", got)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DoHistoryMaxRuns is the number of runs kept per VM action
+const DoHistoryMaxRuns = 20
+
+// DoHistoryMaxOutput is the maximum size of the stored output of a run
+const DoHistoryMaxOutput = 64 * 1024
+
+// DoActionRun is the result of a do-action run (manual or scheduled)
+type DoActionRun struct {
+	Start      time.Time
+	Duration   time.Duration
+	Scheduled  bool
+	ExitStatus int
+	Error      string
+	Output     string
+}
+
+// DoHistoryDatabase stores results of do-action runs, per VM and action
+type DoHistoryDatabase struct {
+	filename string
+	db       map[string][]*DoActionRun
+	mutex    sync.Mutex
+}
+
+// NewDoHistoryDatabase instanciates a new DoHistoryDatabase
+func NewDoHistoryDatabase(filename string) (*DoHistoryDatabase, error) {
+	db := &DoHistoryDatabase{
+		filename: filename,
+		db:       make(map[string][]*DoActionRun),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(db.filename); err == nil {
+		err = db.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the file to check if it's writable
+	err := db.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// This is done internaly, because it must be done with the mutex locked,
+// but we can't lock it here, since save() is called by functions that
+// are already locking the mutex.
+func (db *DoHistoryDatabase) save() error {
+	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&db.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *DoHistoryDatabase) load() error {
+	f, err := os.Open(db.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	requiredMode, err := strconv.ParseInt("0600", 8, 32)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode() != os.FileMode(requiredMode) {
+		return fmt.Errorf("%s: only the owner should be able to read/write this file (mode 0600)", db.filename)
+	}
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&db.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func doHistoryKey(vmName string, action string) string {
+	return vmName + "/" + action
+}
+
+// Add a run to the history of the action (oldest runs are removed)
+func (db *DoHistoryDatabase) Add(vmName string, action string, run *DoActionRun) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if len(run.Output) > DoHistoryMaxOutput {
+		// don't cut in the middle of a multi-byte character
+		cut := len(run.Output) - DoHistoryMaxOutput
+		for cut < len(run.Output) && !utf8.RuneStart(run.Output[cut]) {
+			cut++
+		}
+		run.Output = "[…]\n" + run.Output[cut:]
+	}
+
+	key := doHistoryKey(vmName, action)
+	runs := append(db.db[key], run)
+	if len(runs) > DoHistoryMaxRuns {
+		runs = runs[len(runs)-DoHistoryMaxRuns:]
+	}
+	db.db[key] = runs
+
+	return db.save()
+}
+
+// Get the history of an action (oldest first)
+func (db *DoHistoryDatabase) Get(vmName string, action string) []*DoActionRun {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.db[doHistoryKey(vmName, action)]
+}
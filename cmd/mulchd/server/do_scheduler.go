@@ -0,0 +1,201 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DoActionScheduler runs do-actions with a 'schedule' setting
+type DoActionScheduler struct {
+	app      *App
+	lastTick time.Time
+	running  map[string]bool
+	mutex    sync.Mutex
+}
+
+// NewDoActionScheduler creates a new DoActionScheduler
+func NewDoActionScheduler(app *App) *DoActionScheduler {
+	return &DoActionScheduler{
+		app:      app,
+		lastTick: time.Now(),
+		running:  make(map[string]bool),
+	}
+}
+
+// Run the scheduler loop
+func (sched *DoActionScheduler) Run() {
+	sched.app.VMStateDB.WaitRestore()
+
+	for {
+		time.Sleep(time.Minute)
+		now := time.Now()
+		sched.tick(sched.lastTick, now)
+		sched.lastTick = now
+	}
+}
+
+// run all actions scheduled in the ]from, to] interval
+func (sched *DoActionScheduler) tick(from time.Time, to time.Time) {
+	app := sched.app
+
+	sched.mutex.Lock()
+	defer sched.mutex.Unlock()
+
+	for _, vmName := range app.VMDB.GetNames() {
+		entry, err := app.VMDB.GetEntryByName(vmName)
+		if err != nil || entry.Active == false || entry.VM.WIP != VMOperationNone {
+			continue
+		}
+
+		for _, action := range entry.VM.Config.DoActions {
+			if action.Schedule == "" {
+				continue
+			}
+
+			spec, err := ParseCronSpec(action.Schedule)
+			if err != nil {
+				app.Log.Errorf("VM %s, action '%s': %s", vmName, action.Name, err)
+				continue
+			}
+
+			if !spec.Prev(to).After(from) {
+				continue
+			}
+
+			key := doHistoryKey(vmName.Name, action.Name)
+			if sched.running[key] {
+				app.Log.Warningf("VM %s: scheduled action '%s' is still running, skipped", vmName, action.Name)
+				continue
+			}
+			sched.running[key] = true
+
+			go func(vm *VM, vmName *VMName, action *VMDoAction) {
+				sched.runAction(vm, vmName, action)
+
+				sched.mutex.Lock()
+				delete(sched.running, key)
+				sched.mutex.Unlock()
+			}(entry.VM, vmName, action)
+		}
+	}
+}
+
+func (sched *DoActionScheduler) runAction(vm *VM, vmName *VMName, action *VMDoAction) {
+	app := sched.app
+
+	running, _ := VMIsRunning(vmName, app)
+	if running == false {
+		return
+	}
+
+	log := NewLog(vm.Config.Name, app.Hub, app.LogHistory)
+	log.Infof("running scheduled action '%s'", action.Name)
+
+	operation := app.Operations.Add(&Operation{
+		Origin:        "[do-scheduler]",
+		Action:        "do:" + action.Name,
+		Ressource:     "vm",
+		RessourceName: vmName.ID(),
+	})
+	defer app.Operations.Remove(operation)
+
+	run := VMDoActionRun(vm, vmName, action, "", DoActionScheduled, nil, app, log)
+
+	if run.Error != "" {
+		log.Errorf("scheduled action '%s' failed: %s", action.Name, run.Error)
+		app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Scheduled action",
+			Content: fmt.Sprintf("scheduled action '%s' failed on VM %s: %s", action.Name, vmName.ID(), run.Error),
+			Project: vm.Config.Project,
+		})
+		return
+	}
+	log.Infof("scheduled action '%s' returned 0 (%s)", action.Name, run.Duration)
+}
+
+// DoActionRun trigger
+const (
+	DoActionScheduled = true
+	DoActionManual    = false
+)
+
+// VMDoActionRun executes a do-action in the VM and records the result in
+// the action history (output is streamed to log, and also captured)
+func VMDoActionRun(vm *VM, vmName *VMName, action *VMDoAction, arguments string, scheduled bool, closeChannel <-chan bool, app *App, log *Log) *DoActionRun {
+	result := &DoActionRun{
+		Start:      time.Now(),
+		Scheduled:  scheduled,
+		ExitStatus: -1,
+	}
+
+	var output strings.Builder
+	var outputMutex sync.Mutex
+	// output is stored and served by the API, secrets must be masked
+	appendOutput := func(line string) {
+		line = app.SecretsDB.Mask(line)
+		outputMutex.Lock()
+		defer outputMutex.Unlock()
+		if output.Len() < 4*DoHistoryMaxOutput {
+			output.WriteString(line + "\n")
+		}
+	}
+
+	err := func() error {
+		content, _, errG := app.ScriptCache.Get(action.ScriptURL, action.SHA256, log)
+		if errG != nil {
+			return fmt.Errorf("unable to get script '%s': %s", action.ScriptURL, errG)
+		}
+
+		SSHSuperUserAuth, err := app.SSHPairDB.GetPublicKeyAuth(SSHSuperUserPair)
+		if err != nil {
+			return err
+		}
+
+		run := &Run{
+			Caption: "do",
+			SSHConn: &SSHConnection{
+				User: app.Config.MulchSuperUser,
+				Host: vm.LastIP,
+				Port: 22,
+				Auths: []ssh.AuthMethod{
+					SSHSuperUserAuth,
+				},
+				Log: log,
+			},
+			Tasks: []*RunTask{
+				&RunTask{
+					ScriptName:   ScriptBaseName(action.ScriptURL),
+					ScriptReader: bytes.NewReader(content),
+					As:           action.User,
+					Arguments:    arguments,
+				},
+			},
+			Log:            log,
+			CloseChannel:   closeChannel,
+			StdoutCallback: appendOutput,
+			StderrCallback: appendOutput,
+		}
+		err = run.Go()
+		result.ExitStatus = run.ExitStatus
+		return err
+	}()
+
+	result.Duration = time.Now().Sub(result.Start)
+	if err != nil {
+		result.Error = app.SecretsDB.Mask(err.Error())
+	}
+	result.Output = output.String()
+
+	errH := app.DoHistoryDB.Add(vmName.Name, action.Name, result)
+	if errH != nil {
+		log.Errorf("unable to save action history: %s", errH)
+	}
+
+	return result
+}
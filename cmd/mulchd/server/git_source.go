@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Git script sources:
+// git+ssh://git@host/repo.git//path/script.sh@ref
+// git+https://host/repo.git//path/script.sh@ref
+// (ref is a branch, a tag or a commit, default is HEAD)
+const (
+	GitSourcePrefix  = "git+"
+	gitSourcePathSep = "//"
+)
+
+// gitSourceFetchDelay avoids fetching the same repository for each
+// script of a build
+const gitSourceFetchDelay = 30 * time.Second
+
+// gitSourceTimeout is the maximum duration of a git command (a stuck
+// clone or fetch would block the repository, and the whole build)
+const gitSourceTimeout = 5 * time.Minute
+
+// GitSourceURL is a parsed git script URL
+type GitSourceURL struct {
+	Repository string // URL usable by git (ssh://… or https://…)
+	Path       string
+	Ref        string
+}
+
+// GitSources manages local mirrors of git repositories used as script
+// sources, using mulchd deploy key (see SSHGitPair)
+type GitSources struct {
+	path      string
+	keyFile   string
+	lastFetch map[string]time.Time
+	repoMutex map[string]*sync.Mutex
+	mutex     sync.Mutex
+}
+
+// IsGitSourceURL returns true if the URL is a git script source
+func IsGitSourceURL(sourceURL string) bool {
+	return strings.HasPrefix(sourceURL, GitSourcePrefix+"ssh://") ||
+		strings.HasPrefix(sourceURL, GitSourcePrefix+"https://")
+}
+
+// ParseGitSourceURL parses a git+ssh:// or git+https:// URL
+func ParseGitSourceURL(sourceURL string) (*GitSourceURL, error) {
+	if !IsGitSourceURL(sourceURL) {
+		return nil, fmt.Errorf("'%s' is not a git source URL", sourceURL)
+	}
+
+	str := strings.TrimPrefix(sourceURL, GitSourcePrefix)
+	schemeEnd := strings.Index(str, "://") + 3
+
+	sep := strings.Index(str[schemeEnd:], gitSourcePathSep)
+	if sep == -1 {
+		return nil, fmt.Errorf("'%s': no '//' separator between repository and path", sourceURL)
+	}
+	sep += schemeEnd
+
+	src := &GitSourceURL{
+		Repository: str[:sep],
+		Path:       str[sep+len(gitSourcePathSep):],
+		Ref:        "HEAD",
+	}
+
+	if at := strings.LastIndex(src.Path, "@"); at != -1 {
+		src.Ref = src.Path[at+1:]
+		src.Path = src.Path[:at]
+	}
+
+	if src.Path == "" || src.Ref == "" {
+		return nil, fmt.Errorf("'%s': empty path or ref", sourceURL)
+	}
+	// don't let anything look like a git option
+	if strings.HasPrefix(src.Ref, "-") || strings.HasPrefix(src.Path, "-") {
+		return nil, fmt.Errorf("'%s': invalid path or ref", sourceURL)
+	}
+
+	return src, nil
+}
+
+// GitSourceRedactURL removes credentials (if any) from a repository
+// URL, so it can be logged
+func GitSourceRedactURL(repository string) string {
+	u, err := url.Parse(repository)
+	if err != nil || u.User == nil {
+		return repository
+	}
+	u.User = nil
+	return u.String()
+}
+
+// NewGitSources instanciates a new GitSources, mirrors are stored in path
+func NewGitSources(path string, deployKey *SSHPair) (*GitSources, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile := filepath.Join(path, "deploy_key")
+	err = ioutil.WriteFile(keyFile, []byte(deployKey.Private), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GitSources{
+		path:      path,
+		keyFile:   keyFile,
+		lastFetch: make(map[string]time.Time),
+		repoMutex: make(map[string]*sync.Mutex),
+	}, nil
+}
+
+func (gs *GitSources) lockRepository(repository string) func() {
+	gs.mutex.Lock()
+	mutex, exists := gs.repoMutex[repository]
+	if !exists {
+		mutex = &sync.Mutex{}
+		gs.repoMutex[repository] = mutex
+	}
+	gs.mutex.Unlock()
+
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+func (gs *GitSources) git(dir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitSourceTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_SSH_COMMAND=ssh -i "+gs.keyFile+" -o IdentitiesOnly=yes -o BatchMode=yes -o StrictHostKeyChecking=accept-new",
+	)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("git %s: timeout after %s", args[0], gitSourceTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s (%s)", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// update (or create) the local mirror of the repository
+func (gs *GitSources) update(repository string, dir string, log *Log) error {
+	gs.mutex.Lock()
+	lastFetch := gs.lastFetch[repository]
+	gs.mutex.Unlock()
+
+	if time.Now().Sub(lastFetch) < gitSourceFetchDelay {
+		return nil
+	}
+
+	var err error
+	if _, errS := os.Stat(dir); os.IsNotExist(errS) {
+		log.Infof("cloning %s", GitSourceRedactURL(repository))
+		_, err = gs.git(gs.path, "clone", "--mirror", "--quiet", repository, dir)
+	} else {
+		_, err = gs.git(dir, "remote", "update", "--prune")
+	}
+	if err != nil {
+		// git output may contain the URL
+		return errors.New(strings.Replace(err.Error(), repository, GitSourceRedactURL(repository), -1))
+	}
+
+	gs.mutex.Lock()
+	gs.lastFetch[repository] = time.Now()
+	gs.mutex.Unlock()
+	return nil
+}
+
+// Get returns the content of the file pointed by a git source URL, and
+// the resolved commit SHA. If the repository can't be fetched, the
+// local mirror is used (if any).
+func (gs *GitSources) Get(sourceURL string, log *Log) ([]byte, string, error) {
+	src, err := ParseGitSourceURL(sourceURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	unlock := gs.lockRepository(src.Repository)
+	defer unlock()
+
+	hash := sha256.Sum256([]byte(src.Repository))
+	dir := filepath.Join(gs.path, hex.EncodeToString(hash[:8])+".git")
+
+	err = gs.update(src.Repository, dir, log)
+	if err != nil {
+		if _, errS := os.Stat(dir); errS != nil {
+			return nil, "", err
+		}
+		log.Warningf("%s, using local mirror", err)
+	}
+
+	out, err := gs.git(dir, "rev-parse", "--verify", "--quiet", src.Ref+"^{commit}")
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to resolve '%s' in %s", src.Ref, GitSourceRedactURL(src.Repository))
+	}
+	commit := strings.TrimSpace(string(out))
+
+	content, err := gs.git(dir, "show", commit+":"+src.Path)
+	if err != nil {
+		return nil, "", fmt.Errorf("'%s' not found at %s in %s", src.Path, commit, GitSourceRedactURL(src.Repository))
+	}
+
+	return content, commit, nil
+}
+
+// ScriptBaseName returns the file name of a script URL (git or not)
+func ScriptBaseName(scriptURL string) string {
+	if src, err := ParseGitSourceURL(scriptURL); err == nil {
+		return path.Base(src.Path)
+	}
+	return path.Base(scriptURL)
+}
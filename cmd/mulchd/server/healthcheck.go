@@ -0,0 +1,354 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// VM health values
+const (
+	VMHealthNone      = "" // no healthcheck defined
+	VMHealthUnknown   = "unknown"
+	VMHealthHealthy   = "healthy"
+	VMHealthUnhealthy = "unhealthy"
+)
+
+// HealthMonitor runs healthchecks of active VMs in the background
+type HealthMonitor struct {
+	app    *App
+	states map[string]*healthCheckState
+	mutex  sync.Mutex
+}
+
+// healthCheckState tracks a check of a specific VM revision
+type healthCheckState struct {
+	Health    string
+	Failures  int
+	Successes int
+	LastRun   time.Time
+	LastError error
+	Running   bool
+}
+
+// NewHealthMonitor creates a new HealthMonitor
+func NewHealthMonitor(app *App) *HealthMonitor {
+	return &HealthMonitor{
+		app:    app,
+		states: make(map[string]*healthCheckState),
+	}
+}
+
+func healthCheckStateKey(vmName *VMName, check *VMHealthCheck) string {
+	return vmName.ID() + "/" + check.Name
+}
+
+// Run the health monitoring loop
+func (hm *HealthMonitor) Run() {
+	hm.app.VMStateDB.WaitRestore()
+
+	for {
+		hm.runChecks()
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (hm *HealthMonitor) runChecks() {
+	// snapshot of monitored VMs (libvirt is queried without the lock)
+	var entries []*VMDatabaseEntry
+	for _, vmName := range hm.app.VMDB.GetNames() {
+		entry, err := hm.app.VMDB.GetEntryByName(vmName)
+		if err != nil {
+			continue
+		}
+
+		// only active VMs are monitored (rebuilds check the new revision)
+		if entry.Active == false || entry.VM.WIP != VMOperationNone {
+			continue
+		}
+
+		running, _ := VMIsRunning(vmName, hm.app)
+		if running == false {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	seen := make(map[string]bool)
+
+	for _, entry := range entries {
+		for _, check := range entry.VM.Config.HealthChecks {
+			key := healthCheckStateKey(entry.Name, check)
+			seen[key] = true
+
+			state, exists := hm.states[key]
+			if !exists {
+				state = &healthCheckState{Health: VMHealthUnknown}
+				hm.states[key] = state
+			}
+
+			if state.Running || time.Now().Sub(state.LastRun) < check.Interval {
+				continue
+			}
+
+			state.Running = true
+			state.LastRun = time.Now()
+			go hm.runCheck(entry.VM, entry.Name, check, state)
+		}
+	}
+
+	// forget deleted VMs, inactive revisions, removed checks, …
+	for key := range hm.states {
+		if !seen[key] {
+			delete(hm.states, key)
+		}
+	}
+}
+
+func (hm *HealthMonitor) runCheck(vm *VM, vmName *VMName, check *VMHealthCheck, state *healthCheckState) {
+	err := HealthCheckRun(vm, check, hm.app)
+
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	state.Running = false
+	state.LastError = err
+
+	previous := state.Health
+	if err == nil {
+		state.Failures = 0
+		state.Successes++
+		if state.Successes >= check.SuccessThreshold {
+			state.Health = VMHealthHealthy
+		}
+	} else {
+		hm.app.Log.Tracef("healthcheck '%s' failed for %s: %s", check.Name, vmName, err)
+		state.Successes = 0
+		state.Failures++
+		if state.Failures >= check.FailureThreshold {
+			state.Health = VMHealthUnhealthy
+		}
+	}
+
+	if previous == state.Health {
+		return
+	}
+
+	switch {
+	case state.Health == VMHealthUnhealthy:
+		hm.app.Log.Errorf("VM %s is unhealthy (healthcheck '%s': %s)", vmName, check.Name, err)
+		go hm.app.AlertSender.Send(&Alert{
+			Type:    AlertTypeBad,
+			Subject: "Healthcheck",
+			Content: fmt.Sprintf("VM %s is unhealthy (healthcheck '%s': %s)", vmName, check.Name, err),
+			Project: vm.Config.Project,
+		})
+	case state.Health == VMHealthHealthy && previous == VMHealthUnhealthy:
+		hm.app.Log.Infof("VM %s is healthy again (healthcheck '%s')", vmName, check.Name)
+		go hm.app.AlertSender.Send(&Alert{
+			Type:    AlertTypeGood,
+			Subject: "Healthcheck",
+			Content: fmt.Sprintf("VM %s is healthy again (healthcheck '%s')", vmName, check.Name),
+			Project: vm.Config.Project,
+		})
+	}
+}
+
+// GetHealth returns the global health of a VM: unhealthy if any check
+// is unhealthy, healthy if all checks are healthy, unknown otherwise.
+func (hm *HealthMonitor) GetHealth(vmName *VMName, vm *VM) string {
+	if len(vm.Config.HealthChecks) == 0 {
+		return VMHealthNone
+	}
+
+	hm.mutex.Lock()
+	defer hm.mutex.Unlock()
+
+	healthy := 0
+	for _, check := range vm.Config.HealthChecks {
+		state, exists := hm.states[healthCheckStateKey(vmName, check)]
+		if !exists {
+			continue
+		}
+		switch state.Health {
+		case VMHealthUnhealthy:
+			return VMHealthUnhealthy
+		case VMHealthHealthy:
+			healthy++
+		}
+	}
+
+	if healthy == len(vm.Config.HealthChecks) {
+		return VMHealthHealthy
+	}
+	return VMHealthUnknown
+}
+
+// HealthCheckRun runs a single probe of check on the VM
+func HealthCheckRun(vm *VM, check *VMHealthCheck, app *App) error {
+	if vm.LastIP == "" {
+		return errors.New("VM has no IP")
+	}
+
+	switch check.Type {
+	case VMHealthCheckTypeHTTP:
+		return healthCheckHTTP(vm, check)
+	case VMHealthCheckTypeTCP:
+		return healthCheckTCP(vm, check)
+	case VMHealthCheckTypeCommand:
+		return healthCheckCommand(vm, check, app)
+	}
+	return fmt.Errorf("unknown healthcheck type '%s'", check.Type)
+}
+
+func healthCheckHTTP(vm *VM, check *VMHealthCheck) error {
+	client := http.Client{
+		Timeout: check.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	url := "http://" + net.JoinHostPort(vm.LastIP, strconv.Itoa(check.Port)) + check.Path
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if check.Domain != "" {
+		req.Host = check.Domain
+	}
+	req.Header.Set("User-Agent", "mulchd-healthcheck")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != check.Status {
+		return fmt.Errorf("got status %d, expected %d", res.StatusCode, check.Status)
+	}
+	return nil
+}
+
+func healthCheckTCP(vm *VM, check *VMHealthCheck) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(vm.LastIP, strconv.Itoa(check.Port)), check.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+func healthCheckCommand(vm *VM, check *VMHealthCheck, app *App) error {
+	SSHSuperUserAuth, err := app.SSHPairDB.GetPublicKeyAuth(SSHSuperUserPair)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	conn := &SSHConnection{
+		User: app.Config.MulchSuperUser,
+		Host: vm.LastIP,
+		Port: 22,
+		Auths: []ssh.AuthMethod{
+			SSHSuperUserAuth,
+		},
+		Timeout: check.Timeout,
+		Log:     app.Log,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		// this goroutine owns the connection
+		defer conn.Close()
+
+		if err := conn.Connect(); err != nil {
+			errChan <- err
+			return
+		}
+
+		// interrupt a stuck command on timeout
+		finished := make(chan bool)
+		defer close(finished)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Client.Close()
+			case <-finished:
+			}
+		}()
+
+		conn.Session.Stdin = strings.NewReader(check.Command)
+		out, err := conn.Session.CombinedOutput(fmt.Sprintf("sudo -iu %s bash -s", check.As))
+		if err != nil {
+			errChan <- fmt.Errorf("%s (output: %s)", err, strings.TrimSpace(string(out)))
+			return
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err = <-errChan:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout after %s", check.Timeout)
+	}
+	return err
+}
+
+// vmWaitHealthyMaxRunsFactor limits the number of runs of a flapping
+// check (never reaching one of its thresholds), as a multiple of the sum
+// of its thresholds
+const vmWaitHealthyMaxRunsFactor = 10
+
+// VMWaitHealthy runs all VM healthchecks until they reach their success
+// threshold. An error is returned as soon as a check reaches its
+// failure threshold (consecutive failures, like the health monitor).
+func VMWaitHealthy(vm *VM, app *App, log *Log) error {
+	if len(vm.Config.HealthChecks) == 0 {
+		return nil
+	}
+
+	log.Infof("running healthchecks")
+	for _, check := range vm.Config.HealthChecks {
+		successes := 0
+		failures := 0
+		maxRuns := vmWaitHealthyMaxRunsFactor * (check.SuccessThreshold + check.FailureThreshold)
+		for runs := 1; successes < check.SuccessThreshold; runs++ {
+			err := HealthCheckRun(vm, check, app)
+			if err == nil {
+				successes++
+				failures = 0
+			} else {
+				successes = 0
+				failures++
+				log.Warningf("healthcheck '%s' failed (%d/%d): %s", check.Name, failures, check.FailureThreshold, err)
+				if failures >= check.FailureThreshold {
+					return fmt.Errorf("VM is unhealthy (healthcheck '%s': %s)", check.Name, err)
+				}
+			}
+			if successes >= check.SuccessThreshold {
+				break
+			}
+			if runs >= maxRuns {
+				return fmt.Errorf("VM is unhealthy (healthcheck '%s' is flapping, %d runs)", check.Name, runs)
+			}
+			time.Sleep(check.Interval)
+		}
+		log.Infof("healthcheck '%s' OK", check.Name)
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ type Hub struct {
 	register   chan *HubClient
 	unregister chan *HubClient
 	trace      bool
+	masker     func(string) string
 }
 
 // HubClient describes a client of a Hub
@@ -19,6 +20,7 @@ type HubClient struct {
 	Messages   chan *common.Message
 	clientInfo string
 	target     string
+	project    string
 	trace      bool
 	hub        *Hub
 }
@@ -34,6 +36,12 @@ func NewHub(trace bool) *Hub {
 	}
 }
 
+// SetMasker defines a function used to hide sensitive data (secrets) in
+// all messages
+func (h *Hub) SetMasker(masker func(string) string) {
+	h.masker = masker
+}
+
 // Run will start the Hub, allowing messages to be sent and received
 func (h *Hub) Run() {
 	for {
@@ -53,6 +61,9 @@ func (h *Hub) Run() {
 				if message.MatchTarget(client.target, common.MessageMatchDefault) == false {
 					continue // not for this client
 				}
+				if message.Target != client.target && !MessageInProject(message, client.project) {
+					continue // another project
+				}
 				if message.Type == common.MessageTrace && client.trace == false {
 					continue // this client don't want traces
 				}
@@ -75,12 +86,15 @@ func (h *Hub) Broadcast(message *common.Message) {
 
 // Register a new client of the Hub
 // clientInfo is not currently used but is supposed to differentiate
-// the client. Target may be common.MessageNoTarget.
-func (h *Hub) Register(info string, target string, trace bool) *HubClient {
+// the client. Target may be common.MessageNoTarget. If project is not
+// empty, the client only receives messages of this project VMs (and
+// of its own target).
+func (h *Hub) Register(info string, target string, project string, trace bool) *HubClient {
 	client := &HubClient{
 		Messages:   make(chan *common.Message),
 		clientInfo: info,
 		target:     target,
+		project:    project,
 		trace:      trace,
 		hub:        h,
 	}
@@ -97,3 +111,13 @@ func (hc *HubClient) Unregister() {
 func (hc *HubClient) SetTarget(target string) {
 	hc.target = target
 }
+
+// MessageInProject returns true if the message target is a VM of the
+// project (see ProjectVMName), always true if project is empty
+func MessageInProject(message *common.Message, project string) bool {
+	if project == "" {
+		return true
+	}
+	targetProject, _ := SplitProjectVMName(message.Target)
+	return targetProject == project
+}
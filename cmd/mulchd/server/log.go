@@ -27,6 +27,10 @@ func NewLog(target string, hub *Hub, history *LogHistory) *Log {
 func (log *Log) Log(message *common.Message) {
 	message.Target = log.target
 
+	if log.hub.masker != nil {
+		message.Message = log.hub.masker(message.Message)
+	}
+
 	if !(message.Type == common.MessageTrace && log.hub.trace == false) {
 		// TODO: use our own *log.Logger (see log.go in Nosee project)
 		fmt.Printf("%s(%s): %s\n", message.Type, message.Target, message.Message)
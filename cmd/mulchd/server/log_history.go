@@ -85,8 +85,9 @@ func (lh *LogHistory) Dump() {
 	}
 }
 
-// Search return an array of messages (latest messages, up to maxMessages, for a specific target)
-func (lh *LogHistory) Search(maxMessages int, target string) []*common.Message {
+// Search return an array of messages (latest messages, up to maxMessages, for a specific target,
+// limited to a project if not empty)
+func (lh *LogHistory) Search(maxMessages int, target string, project string) []*common.Message {
 	lh.mux.Lock()
 	defer lh.mux.Unlock()
 
@@ -99,7 +100,8 @@ func (lh *LogHistory) Search(maxMessages int, target string) []*common.Message {
 	curr := lh.newest
 	count := 0
 	for curr != nil && count < maxMessages {
-		if curr.payload.MatchTarget(target, exact) == false {
+		if curr.payload.MatchTarget(target, exact) == false ||
+			MessageInProject(curr.payload, project) == false {
 			curr = curr.older
 			continue
 		}
@@ -5,7 +5,10 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
 )
 
 // IPStringToInt convert an IPv4 string to a unsigned int 32
@@ -85,3 +88,178 @@ func RandomUniqueIPv4(app *App) (string, error) {
 
 	return ip, nil
 }
+
+// NetworkIPv6 returns IPv6 settings of the mulch network, or nil if the
+// network has no IPv6 prefix (or if IPv6 is disabled, see ipv6_mode)
+func (app *App) NetworkIPv6() *libvirtxml.NetworkIP {
+	if app.Config.IPv6Mode == IPv6ModeDisabled || app.Libvirt.NetworkXML == nil {
+		return nil
+	}
+	for index, ip := range app.Libvirt.NetworkXML.IPs {
+		if ip.Family == "ipv6" {
+			return &app.Libvirt.NetworkXML.IPs[index]
+		}
+	}
+	return nil
+}
+
+// NetworkIPv6Prefix returns the IPv6 prefix of the mulch network
+// (or nil, see NetworkIPv6)
+func (app *App) NetworkIPv6Prefix() (*net.IPNet, error) {
+	netIP := app.NetworkIPv6()
+	if netIP == nil {
+		return nil, nil
+	}
+	_, prefix, err := net.ParseCIDR(fmt.Sprintf("%s/%d", netIP.Address, netIP.Prefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid network IPv6 prefix: %s", err)
+	}
+	return prefix, nil
+}
+
+// IPv6IsPublic returns true if the IPv6 is a global unicast address
+// (unique local addresses, fc00::/7, are not public)
+func IPv6IsPublic(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil || ip.To4() != nil {
+		return false
+	}
+	return ip.IsGlobalUnicast() && ip[0]&0xfe != 0xfc
+}
+
+// checkNetworkIPv6 checks the mulch network against ipv6_mode setting
+func (app *App) checkNetworkIPv6() error {
+	if app.Config.IPv6Mode == IPv6ModeDisabled {
+		return nil
+	}
+
+	prefix, err := app.NetworkIPv6Prefix()
+	if err != nil {
+		return err
+	}
+
+	if prefix == nil {
+		if app.Config.IPv6Mode == IPv6ModePublic {
+			return errors.New("ipv6_mode is 'public' but mulch network has no IPv6 prefix")
+		}
+		return nil
+	}
+
+	ones, _ := prefix.Mask.Size()
+	if ones > 120 {
+		return fmt.Errorf("network IPv6 prefix %s is too small", prefix)
+	}
+
+	public := IPv6IsPublic(prefix.IP)
+	if app.Config.IPv6Mode == IPv6ModePublic && !public {
+		return fmt.Errorf("ipv6_mode is 'public' but network IPv6 prefix %s is not a public one", prefix)
+	}
+	if app.Config.IPv6Mode == IPv6ModePrivate && public {
+		app.Log.Warningf("network IPv6 prefix %s is public, VMs will be directly reachable (see ipv6_mode)", prefix)
+	}
+
+	app.Log.Infof("network IPv6: %s (%s mode)", prefix, app.Config.IPv6Mode)
+	return nil
+}
+
+// ipv6RandomTries limits random picks of an IPv6 address, before
+// scanning the whole prefix (small prefixes) or giving up
+const ipv6RandomTries = 1000
+
+// ipv6MaxScanBits is the largest host part that can be fully scanned
+const ipv6MaxScanBits = 16
+
+// RandomUniqueIPv6 generate a random unique IPv6 (among other Mulch VMs)
+// inside the network IPv6 prefix, excluding the network address and its
+// DHCPv6 range, if any. Returns an empty string if there's no IPv6 prefix.
+func RandomUniqueIPv6(app *App) (string, error) {
+	prefix, err := app.NetworkIPv6Prefix()
+	if err != nil || prefix == nil {
+		return "", err
+	}
+	netIP := app.NetworkIPv6()
+	gateway := net.ParseIP(netIP.Address)
+
+	var ranges []libvirtxml.NetworkDHCPRange
+	if netIP.DHCP != nil {
+		ranges = netIP.DHCP.Ranges
+	}
+
+	used := make(map[string]bool)
+	for _, name := range app.VMDB.GetNames() {
+		vm, err := app.VMDB.GetByName(name)
+		if err == nil && vm.AssignedIPv6 != "" {
+			used[vm.AssignedIPv6] = true
+		}
+	}
+
+	taken := func(ip net.IP) bool {
+		if ip.Equal(gateway) || used[ip.String()] {
+			return true
+		}
+		// DHCPv6 range
+		for _, r := range ranges {
+			start := net.ParseIP(r.Start).To16()
+			end := net.ParseIP(r.End).To16()
+			if start != nil && end != nil && bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	ip, err := pickIPv6(prefix, taken, app.Rand)
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// pickIPv6 returns a random address of the prefix (host part not zero)
+// that is not taken. Small prefixes are fully scanned when random picks
+// fail, so an error means that the prefix is exhausted (or almost).
+func pickIPv6(prefix *net.IPNet, taken func(net.IP) bool, rnd *rand.Rand) (net.IP, error) {
+	network := prefix.IP.To16()
+	mask := prefix.Mask
+	ones, bits := mask.Size()
+	if network == nil || bits != 8*net.IPv6len {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", prefix)
+	}
+
+	isHost := func(ip net.IP) bool {
+		for i := range ip {
+			if ip[i]&^mask[i] != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for try := 0; try < ipv6RandomTries; try++ {
+		ip := make(net.IP, net.IPv6len)
+		for i := range ip {
+			ip[i] = network[i]&mask[i] | byte(rnd.Intn(256))&^mask[i]
+		}
+		if isHost(ip) && !taken(ip) {
+			return ip, nil
+		}
+	}
+
+	hostBits := bits - ones
+	if hostBits <= ipv6MaxScanBits {
+		ip := make(net.IP, net.IPv6len)
+		for n := 1; n < 1<<uint(hostBits); n++ {
+			copy(ip, network)
+			for i := range ip {
+				ip[i] &= mask[i]
+			}
+			ip[14] |= byte(n >> 8)
+			ip[15] |= byte(n)
+			if !taken(ip) {
+				return ip, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no free IPv6 address found in %s", prefix)
+}
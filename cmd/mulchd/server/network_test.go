@@ -0,0 +1,81 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestIPv6IsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"2001:db8::1", true},
+		{"2a01:4f8::1", true},
+		{"fd00::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::1", false},
+		{"ff02::1", false},
+		{"::", false},
+		{"192.168.1.1", false},
+		{"8.8.8.8", false},
+	}
+
+	for _, test := range tests {
+		if got := IPv6IsPublic(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.ip, got, test.want)
+		}
+	}
+	if IPv6IsPublic(nil) {
+		t.Errorf("nil IP is not public")
+	}
+}
+
+func TestPickIPv6(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	_, prefix, _ := net.ParseCIDR("fd12:3456::/120")
+
+	// all addresses but one are taken
+	free := net.ParseIP("fd12:3456::c8")
+	taken := func(ip net.IP) bool {
+		if !prefix.Contains(ip) {
+			t.Fatalf("%s is outside of %s", ip, prefix)
+		}
+		return !ip.Equal(free)
+	}
+	ip, err := pickIPv6(prefix, taken, rnd)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !ip.Equal(free) {
+		t.Errorf("got %s, want %s", ip, free)
+	}
+
+	// exhausted prefix
+	ip, err = pickIPv6(prefix, func(net.IP) bool { return true }, rnd)
+	if err == nil {
+		t.Errorf("error expected, got %s", ip)
+	}
+
+	// the network address (zero host part) is never used
+	_, prefix, _ = net.ParseCIDR("2001:db8::/64")
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ip, err = pickIPv6(prefix, func(ip net.IP) bool { return seen[ip.String()] }, rnd)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !prefix.Contains(ip) || ip.Equal(prefix.IP) || seen[ip.String()] {
+			t.Fatalf("invalid address %s", ip)
+		}
+		seen[ip.String()] = true
+	}
+
+	// exhausted large prefix, no scan
+	_, err = pickIPv6(prefix, func(net.IP) bool { return true }, rnd)
+	if err == nil {
+		t.Errorf("error expected for an exhausted /64")
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// parse a published port: [public_port:]vm_port[/tcp|udp][->allowed source]
+// ex: "25", "2525:25/tcp", "1194/udp", "5432->10.0.0.0/24"
+func vmConfigGetPort(str string) (*common.Port, error) {
+	port := &common.Port{
+		Protocol: common.PortProtocolTCP,
+	}
+
+	spec := strings.TrimSpace(str)
+	if parts := strings.SplitN(spec, "->", 2); len(parts) == 2 {
+		spec = strings.TrimSpace(parts[0])
+		port.AllowFrom = strings.TrimSpace(parts[1])
+		if _, _, err := net.ParseCIDR(port.AllowFrom); err != nil && net.ParseIP(port.AllowFrom) == nil {
+			return nil, fmt.Errorf("port '%s': invalid source '%s' (IP or CIDR needed)", str, port.AllowFrom)
+		}
+	}
+
+	if parts := strings.SplitN(spec, "/", 2); len(parts) == 2 {
+		spec = parts[0]
+		port.Protocol = strings.ToLower(parts[1])
+		if port.Protocol != common.PortProtocolTCP && port.Protocol != common.PortProtocolUDP {
+			return nil, fmt.Errorf("port '%s': unsupported protocol '%s'", str, parts[1])
+		}
+	}
+
+	parsePort := func(value string) (int, error) {
+		num, err := strconv.Atoi(value)
+		if err != nil || num < 1 || num > 65535 {
+			return 0, fmt.Errorf("port '%s': invalid port number '%s'", str, value)
+		}
+		return num, nil
+	}
+
+	var err error
+	parts := strings.SplitN(spec, ":", 2)
+	port.DestinationPort, err = parsePort(parts[len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+	port.PublicPort = port.DestinationPort
+	if len(parts) == 2 {
+		port.PublicPort, err = parsePort(parts[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return port, nil
+}
+
+// CheckPortsConflicts will detect if incoming published ports conflicts
+// with existing VMs, mulchd/mulch-proxy own ports (API, SSH proxy,
+// HTTP/HTTPS proxy) or host SSH
+// You can exclude a specific VM (every revisions) using its name (use empty string otherwise)
+func CheckPortsConflicts(db *VMDatabase, ports []*common.Port, excludeVM string, config *AppConfig) error {
+	portMap := make(map[string]string)
+
+	portMap["22/"+common.PortProtocolTCP] = "host SSH"
+	for _, listen := range []string{config.Listen, config.ProxyListenSSH} {
+		_, portStr, err := net.SplitHostPort(listen)
+		if err == nil {
+			portMap[portStr+"/"+common.PortProtocolTCP] = "mulchd"
+		}
+	}
+	for _, listen := range []string{config.ProxyListenHTTP, config.ProxyListenHTTPS} {
+		_, portStr, err := net.SplitHostPort(listen)
+		if err == nil {
+			portMap[portStr+"/"+common.PortProtocolTCP] = "mulch-proxy"
+		}
+	}
+
+	vmNames := db.GetNames()
+	for _, vmName := range vmNames {
+		if excludeVM != "" && vmName.Name == excludeVM {
+			continue
+		}
+
+		entry, err := db.GetEntryByName(vmName)
+		if err != nil {
+			return err
+		}
+
+		if entry.Active == false {
+			continue
+		}
+
+		for _, port := range entry.VM.Config.Ports {
+			portMap[port.Key()] = "vm '" + entry.VM.Config.Name + "'"
+		}
+	}
+
+	for _, port := range ports {
+		owner, exist := portMap[port.Key()]
+		if exist == true {
+			return fmt.Errorf("%s already uses port %s", owner, port.Key())
+		}
+	}
+
+	return nil
+}
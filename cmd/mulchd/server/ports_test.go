@@ -0,0 +1,67 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+func TestVMConfigGetPort(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    *common.Port
+		wantErr bool
+	}{
+		{
+			str:  "25",
+			want: &common.Port{PublicPort: 25, DestinationPort: 25, Protocol: "tcp"},
+		},
+		{
+			str:  " 2525:25/tcp ",
+			want: &common.Port{PublicPort: 2525, DestinationPort: 25, Protocol: "tcp"},
+		},
+		{
+			str:  "1194/UDP",
+			want: &common.Port{PublicPort: 1194, DestinationPort: 1194, Protocol: "udp"},
+		},
+		{
+			str:  "5432->10.0.0.0/24",
+			want: &common.Port{PublicPort: 5432, DestinationPort: 5432, Protocol: "tcp", AllowFrom: "10.0.0.0/24"},
+		},
+		{
+			str:  "15432:5432/tcp -> 1.2.3.4",
+			want: &common.Port{PublicPort: 15432, DestinationPort: 5432, Protocol: "tcp", AllowFrom: "1.2.3.4"},
+		},
+		{
+			str:  "53/udp->2001:db8::/32",
+			want: &common.Port{PublicPort: 53, DestinationPort: 53, Protocol: "udp", AllowFrom: "2001:db8::/32"},
+		},
+		{str: "", wantErr: true},
+		{str: "0", wantErr: true},
+		{str: "65536", wantErr: true},
+		{str: "http", wantErr: true},
+		{str: "80:", wantErr: true},
+		{str: ":80", wantErr: true},
+		{str: "80/sctp", wantErr: true},
+		{str: "80->nowhere", wantErr: true},
+		{str: "80->", wantErr: true},
+	}
+
+	for _, test := range tests {
+		port, err := vmConfigGetPort(test.str)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected, got %v", test.str, port)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.str, err)
+			continue
+		}
+		if !reflect.DeepEqual(port, test.want) {
+			t.Errorf("'%s': got %+v, want %+v", test.str, port, test.want)
+		}
+	}
+}
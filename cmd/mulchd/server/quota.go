@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QuotaUsage returns resources used by VMs (all revisions, VMs being
+// created included) owned by an API key, the VM count and the number
+// of backups made with this key (backups in progress included)
+func (app *App) QuotaUsage(keyComment string) (*VMResources, int, int, error) {
+	app.capacityMutex.Lock()
+	defer app.capacityMutex.Unlock()
+
+	return app.quotaUsage(keyComment)
+}
+
+// must be called with capacityMutex locked
+func (app *App) quotaUsage(keyComment string) (*VMResources, int, int, error) {
+	used := &VMResources{}
+	vmCount := 0
+	seenDisks := make(map[string]bool)
+
+	for _, vmName := range app.VMDB.GetNames() {
+		vm, err := app.VMDB.GetByName(vmName)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if vm.Owner() != keyComment {
+			continue
+		}
+
+		res := VMConfigResources(vm.Config, false)
+		for _, disk := range vm.Config.Disks {
+			volName := vmGenDataDiskName(vmName, disk)
+			if disk.Persist && !seenDisks[volName] {
+				seenDisks[volName] = true
+				res.DiskMB += int(disk.Size / 1024 / 1024)
+			}
+		}
+		used.CPUs += res.CPUs
+		used.RAMMB += res.RAMMB
+		used.DiskMB += res.DiskMB
+		vmCount++
+	}
+
+	for _, entry := range app.VMDB.GetMaternityEntries() {
+		if entry.VM.Owner() != keyComment {
+			continue
+		}
+		res := VMConfigResources(entry.VM.Config, true)
+		used.CPUs += res.CPUs
+		used.RAMMB += res.RAMMB
+		used.DiskMB += res.DiskMB
+		vmCount++
+	}
+
+	backups := 0
+	for _, name := range app.BackupsDB.GetNames() {
+		backup := app.BackupsDB.GetByName(name)
+		if backup != nil && backup.AuthorKey == keyComment {
+			backups++
+		}
+	}
+
+	backups += app.pendingBackups[keyComment]
+
+	return used, vmCount, backups, nil
+}
+
+// CheckQuota checks that the quota of an API key (if any) can hold extra
+// resources and backups
+func (app *App) CheckQuota(keyComment string, extra *VMResources, extraBackups int) error {
+	key := app.APIKeysDB.GetByComment(keyComment)
+	if key == nil || key.Quota == nil {
+		return nil
+	}
+
+	app.capacityMutex.Lock()
+	defer app.capacityMutex.Unlock()
+
+	return app.checkQuota(keyComment, key.Quota, extra, extraBackups)
+}
+
+// ReserveBackupQuota checks the backup quota of an API key and counts
+// one more backup for this key until release is called (when the backup
+// is done, and then counted by the backup DB), so concurrent backups
+// can't exceed the quota
+func (app *App) ReserveBackupQuota(keyComment string) (func(), error) {
+	app.capacityMutex.Lock()
+	defer app.capacityMutex.Unlock()
+
+	key := app.APIKeysDB.GetByComment(keyComment)
+	if key != nil && key.Quota != nil {
+		err := app.checkQuota(keyComment, key.Quota, &VMResources{}, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.pendingBackups[keyComment]++
+	release := func() {
+		app.capacityMutex.Lock()
+		defer app.capacityMutex.Unlock()
+		app.pendingBackups[keyComment]--
+		if app.pendingBackups[keyComment] <= 0 {
+			delete(app.pendingBackups, keyComment)
+		}
+	}
+	return release, nil
+}
+
+// must be called with capacityMutex locked
+func (app *App) checkQuota(keyComment string, quota *APIKeyQuota, extra *VMResources, extraBackups int) error {
+	used, _, backups, err := app.quotaUsage(keyComment)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	check := func(name string, unit string, used int, extra int, limit int) {
+		if limit == 0 || extra <= 0 {
+			return
+		}
+		if used+extra > limit {
+			problems = append(problems, fmt.Sprintf(
+				"%s: %d%s requested, %d%s used, quota is %d%s",
+				name, extra, unit, used, unit, limit, unit))
+		}
+	}
+
+	check("CPU", "", used.CPUs, extra.CPUs, quota.CPUs)
+	check("RAM", "MB", used.RAMMB, extra.RAMMB, quota.RAMMB)
+	check("disk", "MB", used.DiskMB, extra.DiskMB, quota.DiskMB)
+	check("backups", "", backups, extraBackups, quota.Backups)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("quota exceeded for key '%s' (%s)", keyComment, strings.Join(problems, "; "))
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 )
 
@@ -50,6 +51,36 @@ func (req *Request) SetTarget(target string) {
 	}
 }
 
+// Project returns the project the request is limited to: the project of
+// the API key, or the "project" parameter for global keys (empty = all)
+func (req *Request) Project() string {
+	if req.APIKey != nil && req.APIKey.Project != "" {
+		return req.APIKey.Project
+	}
+	return req.HTTP.FormValue("project")
+}
+
+// InProject returns true if a project is accessible by the request
+func (req *Request) InProject(project string) bool {
+	current := req.Project()
+	return current == "" || current == project
+}
+
+// QualifiedName returns a name given by the client (VM, secret),
+// relative to the request project (if any), unless already qualified
+// ("project.name")
+func (req *Request) QualifiedName(name string) string {
+	if name == "" || strings.Contains(name, ProjectVMSeparator) {
+		return name
+	}
+	return ProjectVMName(req.Project(), name)
+}
+
+// VMName returns the name of a VM given by the client (see QualifiedName)
+func (req *Request) VMName(name string) string {
+	return req.QualifiedName(name)
+}
+
 // Printf like helper for req.Response.Write
 func (req *Request) Printf(format string, args ...interface{}) {
 	req.Response.Write([]byte(fmt.Sprintf(format, args...)))
@@ -91,7 +91,7 @@ func routeStreamHandler(w http.ResponseWriter, r *http.Request, request *Request
 	// plug ourselves into the hub
 	// TODO: use API key owner instead of "me"
 	tmpTarget := fmt.Sprintf(".tmp-%d", request.App.Rand.Int31())
-	client := request.App.Hub.Register("me", tmpTarget, trace)
+	client := request.App.Hub.Register("me", tmpTarget, request.Project(), trace)
 
 	request.Stream = NewLog(tmpTarget, request.App.Hub, request.App.LogHistory)
 	request.HubClient = client
@@ -25,7 +25,9 @@ type Run struct {
 	// DialDuration time.Duration
 	Log            *Log
 	StdoutCallback func(string)
+	StderrCallback func(string)
 	CloseChannel   <-chan bool
+	ExitStatus     int // last script exit status
 }
 
 // Go will execute the Run
@@ -54,6 +54,9 @@ func (run *Run) readStderr(std io.Reader) error {
 	for scanner.Scan() {
 		text := scanner.Text()
 		run.Log.Error(text)
+		if run.StderrCallback != nil {
+			run.StderrCallback(text)
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -118,6 +121,7 @@ func (run *Run) stdinInject(out io.WriteCloser, exitStatus chan int) error {
 		}
 
 		status := <-exitStatus
+		run.ExitStatus = status
 		if status != 0 {
 			return fmt.Errorf("detected non-zero exit status: %d", status)
 		}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScriptPinSeparator separates a script URL from its pinned SHA256
+// ("admin@deb-lamp.sh#sha256=…")
+const ScriptPinSeparator = "#sha256="
+
+var scriptSHA256Regex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ScriptCache is a content-addressed cache (by SHA256) of pinned scripts
+// fetched by mulchd, so they are still available when their origin is
+// down or was modified
+type ScriptCache struct {
+	path  string
+	git   *GitSources
+	mutex sync.Mutex
+}
+
+// VMScriptRevision is the exact revision of a script that was run in a VM
+type VMScriptRevision struct {
+	Step   string
+	URL    string
+	As     string
+	SHA256 string
+	Commit string // git sources only
+	Pinned bool
+	Date   time.Time
+}
+
+// NewScriptCache instanciates a new ScriptCache, creating the
+// storage directory if needed
+func NewScriptCache(path string, git *GitSources) (*ScriptCache, error) {
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScriptCache{
+		path: path,
+		git:  git,
+	}, nil
+}
+
+// ParseScriptReference splits a "url#sha256=hash" reference, the
+// hash is optional
+func ParseScriptReference(ref string) (string, string, error) {
+	pos := strings.Index(ref, ScriptPinSeparator)
+	if pos == -1 {
+		return ref, "", nil
+	}
+
+	scriptURL := ref[:pos]
+	sum := strings.ToLower(ref[pos+len(ScriptPinSeparator):])
+
+	if !scriptSHA256Regex.MatchString(sum) {
+		return "", "", fmt.Errorf("'%s': invalid SHA256 pin (64 hex chars needed)", ref)
+	}
+	return scriptURL, sum, nil
+}
+
+func (cache *ScriptCache) filename(sum string) string {
+	return filepath.Join(cache.path, sum)
+}
+
+func (cache *ScriptCache) load(sum string) ([]byte, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return ioutil.ReadFile(cache.filename(sum))
+}
+
+func (cache *ScriptCache) store(sum string, content []byte) error {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	filename := cache.filename(sum)
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	tmpName := filename + ".tmp"
+	err := ioutil.WriteFile(tmpName, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// returns script content and git commit (if any)
+func (cache *ScriptCache) fetch(scriptURL string, log *Log) ([]byte, string, error) {
+	if IsGitSourceURL(scriptURL) {
+		return cache.git.Get(scriptURL, log)
+	}
+
+	stream, err := GetContentFromURL(scriptURL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer stream.Close()
+
+	content, err := ioutil.ReadAll(stream)
+	return content, "", err
+}
+
+// Get returns the content of a script and its SHA256. If sum is not
+// empty, the content must match it, and the cached copy is used if
+// the script can't be fetched (network down) or was modified.
+func (cache *ScriptCache) Get(scriptURL string, sum string, log *Log) ([]byte, string, error) {
+	content, sum, _, err := cache.get(scriptURL, sum, log)
+	return content, sum, err
+}
+
+// same as Get, with the resolved git commit (if any)
+func (cache *ScriptCache) get(scriptURL string, sum string, log *Log) ([]byte, string, string, error) {
+	content, commit, errF := cache.fetch(scriptURL, log)
+
+	if errF == nil {
+		hash := sha256.Sum256(content)
+		contentSum := hex.EncodeToString(hash[:])
+
+		if sum == "" {
+			return content, contentSum, commit, nil
+		}
+
+		if sum == contentSum {
+			// only pinned scripts are cached (so the cache can't grow
+			// with each revision of unpinned scripts)
+			if err := cache.store(contentSum, content); err != nil {
+				log.Warningf("unable to cache script '%s': %s", scriptURL, err)
+			}
+			return content, contentSum, commit, nil
+		}
+		errF = fmt.Errorf("SHA256 mismatch (pinned %s, got %s)", sum, contentSum)
+	}
+
+	if sum == "" {
+		return nil, "", "", errF
+	}
+
+	cached, errL := cache.load(sum)
+	if errL != nil {
+		return nil, "", "", fmt.Errorf("%s (and no cached copy)", errF)
+	}
+
+	log.Warningf("script '%s': %s, using cached copy", scriptURL, errF)
+	return cached, sum, "", nil
+}
+
+// GetTask returns a RunTask for a config script (using the script cache)
+// and records the script revision in the VM
+func (cache *ScriptCache) GetTask(vm *VM, step string, script *VMConfigScript, log *Log) (*RunTask, error) {
+	content, sum, commit, err := cache.get(script.ScriptURL, script.SHA256, log)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get script '%s': %s", script.ScriptURL, err)
+	}
+
+	vm.recordScriptRevision(&VMScriptRevision{
+		Step:   step,
+		URL:    script.ScriptURL,
+		As:     script.As,
+		SHA256: sum,
+		Commit: commit,
+		Pinned: script.SHA256 != "",
+		Date:   time.Now(),
+	})
+
+	return &RunTask{
+		ScriptName:   ScriptBaseName(script.ScriptURL),
+		ScriptReader: bytes.NewReader(content),
+		As:           script.As,
+	}, nil
+}
+
+// replaces any previous revision of the same script for the same step
+func (vm *VM) recordScriptRevision(revision *VMScriptRevision) {
+	for i, previous := range vm.Scripts {
+		if previous.Step == revision.Step && previous.URL == revision.URL {
+			vm.Scripts[i] = revision
+			return
+		}
+	}
+	vm.Scripts = append(vm.Scripts, revision)
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretMask replaces secret values in logs and API outputs
+const SecretMask = "********"
+
+// secrets shorter than this are not masked (too many false positives)
+const secretMaskMinLength = 4
+
+// secret reference in VM configs: ${secret:name}
+var secretReferenceRegex = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+// Secret is a value stored (encrypted) by mulchd, and referenced by VM
+// configs using ${secret:name}. Secrets of a project are only available
+// to VMs of this project (and global secrets to VMs without project).
+type Secret struct {
+	Name      string
+	Project   string
+	Value     string
+	Modified  time.Time
+	AuthorKey string
+}
+
+// ID returns the unique name of the secret ("project.name" for
+// project secrets)
+func (secret *Secret) ID() string {
+	return ProjectVMName(secret.Project, secret.Name)
+}
+
+// SecretDatabase is an encrypted store of secrets (AES-256-GCM). The
+// key is stored in a separate file.
+type SecretDatabase struct {
+	filename string
+	key      []byte
+	db       map[string]*Secret
+	mutex    sync.Mutex
+}
+
+// NewSecretDatabase instanciates a new SecretDatabase, the key file is
+// created if needed
+func NewSecretDatabase(filename string, keyFilename string) (*SecretDatabase, error) {
+	db := &SecretDatabase{
+		filename: filename,
+		db:       make(map[string]*Secret),
+	}
+
+	key, err := secretLoadOrCreateKey(keyFilename)
+	if err != nil {
+		return nil, err
+	}
+	db.key = key
+
+	// if the file exists, load it
+	if _, err := os.Stat(db.filename); err == nil {
+		err = db.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the file to check if it's writable
+	err = db.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func secretCheckFileMode(filename string) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	requiredMode, err := strconv.ParseInt("0600", 8, 32)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode() != os.FileMode(requiredMode) {
+		return fmt.Errorf("%s: only the owner should be able to read/write this file (mode 0600)", filename)
+	}
+	return nil
+}
+
+func secretLoadOrCreateKey(filename string) ([]byte, error) {
+	if _, err := os.Stat(filename); err == nil {
+		err = secretCheckFileMode(filename)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s: invalid key size", filename)
+		}
+		return key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	err := ioutil.WriteFile(filename, key, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (db *SecretDatabase) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(db.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// This is done internaly, because it must be done with the mutex locked,
+// but we can't lock it here, since save() is called by functions that
+// are already locking the mutex.
+func (db *SecretDatabase) save() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err := enc.Encode(db.db)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := db.gcm()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	data := gcm.Seal(nonce, nonce, buf.Bytes(), nil)
+	return ioutil.WriteFile(db.filename, data, 0600)
+}
+
+func (db *SecretDatabase) load() error {
+	err := secretCheckFileMode(db.filename)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(db.filename)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := db.gcm()
+	if err != nil {
+		return err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return fmt.Errorf("%s: file is too short", db.filename)
+	}
+	nonce := data[:gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, data[gcm.NonceSize():], nil)
+	if err != nil {
+		return fmt.Errorf("%s: unable to decrypt (wrong key?): %s", db.filename, err)
+	}
+
+	return json.Unmarshal(plain, &db.db)
+}
+
+// Set creates or updates a secret of a project (or a global one)
+func (db *SecretDatabase) Set(project string, name string, value string, authorKey string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if !IsValidName(name) {
+		return fmt.Errorf("invalid secret name '%s'", name)
+	}
+	if value == "" {
+		return errors.New("empty secret value")
+	}
+
+	secret := &Secret{
+		Name:      name,
+		Project:   project,
+		Value:     value,
+		Modified:  time.Now(),
+		AuthorKey: authorKey,
+	}
+	db.db[secret.ID()] = secret
+	return db.save()
+}
+
+// Get returns a secret by its ID (see Secret.ID), or nil
+func (db *SecretDatabase) Get(id string) *Secret {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.db[id]
+}
+
+// Delete removes a secret, using its ID (see Secret.ID)
+func (db *SecretDatabase) Delete(id string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, exists := db.db[id]; !exists {
+		return fmt.Errorf("secret '%s' not found", id)
+	}
+	delete(db.db, id)
+	return db.save()
+}
+
+// List returns all secrets, sorted by name (values included, so
+// be careful with the result)
+func (db *SecretDatabase) List() []*Secret {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var list []*Secret
+	for _, secret := range db.db {
+		list = append(list, secret)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID() < list[j].ID()
+	})
+	return list
+}
+
+// Resolve replaces all ${secret:name} references in str, using secrets
+// of the project only
+func (db *SecretDatabase) Resolve(str string, project string) (string, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var err error
+	res := secretReferenceRegex.ReplaceAllStringFunc(str, func(ref string) string {
+		name := secretReferenceRegex.FindStringSubmatch(ref)[1]
+		// "other_project.name" would reach another project from a
+		// VM without project
+		if !IsValidName(name) || name == "" {
+			err = fmt.Errorf("invalid secret name '%s'", name)
+			return ref
+		}
+		secret, exists := db.db[ProjectVMName(project, name)]
+		if !exists {
+			err = fmt.Errorf("secret '%s' not found", ProjectVMName(project, name))
+			return ref
+		}
+		return secret.Value
+	})
+	return res, err
+}
+
+// Mask replaces all secret values in str (longest values first, a
+// secret may contain another one)
+func (db *SecretDatabase) Mask(str string) string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	var values []string
+	for _, secret := range db.db {
+		if len(secret.Value) < secretMaskMinLength {
+			continue
+		}
+		values = append(values, secret.Value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	for _, value := range values {
+		str = strings.Replace(str, value, SecretMask, -1)
+	}
+	return str
+}
+
+// SecretReferences returns names of all secrets referenced in str
+func SecretReferences(str string) []string {
+	var names []string
+	for _, match := range secretReferenceRegex.FindAllStringSubmatch(str, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// GetSecretUsers returns VMs (with revisions) using each secret (by ID)
+func GetSecretUsers(vmdb *VMDatabase) map[string][]string {
+	users := make(map[string][]string)
+
+	for _, vmName := range vmdb.GetNames() {
+		vm, err := vmdb.GetByName(vmName)
+		if err != nil {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, val := range vm.Config.Env {
+			for _, name := range SecretReferences(val) {
+				id := ProjectVMName(vm.Config.Project, name)
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				users[id] = append(users[id], vmName.ID())
+			}
+		}
+	}
+
+	for name := range users {
+		sort.Strings(users[name])
+	}
+	return users
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func newTestSecretDatabase(t *testing.T) (*SecretDatabase, func()) {
+	dir, err := ioutil.TempDir("", "mulch-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSecretDatabase(path.Join(dir, "secrets.db"), path.Join(dir, "secrets.key"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() { os.RemoveAll(dir) }
+}
+
+func TestSecretDatabaseResolve(t *testing.T) {
+	db, clean := newTestSecretDatabase(t)
+	defer clean()
+
+	secrets := []struct{ project, name, value string }{
+		{"", "smtp_password", "global-pass"},
+		{"customer_x", "db_password", "x-db-pass"},
+		{"customer_y", "db_password", "y-db-pass"},
+	}
+	for _, s := range secrets {
+		if err := db.Set(s.project, s.name, s.value, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		str     string
+		project string
+		want    string
+		wantErr bool
+	}{
+		{name: "no reference", str: "plain value", project: "customer_x", want: "plain value"},
+		{name: "project secret", str: "pass=${secret:db_password}", project: "customer_x", want: "pass=x-db-pass"},
+		{name: "same name, other project", str: "${secret:db_password}", project: "customer_y", want: "y-db-pass"},
+		{name: "global secret", str: "${secret:smtp_password}", project: "", want: "global-pass"},
+		{name: "several references", str: "${secret:db_password}:${secret:db_password}", project: "customer_x", want: "x-db-pass:x-db-pass"},
+		{name: "unknown secret", str: "${secret:nope}", project: "customer_x", wantErr: true},
+		{name: "global secret from a project", str: "${secret:smtp_password}", project: "customer_x", wantErr: true},
+		{name: "project secret without project", str: "${secret:db_password}", project: "", wantErr: true},
+		{name: "another project secret, qualified", str: "${secret:customer_y.db_password}", project: "", wantErr: true},
+		{name: "another project secret, from a project", str: "${secret:customer_y.db_password}", project: "customer_x", wantErr: true},
+		{name: "empty name", str: "${secret:}", project: "customer_x", wantErr: true},
+	}
+
+	for _, test := range tests {
+		res, err := db.Resolve(test.str, test.project)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: error expected, got '%s'", test.name, res)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if res != test.want {
+			t.Errorf("%s: got '%s', want '%s'", test.name, res, test.want)
+		}
+	}
+}
+
+func TestSecretDatabaseMask(t *testing.T) {
+	db, clean := newTestSecretDatabase(t)
+	defer clean()
+
+	db.Set("customer_x", "short", "abc", "test")
+	db.Set("customer_x", "token", "s3cr3t", "test")
+	db.Set("customer_y", "long_token", "s3cr3t-and-more", "test")
+
+	tests := []struct {
+		str  string
+		want string
+	}{
+		{"nothing to hide", "nothing to hide"},
+		{"connecting with password s3cr3t to db", "connecting with password " + SecretMask + " to db"},
+		{"s3cr3ts3cr3t", SecretMask + SecretMask},
+		{"token=s3cr3t-and-more", "token=" + SecretMask},
+		{"abc is too short to be masked", "abc is too short to be masked"},
+	}
+
+	for _, test := range tests {
+		if got := db.Mask(test.str); got != test.want {
+			t.Errorf("'%s': got '%s', want '%s'", test.str, got, test.want)
+		}
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	got := SecretReferences("${secret:a} and ${secret:b_2}, not $secret:c")
+	want := []string{"a", "b_2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+)
+
+// VMToSeed captures the disk of a VM as a new seed (or a new version of
+// an existing uploaded seed). The VM is stopped during the copy, then the
+// image is generalized (cloud-init state, SSH host keys, machine-id, …)
+// using the to-seed.sh template.
+func VMToSeed(vmName *VMName, seedName string, authorKey string, app *App, log *Log) error {
+	vm, err := app.VMDB.GetByName(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.WIP != VMOperationNone {
+		return fmt.Errorf("VM already have a work in progress (%s)", string(vm.WIP))
+	}
+
+	if _, err := exec.LookPath("virt-customize"); err != nil {
+		return errors.New("virt-customize is needed on the host (libguestfs-tools)")
+	}
+
+	seed, err := app.Seeder.beginUpload(seedName)
+	if err != nil {
+		return err
+	}
+	defer app.Seeder.endUpload(seedName)
+
+	vm.SetOperation(VMOperationToSeed)
+	defer vm.SetOperation(VMOperationNone)
+
+	before := time.Now()
+
+	running, _ := VMIsRunning(vmName, app)
+	if running {
+		log.Infof("stopping %s", vmName)
+		err = VMStopByName(vmName, app, log)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the current seed image is untouched until the capture succeeds
+	tmpVolume := seed.Name + "-capture.qcow2"
+	defer app.Libvirt.DeleteVolume(tmpVolume, app.Libvirt.Pools.Seeds)
+
+	err = app.Seeder.captureDisk(vmName, tmpVolume, log)
+
+	if running {
+		errS := VMStartByName(vmName, vm.SecretUUID, app, log)
+		if errS != nil {
+			log.Errorf("unable to restart %s: %s", vmName, errS)
+		}
+	}
+
+	if err != nil {
+		seed.UpdateStatus(fmt.Sprintf("capture failed: %s", err))
+		app.Seeder.Update()
+		return err
+	}
+
+	hash, err := app.Seeder.generalize(tmpVolume, vm, log)
+	if err != nil {
+		seed.UpdateStatus(fmt.Sprintf("generalization failed: %s", err))
+		app.Seeder.Update()
+		return err
+	}
+
+	err = app.Seeder.replaceImage(seed, tmpVolume, log)
+	if err != nil {
+		seed.UpdateStatus(fmt.Sprintf("capture failed: %s", err))
+		app.Seeder.Update()
+		return err
+	}
+
+	infos, err := app.Libvirt.VolumeInfos(seed.GetVolumeName(), app.Libvirt.Pools.Seeds)
+	if err != nil {
+		return err
+	}
+	after := time.Now()
+
+	seed.Ready = true
+	seed.LastModified = time.Now()
+	seed.Size = infos.Allocation
+	seed.SHA256 = hash
+	seed.AuthorKey = authorKey
+	seed.UpdateStatus(fmt.Sprintf("captured from VM %s by %s in %s", vmName, authorKey, after.Sub(before)))
+	app.Seeder.Update()
+	log.Infof("seed '%s' is now ready", seed.Name)
+
+	return nil
+}
+
+// copy the VM disk to a temporary volume of the seed pool (VM must be
+// stopped)
+func (db *SeedDatabase) captureDisk(vmName *VMName, tmpVolume string, log *Log) error {
+	diskNameVM, err := VMGetDiskName(vmName, db.app)
+	if err != nil {
+		return err
+	}
+
+	// leftover of a previous failure?
+	db.app.Libvirt.DeleteVolume(tmpVolume, db.app.Libvirt.Pools.Seeds)
+
+	return db.app.Libvirt.CloneVolume(
+		diskNameVM,
+		db.app.Libvirt.Pools.Disks,
+		tmpVolume,
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		log,
+	)
+}
+
+// run to-seed.sh template inside the (offline) captured image, and
+// return the SHA256 of the result
+func (db *SeedDatabase) generalize(volume string, vm *VM, log *Log) (string, error) {
+	vol, err := db.app.Libvirt.Pools.Seeds.LookupStorageVolByName(volume)
+	if err != nil {
+		return "", err
+	}
+	volPath, err := vol.GetPath()
+	vol.Free()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := ioutil.ReadFile(db.app.Config.GetTemplateFilepath("to-seed.sh"))
+	if err != nil {
+		return "", err
+	}
+
+	variables := make(map[string]interface{})
+	variables["_MULCH_SUPER_USER"] = db.app.Config.MulchSuperUser
+	variables["_APP_USER"] = vm.Config.AppUser
+	script := common.StringExpandVariables(string(data), variables)
+
+	scriptFile, err := ioutil.TempFile(db.app.Config.TempPath, "mulch-to-seed")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(scriptFile.Name())
+
+	_, err = scriptFile.WriteString(script)
+	scriptFile.Close()
+	if err != nil {
+		return "", err
+	}
+
+	log.Infof("generalizing seed image")
+	output, err := exec.Command("virt-customize", "-a", volPath, "--run", scriptFile.Name()).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("virt-customize: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+
+	return seedFileSHA256(volPath)
+}
+
+// replace the seed image with a (generalized) captured volume
+func (db *SeedDatabase) replaceImage(seed *Seed, volume string, log *Log) error {
+	err := db.archiveCurrent(seed, log)
+	if err != nil {
+		return fmt.Errorf("unable to archive current image: %s", err)
+	}
+
+	seed.Ready = false
+	db.Update()
+
+	// no error check, a real failure will be detected by CloneVolume
+	db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+
+	return db.app.Libvirt.CloneVolume(
+		volume,
+		db.app.Libvirt.Pools.Seeds,
+		seed.GetVolumeName(),
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		log,
+	)
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnitiFR/mulch/common"
+	"github.com/c2h5oh/datasize"
+)
+
+// a failed download is resumed a few times before giving up (and the
+// next seeder run will resume it again)
+const (
+	seedDownloadAttempts   = 5
+	seedDownloadRetryDelay = 10 * time.Second
+)
+
+// SeedMirrorURLHeader is sent by a mirror (with Last-Modified), so a
+// peer can check it's the same upstream image
+const SeedMirrorURLHeader = "Mulch-Seed-URL"
+
+func (db *SeedDatabase) seedPartialFile(seed *Seed) string {
+	return path.Join(db.app.Config.TempPath, "mulch-seed-"+seed.Name+".part")
+}
+
+// seedDownload downloads the seed image (upstream date: lastModified)
+// to a temporary file, using the mirror if configured. Interrupted
+// downloads are resumed (HTTP Range). Returns the file path and
+// its SHA256 hash.
+func (db *SeedDatabase) seedDownload(seed *Seed, lastModified time.Time, log *Log) (string, string, error) {
+	operation := db.app.Operations.Add(&Operation{
+		Origin:        "[seeder]",
+		Action:        "download",
+		Ressource:     "seed",
+		RessourceName: seed.GetVolumeName(),
+	})
+	defer db.app.Operations.Remove(operation)
+
+	partFile := db.seedPartialFile(seed)
+
+	// partial download of another upstream image?
+	if !seed.PartialLastModified.Equal(lastModified) {
+		os.Remove(partFile)
+		seed.PartialLastModified = lastModified
+		db.Update()
+	}
+
+	var err error
+	for attempt := 1; attempt <= seedDownloadAttempts; attempt++ {
+		if db.app.Config.SeedMirrorURL != "" {
+			err = db.seedDownloadFrom(seed, db.seedMirrorRequest, lastModified, partFile)
+			if err == nil {
+				break
+			}
+			log.Warningf("mirror: %s, using upstream URL", err)
+		}
+
+		err = db.seedDownloadFrom(seed, db.seedUpstreamRequest, lastModified, partFile)
+		if err == nil {
+			break
+		}
+		log.Warningf("download attempt %d/%d failed: %s", attempt, seedDownloadAttempts, err)
+		if attempt < seedDownloadAttempts {
+			time.Sleep(seedDownloadRetryDelay)
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	sum, err := seedFileSHA256(partFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the file now belongs to the caller
+	seed.PartialLastModified = time.Time{}
+	db.Update()
+
+	return partFile, sum, nil
+}
+
+func (db *SeedDatabase) seedUpstreamRequest(seed *Seed) (*http.Request, error) {
+	return http.NewRequest("GET", seed.URL, nil)
+}
+
+func (db *SeedDatabase) seedMirrorRequest(seed *Seed) (*http.Request, error) {
+	url := strings.TrimRight(db.app.Config.SeedMirrorURL, "/") + "/seed-mirror/" + seed.Name
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Mulch-Key", db.app.Config.SeedMirrorKey)
+	return req, nil
+}
+
+// download (or resume) the image to partFile
+func (db *SeedDatabase) seedDownloadFrom(seed *Seed, newRequest func(*Seed) (*http.Request, error), lastModified time.Time, partFile string) error {
+	req, err := newRequest(seed)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if stat, err := os.Stat(partFile); err == nil {
+		offset = stat.Size()
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	var total int64 // -1: unknown (chunked response)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, size, errR := parseContentRange(resp.Header.Get("Content-Range"))
+		if errR != nil || start != offset {
+			// restart from zero with the next attempt
+			os.Remove(partFile)
+			return fmt.Errorf("unexpected partial content (%s), restarting download", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		// we probably already have the whole file, make sure of it
+		_, size, errR := parseContentRange(resp.Header.Get("Content-Range"))
+		if errR == nil && size == offset {
+			seed.Size = uint64(size)
+			return nil
+		}
+		os.Remove(partFile)
+		return fmt.Errorf("invalid partial file (%d bytes, remote size: %s), restarting download", offset, resp.Header.Get("Content-Range"))
+	default:
+		return fmt.Errorf("response was %s (%v)", resp.Status, resp.StatusCode)
+	}
+
+	// make sure we get the expected image
+	lm, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil || !lm.Equal(lastModified) {
+		return errors.New("Last-Modified date mismatch")
+	}
+	if mirrorURL := resp.Header.Get(SeedMirrorURLHeader); mirrorURL != "" && mirrorURL != seed.URL {
+		return fmt.Errorf("image URL mismatch (%s)", mirrorURL)
+	}
+
+	out, err := os.OpenFile(partFile, flags, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	wc := &common.WriteCounter{
+		Step: 1024 * 1024, // 1 MB
+		CB: func(current uint64, _ uint64) {
+			done := uint64(offset) + current
+			if total < 0 {
+				seed.UpdateStatus(fmt.Sprintf("downloading (%s)", (datasize.ByteSize(done) * datasize.B).HR()))
+				return
+			}
+			if total == 0 {
+				return
+			}
+			seed.UpdateStatus(fmt.Sprintf("downloading %s (%d%%)",
+				(datasize.ByteSize(total) * datasize.B).HR(),
+				(done*100)/uint64(total)),
+			)
+		},
+	}
+	if total > 0 {
+		wc.Total = uint64(total)
+	}
+
+	var body io.Reader = resp.Body
+	if limit := db.app.Config.SeedDownloadRateLimit; limit > 0 {
+		body = newRateLimitedReader(body, int64(limit.Bytes()))
+	}
+
+	written, err := io.Copy(out, io.TeeReader(body, wc))
+	if err != nil {
+		return err
+	}
+
+	size := offset + written
+	if total >= 0 && size != total {
+		return fmt.Errorf("incomplete download (%d/%d bytes)", size, total)
+	}
+	seed.Size = uint64(size)
+	return nil
+}
+
+// parseContentRange parses "bytes 100-199/1000" or "bytes */1000" and
+// returns the start offset (0 for the second form) and the total size
+func parseContentRange(header string) (int64, int64, error) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Content-Range '%s': unknown total size", header)
+	}
+
+	if parts[0] == "*" {
+		return 0, total, nil
+	}
+	bounds := strings.SplitN(parts[0], "-", 2)
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range '%s'", header)
+	}
+	return start, total, nil
+}
+
+// rateLimitedReader limits the average read rate (bytes per second)
+type rateLimitedReader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func newRateLimitedReader(reader io.Reader, rate int64) *rateLimitedReader {
+	return &rateLimitedReader{
+		reader: reader,
+		rate:   rate,
+		start:  time.Now(),
+	}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// don't read more than one second of data at once
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+
+	expected := time.Duration(r.read * int64(time.Second) / r.rate)
+	if wait := expected - time.Now().Sub(r.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+// GetVolumePath returns the local path of the current seed image
+func (db *SeedDatabase) GetVolumePath(seed *Seed) (string, error) {
+	vol, err := db.app.Libvirt.Pools.Seeds.LookupStorageVolByName(seed.GetVolumeName())
+	if err != nil {
+		return "", err
+	}
+	defer vol.Free()
+
+	return vol.GetPath()
+}
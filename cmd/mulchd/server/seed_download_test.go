@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		start   int64
+		total   int64
+		wantErr bool
+	}{
+		{header: "bytes 100-199/1000", start: 100, total: 1000},
+		{header: "bytes 0-0/1", start: 0, total: 1},
+		{header: "bytes */1000", start: 0, total: 1000},
+		{header: "bytes 100-199/*", wantErr: true},
+		{header: "bytes 100/1000", wantErr: true},
+		{header: "bytes a-199/1000", wantErr: true},
+		{header: "items 100-199/1000", wantErr: true},
+		{header: "bytes 100-199", wantErr: true},
+		{header: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		start, total, err := parseContentRange(test.header)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.header, err)
+			continue
+		}
+		if start != test.start || total != test.total {
+			t.Errorf("'%s': got %d/%d, want %d/%d", test.header, start, total, test.start, test.total)
+		}
+	}
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 50000)
+
+	reader := newRateLimitedReader(bytes.NewReader(data), 100000)
+	start := time.Now()
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, reader); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("50 KB at 100 KB/s read in %s", elapsed)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("data mismatch")
+	}
+
+	// never more than one second of data at once
+	reader = newRateLimitedReader(bytes.NewReader(data), 1000)
+	n, _ := reader.Read(make([]byte, 5000))
+	if n != 1000 {
+		t.Errorf("got %d bytes, want 1000 (one second)", n)
+	}
+}
+
+func TestSeedDownloadFromResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	lastModified := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+	lmHeader := lastModified.Format(http.TimeFormat)
+
+	// HTTP Range support, from the standard library
+	serveContent := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "image.qcow2", lastModified, bytes.NewReader(content))
+	}
+
+	tests := []struct {
+		name    string
+		partial int // bytes already downloaded
+		handler http.HandlerFunc
+		wantErr bool
+		want    []byte // part file content, nil if removed
+	}{
+		{
+			name:    "new download",
+			partial: 0,
+			handler: serveContent,
+			want:    content,
+		},
+		{
+			name:    "resume",
+			partial: 4000,
+			handler: serveContent,
+			want:    content,
+		},
+		{
+			name:    "already complete (416)",
+			partial: len(content),
+			handler: serveContent,
+			want:    content,
+		},
+		{
+			name:    "200 after a Range request",
+			partial: 4000,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", lmHeader)
+				w.Write(content)
+			},
+			want: content,
+		},
+		{
+			name:    "206 with a mismatched start",
+			partial: 4000,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", lmHeader)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 3000-%d/%d", len(content)-1, len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[3000:])
+			},
+			wantErr: true,
+			want:    nil,
+		},
+		{
+			name:    "416 with a larger partial file",
+			partial: len(content),
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(content)+10))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			wantErr: true,
+			want:    nil,
+		},
+		{
+			name:    "another image",
+			partial: 0,
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "image.qcow2", lastModified.Add(time.Hour), bytes.NewReader(content))
+			},
+			wantErr: true,
+			want:    []byte{},
+		},
+	}
+
+	tmpDir, err := ioutil.TempDir("", "mulch-seed-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	db := &SeedDatabase{app: &App{Config: &AppConfig{}}}
+
+	for _, test := range tests {
+		server := httptest.NewServer(test.handler)
+		seed := &Seed{Name: "test", URL: server.URL + "/image.qcow2"}
+
+		partFile := path.Join(tmpDir, "test.part")
+		os.Remove(partFile)
+		if test.partial > 0 {
+			err := ioutil.WriteFile(partFile, content[:test.partial], 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := db.seedDownloadFrom(seed, db.seedUpstreamRequest, lastModified, partFile)
+		server.Close()
+
+		if test.wantErr && err == nil {
+			t.Errorf("%s: error expected", test.name)
+		}
+		if !test.wantErr {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", test.name, err)
+			} else if seed.Size != uint64(len(content)) {
+				t.Errorf("%s: size is %d, want %d", test.name, seed.Size, len(content))
+			}
+		}
+
+		got, errR := ioutil.ReadFile(partFile)
+		switch {
+		case test.want == nil:
+			if !os.IsNotExist(errR) {
+				t.Errorf("%s: partial file should be removed", test.name)
+			}
+		case test.partial == 0 && test.wantErr:
+			// nothing downloaded, nothing to check
+		case !bytes.Equal(got, test.want):
+			t.Errorf("%s: partial file content mismatch (%d bytes, want %d)", test.name, len(got), len(test.want))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+// getSeederConfig downloads and parses the config of a seeder, and
+// updates its parent
+func (db *SeedDatabase) getSeederConfig(seed *Seed, log *Log) (*VMConfig, error) {
+	_, err := url.ParseRequestURI(seed.Seeder)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := GetContentFromURL(seed.Seeder)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	conf, err := NewVMConfigFromTomlReader(stream, db.app, log)
+	if err != nil {
+		return nil, fmt.Errorf("decoding config: %s", err)
+	}
+
+	parent, _, err := ParseSeedReference(conf.Seed)
+	if err != nil {
+		return nil, err
+	}
+	if parent != seed.Parent {
+		seed.Parent = parent
+		db.Update()
+	}
+
+	return conf, nil
+}
+
+// seederConfig is the config of a seeder, fetched once per seeder pass
+type seederConfig struct {
+	conf *VMConfig
+	err  error
+}
+
+// sortSeeders returns seeders with parents before their children, and
+// seeders involved in (or depending on) a dependency cycle, that are
+// not in the first list. Configs of all seeders are also returned.
+func (db *SeedDatabase) sortSeeders() ([]*Seed, []*Seed, map[string]*seederConfig) {
+	var seeders []*Seed
+	configs := make(map[string]*seederConfig)
+	for _, name := range db.GetNames() {
+		seed, err := db.GetByName(name)
+		if err != nil || seed.Seeder == "" {
+			continue
+		}
+
+		// also refreshes the parent (errors are reported by the caller)
+		log := NewLog(seed.Name, db.app.Hub, db.app.LogHistory)
+		conf, err := db.getSeederConfig(seed, log)
+		configs[seed.Name] = &seederConfig{conf: conf, err: err}
+
+		seeders = append(seeders, seed)
+	}
+
+	// stable order
+	sort.Slice(seeders, func(i, j int) bool {
+		return seeders[i].Name < seeders[j].Name
+	})
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	states := make(map[string]int)
+	inCycle := make(map[string]bool)
+	var sorted []*Seed
+
+	var visit func(seed *Seed) bool
+	visit = func(seed *Seed) bool {
+		switch states[seed.Name] {
+		case visiting:
+			return false
+		case visited:
+			return !inCycle[seed.Name]
+		}
+
+		states[seed.Name] = visiting
+		ok := true
+		if parent, err := db.GetByName(seed.Parent); err == nil && parent.Seeder != "" {
+			ok = visit(parent)
+		}
+		states[seed.Name] = visited
+
+		if !ok {
+			inCycle[seed.Name] = true
+			return false
+		}
+		sorted = append(sorted, seed)
+		return true
+	}
+
+	for _, seed := range seeders {
+		visit(seed)
+	}
+
+	var cycles []*Seed
+	for _, seed := range seeders {
+		if inCycle[seed.Name] {
+			cycles = append(cycles, seed)
+		}
+	}
+
+	return sorted, cycles, configs
+}
+
+// GetUsers returns VMs (with revisions) using each seed, pinned versions
+// are shown as "vm-r1 (@20200701-081500)"
+func (db *SeedDatabase) GetUsers() map[string][]string {
+	users := make(map[string][]string)
+
+	for _, vmName := range db.app.VMDB.GetNames() {
+		vm, err := db.app.VMDB.GetByName(vmName)
+		if err != nil {
+			continue
+		}
+		seedName, version, err := ParseSeedReference(vm.Config.Seed)
+		if err != nil {
+			continue
+		}
+		user := vmName.ID()
+		if version != "" {
+			user = fmt.Sprintf("%s (@%s)", user, version)
+		}
+		users[seedName] = append(users[seedName], user)
+	}
+
+	for name := range users {
+		sort.Strings(users[name])
+	}
+	return users
+}
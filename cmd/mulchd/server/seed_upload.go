@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// qemuImgInfo is the part of "qemu-img info --output=json" we use
+type qemuImgInfo struct {
+	Format          string `json:"format"`
+	BackingFilename string `json:"backing-filename"`
+}
+
+// beginUpload returns the seed (created if needed) and prevents any
+// other upload for it, until endUpload() is called.
+func (db *SeedDatabase) beginUpload(name string) (*Seed, error) {
+	if !IsValidName(name) {
+		return nil, fmt.Errorf("invalid seed name '%s'", name)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	seed, exists := db.db[name]
+	if exists && seed.Uploaded == false {
+		return nil, fmt.Errorf("seed '%s' is defined in mulchd configuration", name)
+	}
+	if db.uploading[name] {
+		return nil, fmt.Errorf("an upload is already running for seed '%s'", name)
+	}
+	if !exists {
+		seed = &Seed{
+			Name:     name,
+			Uploaded: true,
+			Ready:    false,
+		}
+		seed.UpdateStatus("uploading")
+		db.db[name] = seed
+	}
+	db.uploading[name] = true
+
+	return seed, nil
+}
+
+func (db *SeedDatabase) endUpload(name string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	delete(db.uploading, name)
+}
+
+func (db *SeedDatabase) uploadPartFile(name string) string {
+	return path.Join(db.app.Config.TempPath, "mulch-seed-upload-"+name+".part")
+}
+
+// UploadChunk appends a chunk of an uploaded seed image, starting at
+// offset. When the last chunk is received, the image is checked and
+// moved to the seed storage (and true is returned).
+// A failed upload can be resumed at seed.UploadOffset.
+func (db *SeedDatabase) UploadChunk(name string, offset int64, total int64, chunk io.Reader, authorKey string, log *Log) (bool, error) {
+	seed, err := db.beginUpload(name)
+	if err != nil {
+		return false, err
+	}
+	defer db.endUpload(name)
+
+	if offset != 0 && offset != seed.UploadOffset {
+		return false, fmt.Errorf("offset mismatch, server has %d bytes for this upload", seed.UploadOffset)
+	}
+
+	flags := os.O_WRONLY | os.O_APPEND
+	if offset == 0 {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		seed.UploadOffset = 0
+	}
+	seed.UploadTotal = total
+
+	partFile := db.uploadPartFile(name)
+	f, err := os.OpenFile(partFile, flags, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	written, err := io.Copy(f, chunk)
+	f.Close()
+	seed.UploadOffset += written
+	db.Update()
+	if err != nil {
+		return false, fmt.Errorf("upload interrupted at %d bytes: %s", seed.UploadOffset, err)
+	}
+
+	if seed.UploadOffset < total {
+		return false, nil
+	}
+
+	if seed.UploadOffset > total {
+		seed.UploadOffset = 0
+		db.Update()
+		os.Remove(partFile)
+		return false, fmt.Errorf("received more data than expected (%d bytes)", total)
+	}
+
+	err = db.uploadFinalize(seed, partFile, authorKey, log)
+
+	// whatever the result, this upload is over
+	seed.UploadOffset = 0
+	seed.UploadTotal = 0
+	os.Remove(partFile)
+	if err != nil {
+		seed.UpdateStatus(fmt.Sprintf("upload failed: %s", err))
+	}
+	db.Update()
+
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (db *SeedDatabase) uploadFinalize(seed *Seed, file string, authorKey string, log *Log) error {
+	log.Infof("checking image")
+	infos, err := seedImageInfos(file)
+	if err != nil {
+		return err
+	}
+	if infos.Format != "qcow2" {
+		return fmt.Errorf("unsupported image format '%s' (qcow2 needed)", infos.Format)
+	}
+	if infos.BackingFilename != "" {
+		return errors.New("images with a backing file are not allowed")
+	}
+
+	hash, err := seedFileSHA256(file)
+	if err != nil {
+		return err
+	}
+
+	err = db.archiveCurrent(seed, log)
+	if err != nil {
+		return fmt.Errorf("unable to archive current image: %s", err)
+	}
+
+	seed.Ready = false
+	db.Update()
+
+	log.Infof("moving seed '%s' to storage", seed.Name)
+
+	// no error check, a real failure will be detected by UploadFileToLibvirt
+	db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+
+	err = db.app.Libvirt.UploadFileToLibvirt(
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		file,
+		seed.GetVolumeName(),
+		log)
+	if err != nil {
+		return fmt.Errorf("unable to move image to storage: %s", err)
+	}
+
+	volInfos, err := db.app.Libvirt.VolumeInfos(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+	if err != nil {
+		return err
+	}
+
+	seed.Ready = true
+	seed.LastModified = time.Now()
+	seed.Size = volInfos.Allocation
+	seed.SHA256 = hash
+	seed.AuthorKey = authorKey
+	seed.UpdateStatus(fmt.Sprintf("uploaded by %s", authorKey))
+	log.Infof("seed '%s' is now ready", seed.Name)
+
+	return nil
+}
+
+// Delete an uploaded seed (and all its versions)
+func (db *SeedDatabase) Delete(name string, log *Log) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	seed, exists := db.db[name]
+	if !exists {
+		return fmt.Errorf("seed %s does not exists", name)
+	}
+	if seed.Uploaded == false {
+		return fmt.Errorf("seed '%s' is defined in mulchd configuration, remove it there", name)
+	}
+	if db.uploading[name] {
+		return fmt.Errorf("an upload is running for seed '%s'", name)
+	}
+
+	// VMs using this seed would not be rebuildable anymore
+	var users []string
+	for _, vmName := range db.app.VMDB.GetNames() {
+		vm, err := db.app.VMDB.GetByName(vmName)
+		if err != nil {
+			continue
+		}
+		seedName, _, _ := ParseSeedReference(vm.Config.Seed)
+		if seedName == name {
+			users = append(users, vmName.ID())
+		}
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("seed is used by: %s", strings.Join(users, ", "))
+	}
+
+	log.Infof("deleting seed '%s'", name)
+	db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+	for _, version := range seed.Versions {
+		db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
+	}
+	os.Remove(db.uploadPartFile(name))
+
+	delete(db.db, name)
+	return db.save()
+}
+
+func seedImageInfos(file string) (*qemuImgInfo, error) {
+	output, err := exec.Command("qemu-img", "info", "--output=json", file).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+
+	var infos qemuImgInfo
+	err = json.Unmarshal(output, &infos)
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img: unable to parse output: %s", err)
+	}
+	return &infos, nil
+}
+
+func seedFileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// seedChecksumMaxSize limits the size of checksum and signature files
+const seedChecksumMaxSize = 1024 * 1024
+
+// seedVerify checks the downloaded image hash using seed settings
+// (static sha256, or a checksum file, optionally GPG signed)
+func (db *SeedDatabase) seedVerify(seed *Seed, hash string, log *Log) error {
+	if seed.ExpectedSHA256 != "" {
+		if !strings.EqualFold(seed.ExpectedSHA256, hash) {
+			return fmt.Errorf("sha256 mismatch: expected %s, got %s", seed.ExpectedSHA256, hash)
+		}
+		log.Infof("seed '%s': sha256 checksum OK", seed.Name)
+		return nil
+	}
+
+	if seed.ChecksumURL == "" {
+		return nil
+	}
+
+	sums, err := seedGetSmallFile(seed.ChecksumURL)
+	if err != nil {
+		return fmt.Errorf("unable to get checksum file: %s", err)
+	}
+
+	if seed.SignatureURL != "" {
+		signature, err := seedGetSmallFile(seed.SignatureURL)
+		if err != nil {
+			return fmt.Errorf("unable to get signature file: %s", err)
+		}
+		err = seedCheckGPGSignature(sums, signature, seed.GPGKeyring, db.app.Config.TempPath)
+		if err != nil {
+			return err
+		}
+		log.Infof("seed '%s': checksum file signature OK", seed.Name)
+	}
+
+	imageURL, err := url.Parse(seed.URL)
+	if err != nil {
+		return err
+	}
+	filename := path.Base(imageURL.Path)
+
+	expected, err := seedFindChecksum(sums, filename)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(expected, hash) {
+		return fmt.Errorf("sha256 mismatch for '%s': expected %s, got %s", filename, expected, hash)
+	}
+
+	log.Infof("seed '%s': sha256 checksum OK", seed.Name)
+	return nil
+}
+
+func seedGetSmallFile(fileURL string) ([]byte, error) {
+	stream, err := GetContentFromURL(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(stream, seedChecksumMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > seedChecksumMaxSize {
+		return nil, fmt.Errorf("file '%s' is too large", fileURL)
+	}
+	return content, nil
+}
+
+// seedFindChecksum search filename in a sha256sum formatted file
+// ("hash  filename" or "hash *filename", the filename may have a path).
+// An exact filename wins over a filename found in a sub-directory, and
+// different hashes for the same file are rejected. The hash is returned
+// lowercase.
+func seedFindChecksum(sums []byte, filename string) (string, error) {
+	var exact, other []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) < 66 || (line[64] != ' ' && line[64] != '\t') {
+			continue
+		}
+		sum := strings.ToLower(line[:64])
+		if _, err := hex.DecodeString(sum); err != nil {
+			continue
+		}
+		name := strings.TrimLeft(line[64:], " \t")
+		name = strings.TrimPrefix(name, "*")
+		name = strings.TrimPrefix(name, "./")
+
+		switch {
+		case name == filename:
+			exact = append(exact, sum)
+		case path.Base(name) == filename:
+			other = append(other, sum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	candidates := exact
+	if len(candidates) == 0 {
+		candidates = other
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no checksum found for '%s'", filename)
+	}
+	for _, sum := range candidates[1:] {
+		if sum != candidates[0] {
+			return "", fmt.Errorf("multiple checksums found for '%s'", filename)
+		}
+	}
+	return candidates[0], nil
+}
+
+// seedCheckGPGSignature checks a detached signature using gpgv
+func seedCheckGPGSignature(data []byte, signature []byte, keyring string, tmpPath string) error {
+	dataFile, err := ioutil.TempFile(tmpPath, "mulch-seed-sums")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dataFile.Name())
+
+	sigFile, err := ioutil.TempFile(tmpPath, "mulch-seed-sig")
+	if err != nil {
+		dataFile.Close()
+		return err
+	}
+	defer os.Remove(sigFile.Name())
+
+	_, errD := dataFile.Write(data)
+	_, errS := sigFile.Write(signature)
+	dataFile.Close()
+	sigFile.Close()
+	if errD != nil || errS != nil {
+		return fmt.Errorf("unable to write temporary files: %s / %s", errD, errS)
+	}
+
+	output, err := exec.Command("gpgv", "--keyring", keyring, sigFile.Name(), dataFile.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid GPG signature: %s (%s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSeedFindChecksum(t *testing.T) {
+	hashA := strings.Repeat("a", 64)
+	hashB := strings.Repeat("b", 64)
+	hashMixed := "0123456789ABCDEFabcdef0123456789abcdef0123456789ABCDEF0123456789"
+
+	tests := []struct {
+		name     string
+		sums     string
+		filename string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "text mode",
+			sums:     hashB + "  other.qcow2\n" + hashA + "  debian.qcow2\n",
+			filename: "debian.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "binary mode",
+			sums:     hashA + " *debian.qcow2\n",
+			filename: "debian.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "CRLF and leading ./",
+			sums:     hashA + "  ./debian.qcow2\r\n",
+			filename: "debian.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "mixed case, returned lowercase",
+			sums:     hashMixed + "  debian.qcow2\n",
+			filename: "debian.qcow2",
+			want:     strings.ToLower(hashMixed),
+		},
+		{
+			name:     "path",
+			sums:     hashA + "  images/amd64/debian.qcow2\n",
+			filename: "debian.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "exact name wins over a path",
+			sums:     hashB + "  arm64/debian.qcow2\n" + hashA + "  debian.qcow2\n",
+			filename: "debian.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "ambiguous paths",
+			sums:     hashA + "  amd64/debian.qcow2\n" + hashB + "  arm64/debian.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "same file listed twice, different hashes",
+			sums:     hashA + "  debian.qcow2\n" + hashB + "  debian.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "filename with spaces",
+			sums:     hashA + "  my image.qcow2\n",
+			filename: "my image.qcow2",
+			want:     hashA,
+		},
+		{
+			name:     "suffix of another name",
+			sums:     hashA + "  debian.qcow2.sig\n" + hashB + "  old-debian.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "not an hex hash",
+			sums:     strings.Repeat("z", 64) + "  debian.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "too long hash",
+			sums:     hashA + "aa  debian.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "not found",
+			sums:     hashA + "  other.qcow2\n",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+		{
+			name:     "empty file",
+			sums:     "",
+			filename: "debian.qcow2",
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		sum, err := seedFindChecksum([]byte(test.sums), test.filename)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: error expected, got %s", test.name, sum)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if sum != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, sum, test.want)
+		}
+	}
+}
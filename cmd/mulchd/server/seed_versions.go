@@ -0,0 +1,279 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SeedVersionFormat is the format of a seed version ID (image date, UTC)
+const SeedVersionFormat = "20060102-150405"
+
+// seedVersionLegacyFormat was used by older mulchd releases (one version
+// per day), such IDs are still accepted, and a date selects the newest
+// version of this day
+const seedVersionLegacyFormat = "2006-01-02"
+
+// SeedVersion is a previous version of a seed image
+type SeedVersion struct {
+	ID     string
+	Date   time.Time
+	SHA256 string
+	Size   uint64
+	Volume string
+}
+
+// ParseSeedReference splits a "seed@version" reference (version is
+// optional). The version is a version ID ("20200701-093000") or a date
+// ("2020-07-01", newest version of this day).
+func ParseSeedReference(ref string) (string, string, error) {
+	parts := strings.Split(ref, "@")
+	if len(parts) > 2 {
+		return "", "", fmt.Errorf("invalid seed reference '%s'", ref)
+	}
+
+	name := parts[0]
+	if name == "" || !IsValidName(name) {
+		return "", "", fmt.Errorf("invalid seed name '%s'", name)
+	}
+
+	version := ""
+	if len(parts) == 2 {
+		version = parts[1]
+		_, err := time.Parse(SeedVersionFormat, version)
+		if err != nil {
+			_, err = time.Parse(seedVersionLegacyFormat, version)
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("invalid seed version '%s' (format: YYYYMMDD-HHMMSS or YYYY-MM-DD)", version)
+		}
+	}
+	return name, version, nil
+}
+
+// CurrentVersion returns the version ID of the current seed image
+func (seed *Seed) CurrentVersion() string {
+	if seed.LastModified.IsZero() {
+		return ""
+	}
+	return seed.LastModified.UTC().Format(SeedVersionFormat)
+}
+
+// resolveVersion returns the ID of the version matching a reference
+// version: an exact version ID, or a date ("2006-01-02", UTC) selecting
+// the newest version of this day (the current image included)
+func (seed *Seed) resolveVersion(version string) string {
+	if _, err := time.Parse(seedVersionLegacyFormat, version); err != nil {
+		return version
+	}
+
+	id := version
+	var newest time.Time
+	match := func(vID string, date time.Time) {
+		if date.UTC().Format(seedVersionLegacyFormat) == version && date.After(newest) {
+			id = vID
+			newest = date
+		}
+	}
+
+	if seed.Ready && !seed.LastModified.IsZero() {
+		match(seed.CurrentVersion(), seed.LastModified)
+	}
+	for _, v := range seed.Versions {
+		match(v.ID, v.Date)
+	}
+	return id
+}
+
+// GetVolumeNameForVersion return the volume file name of a specific
+// seed version ("" = current version), see resolveVersion
+func (seed *Seed) GetVolumeNameForVersion(version string) (string, error) {
+	version = seed.resolveVersion(version)
+
+	if version == "" || version == seed.CurrentVersion() {
+		if seed.Ready == false {
+			return "", fmt.Errorf("seed %s is not ready", seed.Name)
+		}
+		return seed.GetVolumeName(), nil
+	}
+
+	for _, v := range seed.Versions {
+		if v.ID == version {
+			return v.Volume, nil
+		}
+	}
+	return "", fmt.Errorf("version '%s' of seed %s does not exist", version, seed.Name)
+}
+
+// is this version pinned by a VM?
+func (db *SeedDatabase) isVersionPinned(seed *Seed, version string) bool {
+	for _, vmName := range db.app.VMDB.GetNames() {
+		vm, err := db.app.VMDB.GetByName(vmName)
+		if err != nil {
+			continue
+		}
+		name, pinned, err := ParseSeedReference(vm.Config.Seed)
+		if err == nil && name == seed.Name && pinned != "" && seed.resolveVersion(pinned) == version {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveCurrent keeps a copy of the current seed image before it's
+// replaced, and removes old versions
+func (db *SeedDatabase) archiveCurrent(seed *Seed, log *Log) error {
+	keep := db.app.Config.SeedKeepVersions
+	if keep < 1 || seed.Ready == false || seed.LastModified.IsZero() {
+		return nil
+	}
+
+	versions, err := db.copyCurrent(seed, log)
+	if err != nil {
+		return err
+	}
+
+	// remove old versions (unless pinned by a VM)
+	var kept []*SeedVersion
+	for num, v := range versions {
+		if num < keep || db.isVersionPinned(seed, v.ID) {
+			kept = append(kept, v)
+			continue
+		}
+		log.Infof("removing seed '%s' version %s", seed.Name, v.ID)
+		err := db.app.Libvirt.DeleteVolume(v.Volume, db.app.Libvirt.Pools.Seeds)
+		if err != nil {
+			log.Errorf("unable to delete '%s': %s", v.Volume, err)
+		}
+	}
+	seed.Versions = kept
+
+	return db.Update()
+}
+
+// copy the current image to a version volume, and return the new list
+// of versions (newest first)
+func (db *SeedDatabase) copyCurrent(seed *Seed, log *Log) ([]*SeedVersion, error) {
+	version := &SeedVersion{
+		ID:     seed.CurrentVersion(),
+		Date:   seed.LastModified,
+		SHA256: seed.SHA256,
+		Size:   seed.Size,
+	}
+	version.Volume = seed.Name + "@" + version.ID + ".qcow2"
+
+	log.Infof("archiving seed '%s' version %s", seed.Name, version.ID)
+
+	// same version? (ex: archived by a previous rollback) replace it
+	db.app.Libvirt.DeleteVolume(version.Volume, db.app.Libvirt.Pools.Seeds)
+	var versions []*SeedVersion
+	inserted := false
+	for _, v := range seed.Versions {
+		if v.ID == version.ID {
+			continue
+		}
+		if !inserted && v.Date.Before(version.Date) {
+			versions = append(versions, version)
+			inserted = true
+		}
+		versions = append(versions, v)
+	}
+	if !inserted {
+		versions = append(versions, version)
+	}
+
+	err := db.app.Libvirt.CloneVolume(
+		seed.GetVolumeName(),
+		db.app.Libvirt.Pools.Seeds,
+		version.Volume,
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		log,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Rollback replaces the current seed image with the previous version
+// (the newest one older than the current image). The replaced image is
+// archived, so a rollback can be reverted with a refresh or a rebuild.
+func (db *SeedDatabase) Rollback(seed *Seed, log *Log) error {
+	db.mutex.Lock()
+	uploading := db.uploading[seed.Name]
+	db.mutex.Unlock()
+	if uploading {
+		return fmt.Errorf("an upload is running for seed '%s'", seed.Name)
+	}
+
+	var previous *SeedVersion
+	for _, v := range seed.Versions {
+		if v.Date.Before(seed.LastModified) {
+			previous = v
+			break
+		}
+	}
+	if previous == nil {
+		return errors.New("no previous version available")
+	}
+
+	log.Infof("rolling back seed '%s' to version %s", seed.Name, previous.ID)
+
+	versions := seed.Versions
+	if seed.Ready {
+		var err error
+		versions, err = db.copyCurrent(seed, log)
+		if err != nil {
+			return fmt.Errorf("unable to archive current image: %s", err)
+		}
+	}
+
+	seed.Ready = false
+	db.Update()
+
+	// no error check, a real failure will be detected by CloneVolume
+	db.app.Libvirt.DeleteVolume(seed.GetVolumeName(), db.app.Libvirt.Pools.Seeds)
+
+	err := db.app.Libvirt.CloneVolume(
+		previous.Volume,
+		db.app.Libvirt.Pools.Seeds,
+		seed.GetVolumeName(),
+		db.app.Libvirt.Pools.Seeds,
+		db.app.Libvirt.Pools.SeedsXML,
+		db.app.Config.GetTemplateFilepath("volume.xml"),
+		log,
+	)
+	if err != nil {
+		seed.Versions = versions
+		return err
+	}
+
+	// don't download the faulty upstream image again
+	if seed.URL != "" {
+		seed.IgnoredLastModified = seed.LastModified
+	}
+	// seeders: delay the next rebuild
+	seed.RollbackDate = time.Now()
+	seed.LastModified = previous.Date
+
+	// the previous version is now the current one
+	var kept []*SeedVersion
+	for _, v := range versions {
+		if v.ID == previous.ID && !db.isVersionPinned(seed, v.ID) {
+			db.app.Libvirt.DeleteVolume(v.Volume, db.app.Libvirt.Pools.Seeds)
+			continue
+		}
+		kept = append(kept, v)
+	}
+	seed.Versions = kept
+
+	seed.Ready = true
+	seed.SHA256 = previous.SHA256
+	seed.Size = previous.Size
+	seed.UpdateStatus(fmt.Sprintf("rolled back to version %s", previous.ID))
+
+	return db.Update()
+}
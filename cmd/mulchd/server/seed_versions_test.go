@@ -0,0 +1,108 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSeedReference(t *testing.T) {
+	tests := []struct {
+		ref     string
+		name    string
+		version string
+		wantErr bool
+	}{
+		{ref: "debian_10", name: "debian_10"},
+		{ref: "debian_10@20200701-081500", name: "debian_10", version: "20200701-081500"},
+		{ref: "debian_10@2020-07-01", name: "debian_10", version: "2020-07-01"},
+		{ref: "debian_10@", wantErr: true},
+		{ref: "debian_10@latest", wantErr: true},
+		{ref: "debian_10@20200701", wantErr: true},
+		{ref: "debian_10@2020-13-01", wantErr: true},
+		{ref: "debian_10@20200701-251500", wantErr: true},
+		{ref: "debian_10@2020-07-01@2020-07-02", wantErr: true},
+		{ref: "@2020-07-01", wantErr: true},
+		{ref: "debian-10", wantErr: true},
+		{ref: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		name, version, err := ParseSeedReference(test.ref)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected", test.ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.ref, err)
+			continue
+		}
+		if name != test.name || version != test.version {
+			t.Errorf("'%s': got '%s'/'%s', want '%s'/'%s'", test.ref, name, version, test.name, test.version)
+		}
+	}
+}
+
+func TestSeedGetVolumeNameForVersion(t *testing.T) {
+	date := func(str string) time.Time {
+		d, err := time.Parse(SeedVersionFormat, str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	seed := &Seed{
+		Name:         "debian_10",
+		Ready:        true,
+		LastModified: date("20200703-120000"),
+		Versions: []*SeedVersion{
+			{ID: "20200701-180000", Date: date("20200701-180000"), Volume: "v-0701-18.qcow2"},
+			{ID: "20200701-081500", Date: date("20200701-081500"), Volume: "v-0701-08.qcow2"},
+			// archived by an older release
+			{ID: "2020-06-15", Date: date("20200615-000000"), Volume: "v-0615.qcow2"},
+		},
+	}
+
+	tests := []struct {
+		version string
+		want    string
+		wantErr bool
+	}{
+		{version: "", want: "debian_10.qcow2"},
+		{version: "20200703-120000", want: "debian_10.qcow2"},
+		{version: "2020-07-03", want: "debian_10.qcow2"},
+		{version: "20200701-081500", want: "v-0701-08.qcow2"},
+		{version: "2020-07-01", want: "v-0701-18.qcow2"},
+		{version: "2020-06-15", want: "v-0615.qcow2"},
+		{version: "2020-07-02", wantErr: true},
+		{version: "20200701-081501", wantErr: true},
+	}
+
+	for _, test := range tests {
+		volume, err := seed.GetVolumeNameForVersion(test.version)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("'%s': error expected, got %s", test.version, volume)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %s", test.version, err)
+			continue
+		}
+		if volume != test.want {
+			t.Errorf("'%s': got %s, want %s", test.version, volume, test.want)
+		}
+	}
+
+	// a seed being rebuilt can't give its current image
+	seed.Ready = false
+	if _, err := seed.GetVolumeNameForVersion(""); err == nil {
+		t.Errorf("error expected for a seed that is not ready")
+	}
+	if volume, err := seed.GetVolumeNameForVersion("2020-07-01"); err != nil || volume != "v-0701-18.qcow2" {
+		t.Errorf("got %s (%v), want an archived version", volume, err)
+	}
+}
@@ -4,16 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"sync"
 	"time"
 
-	"github.com/OnitiFR/mulch/common"
-	"github.com/c2h5oh/datasize"
 	"golang.org/x/crypto/ssh"
 	"gopkg.in/libvirt/libvirt-go.v5"
 )
@@ -23,6 +18,9 @@ type SeedDatabase struct {
 	filename string
 	db       map[string]*Seed
 	app      *App
+	mutex    sync.Mutex
+
+	uploading map[string]bool
 }
 
 // Seed entry in the DB
@@ -35,6 +33,36 @@ type Seed struct {
 	Size         uint64
 	Status       string
 	StatusTime   time.Time
+	SHA256       string // hash of the current image (if known)
+
+	// uploaded seeds (not defined in mulchd config)
+	Uploaded     bool
+	AuthorKey    string
+	UploadOffset int64 // received bytes of a pending upload
+	UploadTotal  int64
+
+	// seeders: the seed this seeder is built on (from its config), and
+	// the parent version ("name@version") used by the last build
+	Parent        string
+	ParentVersion string
+
+	// previous images (newest first)
+	Versions []*SeedVersion
+
+	// partial download (resumed if upstream image is still the same)
+	PartialLastModified time.Time
+
+	// upstream image refused by a rollback
+	IgnoredLastModified time.Time
+
+	// last rollback (seeders: the next rebuild is delayed from this date)
+	RollbackDate time.Time
+
+	// verification settings (from config)
+	ExpectedSHA256 string
+	ChecksumURL    string
+	SignatureURL   string
+	GPGKeyring     string
 }
 
 // SeedRefresh force flag
@@ -46,9 +74,10 @@ const (
 // NewSeeder instanciates a new VMDatabase
 func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 	db := &SeedDatabase{
-		app:      app,
-		filename: filename,
-		db:       make(map[string]*Seed),
+		app:       app,
+		filename:  filename,
+		db:        make(map[string]*Seed),
+		uploading: make(map[string]bool),
 	}
 
 	// if the file exists, load it
@@ -71,6 +100,9 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 	for name, configEntry := range app.Config.Seeds {
 		seed, exists := db.db[name]
 		if exists {
+			if seed.Uploaded {
+				return nil, fmt.Errorf("seed '%s': an uploaded seed already exists with this name", name)
+			}
 			if seed.URL != "" && configEntry.URL == "" {
 				return nil, fmt.Errorf("seed '%s': converting URL seeds to Seeders is not supported", name)
 			}
@@ -81,22 +113,30 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 			seed.Seeder = configEntry.Seeder
 		} else {
 			app.Log.Infof("adding a new seed '%s'", name)
-			db.db[name] = &Seed{
+			seed = &Seed{
 				Name:   name,
 				URL:    configEntry.URL,
 				Seeder: configEntry.Seeder,
 				Ready:  false,
 			}
+			db.db[name] = seed
 		}
+		seed.ExpectedSHA256 = configEntry.SHA256
+		seed.ChecksumURL = configEntry.ChecksumURL
+		seed.SignatureURL = configEntry.SignatureURL
+		seed.GPGKeyring = configEntry.GPGKeyring
 	}
 
 	// 2 - remove old entries
 	for name, oldSeed := range db.db {
 		_, exists := app.Config.Seeds[name]
-		if exists == false {
+		if exists == false && oldSeed.Uploaded == false {
 			app.Log.Infof("removing old seed '%s'", name)
 			delete(db.db, name)
 			app.Libvirt.DeleteVolume(oldSeed.GetVolumeName(), app.Libvirt.Pools.Seeds)
+			for _, version := range oldSeed.Versions {
+				app.Libvirt.DeleteVolume(version.Volume, app.Libvirt.Pools.Seeds)
+			}
 		}
 	}
 
@@ -109,6 +149,7 @@ func NewSeeder(filename string, app *App) (*SeedDatabase, error) {
 	return db, nil
 }
 
+// save() is called with the mutex locked
 func (db *SeedDatabase) save() error {
 	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
@@ -139,8 +180,19 @@ func (db *SeedDatabase) load() error {
 	return nil
 }
 
+// Update the database file (after changing a seed)
+func (db *SeedDatabase) Update() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.save()
+}
+
 // GetByName returns a seed using its name (or an error)
 func (db *SeedDatabase) GetByName(name string) (*Seed, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	seed, exits := db.db[name]
 	if exits == false {
 		return nil, fmt.Errorf("seed %s does not exists", name)
@@ -150,6 +202,9 @@ func (db *SeedDatabase) GetByName(name string) (*Seed, error) {
 
 // GetNames returns a list of seed names
 func (db *SeedDatabase) GetNames() []string {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
 	keys := make([]string, 0, len(db.db))
 	for key := range db.db {
 		keys = append(keys, key)
@@ -180,14 +235,19 @@ func (db *SeedDatabase) reportError(seed *Seed, err error) {
 	msg := fmt.Sprintf("seeder '%s': %s", seed.Name, err)
 	db.app.Log.Error(msg)
 	seed.UpdateStatus(msg)
-	db.save()
+	db.Update()
 	seedSendErrorAlert(db.app, seed.Name)
 }
 
 func (db *SeedDatabase) runStepSeeds() {
-	for _, seed := range db.db {
+	for _, name := range db.GetNames() {
 		var err error
 
+		seed, errG := db.GetByName(name)
+		if errG != nil {
+			continue
+		}
+
 		if seed.Seeder != "" {
 			continue
 		}
@@ -203,17 +263,19 @@ func (db *SeedDatabase) runStepSeeds() {
 }
 
 func (db *SeedDatabase) runStepSeeders() {
-	for _, seed := range db.db {
-		var err error
+	// parents first, so children are rebuilt in the same pass
+	seeders, cycles, configs := db.sortSeeders()
 
-		if seed.URL != "" {
-			continue
-		}
+	for _, seed := range cycles {
+		db.reportError(seed, errors.New("dependency cycle between seeders"))
+	}
 
-		if seed.Seeder != "" {
-			err = db.RefreshSeeder(seed, SeedRefreshIfNeeded)
+	for _, seed := range seeders {
+		config := configs[seed.Name]
+		err := config.err
+		if err == nil {
+			err = db.refreshSeeder(seed, config.conf, SeedRefreshIfNeeded)
 		}
-
 		if err != nil {
 			db.reportError(seed, err)
 		}
@@ -224,31 +286,57 @@ func (db *SeedDatabase) runStepSeeders() {
 func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 	log := NewLog(seed.Name, db.app.Hub, db.app.LogHistory)
 
-	_, err := url.ParseRequestURI(seed.Seeder)
+	conf, err := db.getSeederConfig(seed, log)
 	if err != nil {
 		return err
 	}
 
-	stream, err := GetContentFromURL(seed.Seeder)
-	if err != nil {
-		return err
-	}
-	defer stream.Close()
+	return db.refreshSeeder(seed, conf, force)
+}
 
-	conf, err := NewVMConfigFromTomlReader(stream, log)
-	if err != nil {
-		return fmt.Errorf("decoding config: %s", err)
-	}
+func (db *SeedDatabase) refreshSeeder(seed *Seed, conf *VMConfig, force bool) error {
+	log := NewLog(seed.Name, db.app.Hub, db.app.LogHistory)
 
 	if conf.AutoRebuild == "" {
 		return fmt.Errorf("seeder is missing 'auto_rebuild' setting (it's the whole point :)")
 	}
 
-	if !IsRebuildNeeded(conf.AutoRebuild, seed.LastModified) && force != SeedRefreshForce {
+	// compare parent versions (and not dates), so a parent rollback
+	// is also cascaded to its children
+	parentChanged := false
+	parentVersion := ""
+	parent, err := db.GetByName(seed.Parent)
+	if err == nil {
+		if parent.Ready == false {
+			return fmt.Errorf("parent seed '%s' is not ready", parent.Name)
+		}
+		parentVersion = parent.Name + "@" + parent.CurrentVersion()
+		if _, pinned, _ := ParseSeedReference(conf.Seed); pinned != "" {
+			parentVersion = conf.Seed
+		}
+
+		if seed.ParentVersion == "" {
+			// built by an older mulchd release
+			parentChanged = parent.LastModified.After(seed.LastModified)
+		} else {
+			parentChanged = seed.ParentVersion != parentVersion
+		}
+	}
+
+	lastBuild := seed.LastModified
+	if seed.RollbackDate.After(lastBuild) {
+		lastBuild = seed.RollbackDate
+	}
+
+	if !IsRebuildNeeded(conf.AutoRebuild, lastBuild) && !parentChanged && force != SeedRefreshForce {
 		log.Tracef("no rebuild needed yet for seeder '%s'", seed.Name)
 		return nil
 	}
 
+	if parentChanged {
+		log.Infof("parent seed '%s' was updated", parent.Name)
+	}
+
 	db.app.Log.Infof("rebuilding seed '%s'", seed.Name)
 
 	operation := db.app.Operations.Add(&Operation{
@@ -260,7 +348,7 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 	defer db.app.Operations.Remove(operation)
 
 	before := time.Now()
-	_, vmName, err := NewVM(conf, VMInactive, VMStopOnScriptFailure, "[seeder]", db.app, log)
+	_, vmName, err := NewVM(conf, VMInactive, VMStopOnScriptFailure, "[seeder]", nil, db.app, log)
 	if err != nil {
 		log.Failuref("Cannot create VM: %s", err)
 		return err
@@ -321,6 +409,11 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 		return err
 	}
 
+	err = db.archiveCurrent(seed, log)
+	if err != nil {
+		return fmt.Errorf("unable to archive current image: %s", err)
+	}
+
 	seed.Ready = false
 
 	// Delete previous seed volume.
@@ -348,9 +441,10 @@ func (db *SeedDatabase) RefreshSeeder(seed *Seed, force bool) error {
 
 	seed.Ready = true
 	seed.LastModified = time.Now()
+	seed.ParentVersion = parentVersion
 	seed.Size = infos.Allocation
 	seed.UpdateStatus(fmt.Sprintf("seeder was built in %s", after.Sub(before)))
-	db.save()
+	db.Update()
 	db.app.Log.Infof("seed '%s' is now ready", seed.Name)
 
 	return nil
@@ -379,18 +473,35 @@ func (db *SeedDatabase) RefreshSeed(seed *Seed, force bool) error {
 	if err != nil {
 		return fmt.Errorf("can't parse Last-Modified header: %s", err)
 	}
+	if t.Equal(seed.IgnoredLastModified) && force != SeedRefreshForce {
+		log.Tracef("seed '%s': upstream image was refused by a rollback", name)
+		return nil
+	}
+
 	if seed.LastModified != t || force == SeedRefreshForce {
 		log.Infof("downloading seed '%s'", name)
 
 		before := time.Now()
-		tmpFile, err := db.seedDownload(seed, db.app.Config.TempPath)
+		tmpFile, hash, err := db.seedDownload(seed, t, log)
 		if err != nil {
 			return fmt.Errorf("unable to download image: %s", err)
 		}
 		defer os.Remove(tmpFile)
 
+		// the previous image (if any) is kept untouched on failure
+		err = db.seedVerify(seed, hash, log)
+		if err != nil {
+			seed.UpdateStatus(fmt.Sprintf("verification failed: %s", err))
+			return fmt.Errorf("image verification failed: %s", err)
+		}
+
+		err = db.archiveCurrent(seed, log)
+		if err != nil {
+			return fmt.Errorf("unable to archive current image: %s", err)
+		}
+
 		seed.Ready = false
-		db.save()
+		db.Update()
 
 		// upload to libvirt seed storage
 		log.Infof("moving seed '%s' to storage", name)
@@ -417,61 +528,15 @@ func (db *SeedDatabase) RefreshSeed(seed *Seed, force bool) error {
 
 		seed.Ready = true
 		seed.LastModified = t
+		seed.IgnoredLastModified = time.Time{}
+		seed.SHA256 = hash
 		seed.UpdateStatus(fmt.Sprintf("downloaded and stored in %s", after.Sub(before)))
-		db.save()
+		db.Update()
 		log.Infof("seed '%s' is now ready", name)
 	}
 	return nil
 }
 
-func (db *SeedDatabase) seedDownload(seed *Seed, tmpPath string) (string, error) {
-	tmpfile, err := ioutil.TempFile(tmpPath, "mulch-seed-image")
-	if err != nil {
-		return "", err
-	}
-	defer tmpfile.Close()
-
-	operation := db.app.Operations.Add(&Operation{
-		Origin:        "[seeder]",
-		Action:        "download",
-		Ressource:     "seed",
-		RessourceName: seed.GetVolumeName(),
-	})
-	defer db.app.Operations.Remove(operation)
-
-	resp, err := http.Get(seed.URL)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("response was %s (%v)", resp.Status, resp.StatusCode)
-	}
-
-	total, _ := strconv.Atoi(resp.Header.Get("Content-Length"))
-	seed.Size = uint64(total)
-
-	wc := &common.WriteCounter{
-		Total: uint64(total),
-		Step:  1024 * 1024, // 1 MB
-		CB: func(current uint64, total uint64) {
-			seed.UpdateStatus(fmt.Sprintf("downloading %s (%d%%)",
-				(datasize.ByteSize(total) * datasize.B).HR(),
-				(current*100)/total),
-			)
-		},
-	}
-	tee := io.TeeReader(resp.Body, wc)
-
-	_, err = io.Copy(tmpfile, tee)
-	if err != nil {
-		return "", err
-	}
-
-	return tmpfile.Name(), nil
-}
-
 // UpdateStatus change status informations
 func (seed *Seed) UpdateStatus(status string) {
 	seed.Status = status
@@ -12,6 +12,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -23,6 +24,8 @@ type SSHConnection struct {
 	Auths []ssh.AuthMethod
 	Host  string
 	Port  int
+	// dial timeout (0 = none)
+	Timeout time.Duration
 	// Ciphers []string
 	Session *ssh.Session
 	Client  *ssh.Client
@@ -76,8 +79,9 @@ func hostKeyBilndTrustChecker(hostname string, remote net.Addr, key ssh.PublicKe
 // Connect will dial SSH server and open a session
 func (connection *SSHConnection) Connect() error {
 	sshConfig := &ssh.ClientConfig{
-		User: connection.User,
-		Auth: connection.Auths,
+		User:    connection.User,
+		Auth:    connection.Auths,
+		Timeout: connection.Timeout,
 	}
 
 	sshConfig.HostKeyCallback = hostKeyBilndTrustChecker
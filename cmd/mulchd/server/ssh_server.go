@@ -45,6 +45,7 @@ func NewSSHProxyServer(app *App) error {
 
 			user := ""
 			vmName := ""
+			project := "" // access limited to this project
 			var client sshServerClient
 
 			apiKey, errG := app.APIKeysDB.GetByPubKey(string(pubKey.Marshal()))
@@ -61,6 +62,7 @@ func NewSSHProxyServer(app *App) error {
 
 				user = parts[0]
 				vmName = parts[1]
+				project = apiKey.Project
 				client.apiAuth = apiKey.Comment
 				app.Log.Tracef("SSH Proxy: %s (API key '%s') %s@%s", c.RemoteAddr(), apiKey.Comment, user, vmName)
 			} else {
@@ -68,6 +70,19 @@ func NewSSHProxyServer(app *App) error {
 				if errS != nil {
 					return nil, errS
 				}
+				// project extra keys
+				for name, conf := range app.Config.Projects {
+					if matchingPubKey != nil {
+						break
+					}
+					matchingPubKey, comment, errS = SearchSSHAuthorizedKey(pubKey, conf.SSHExtraKeysFile)
+					if errS != nil {
+						return nil, errS
+					}
+					if matchingPubKey != nil {
+						project = name
+					}
+				}
 				// Extra public key access
 				if matchingPubKey != nil {
 					client.apiAuth = "[pubKey] " + comment
@@ -93,6 +108,11 @@ func NewSSHProxyServer(app *App) error {
 				return nil, fmt.Errorf("no allowed public key found (%s)", c.RemoteAddr())
 			}
 
+			// VM names are relative to the project
+			if project != "" && !strings.Contains(vmName, ProjectVMSeparator) {
+				vmName = ProjectVMName(project, vmName)
+			}
+
 			var vm *VM
 
 			if strings.Contains(vmName, "-") {
@@ -123,6 +143,10 @@ func NewSSHProxyServer(app *App) error {
 				}
 			}
 
+			if project != "" && vm.Config.Project != project {
+				return nil, fmt.Errorf("VM %s is not in project '%s'", vmName, project)
+			}
+
 			client.vm = vm
 			client.sshUser = user
 			client.startTime = time.Now()
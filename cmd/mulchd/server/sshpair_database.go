@@ -13,6 +13,7 @@ import (
 const (
 	SSHSuperUserPair = "mulch_super_user"
 	SSHProxyPair     = "mulch_ssh_proxy"
+	SSHGitPair       = "mulch_git_deploy"
 )
 
 // SSHPair describes an OpenSSH formatted key pair
@@ -7,7 +7,6 @@ import (
 	"os"
 	"path"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/OnitiFR/mulch/common"
@@ -32,6 +31,8 @@ const (
 	VMOperationNone    = ""
 	VMOperationBackup  = "backup"
 	VMOperationRestore = "restore"
+	VMOperationToSeed  = "to-seed"
+	VMOperationResize  = "resize"
 )
 
 // Backup compression
@@ -63,14 +64,20 @@ type VM struct {
 	App                 *App
 	Config              *VMConfig
 	AuthorKey           string
+	OwnerKey            string
 	InitDate            time.Time
 	LastIP              string
 	Locked              bool
+	Maintenance         bool
+	CanaryWeight        int
 	WIP                 VMOperation
 	LastRebuildDuration time.Duration
 	LastRebuildDowntime time.Duration
+	LastConfigUpdate    time.Time
 	AssignedMAC         string
 	AssignedIPv4        string
+	AssignedIPv6        string
+	Scripts             []*VMScriptRevision
 }
 
 // SetOperation change VM WIP
@@ -78,16 +85,26 @@ func (vm *VM) SetOperation(op VMOperation) {
 	vm.WIP = op
 }
 
+// Owner returns the API key owning the VM (used for quotas), VMs created
+// before owner tracking are owned by their author
+func (vm *VM) Owner() string {
+	if vm.OwnerKey != "" {
+		return vm.OwnerKey
+	}
+	return vm.AuthorKey
+}
+
 // small helper to generate main disk name
 func vmGenDiskName(vmName *VMName) string {
 	diskName := vmName.ID() + ".qcow2"
 	return diskName
 }
 
-// NewVM builds a new virtual machine from config
+// NewVM builds a new virtual machine from config. If quota is not nil,
+// it's checked for authorKey.
 // TODO: this function is HUUUGE and needs to be splitted. It's tricky
 // because there's a "transaction" here.
-func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey string, app *App, log *Log) (*VM, *VMName, error) {
+func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey string, quota *APIKeyQuota, app *App, log *Log) (*VM, *VMName, error) {
 	log.Infof("creating new VM '%s'", vmConfig.Name)
 
 	commit := false
@@ -102,6 +119,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		SecretUUID: secretUUID.String(),
 		Config:     vmConfig, // copy()? (deep)
 		AuthorKey:  authorKey,
+		OwnerKey:   authorKey,
 		InitDate:   time.Now(),
 		Locked:     false,
 		WIP:        VMOperationNone,
@@ -112,7 +130,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, err
 	}
 
-	if !IsValidName(vmConfig.Name) {
+	if !IsValidVMName(vmConfig.Name) {
 		return nil, nil, fmt.Errorf("name '%s' is invalid (need only letters, numbers and underscore, do not start with a number)", vmConfig.Name)
 	}
 
@@ -131,18 +149,29 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, fmt.Errorf("Unexpected error: %s", err)
 	}
 
-	app.VMDB.AddToMaternity(vm, vmName)
+	// a new revision replaces an existing VM (rebuild room not needed)
+	replace := app.VMDB.GetCountForName(vmConfig.Name) > 0
+	err = app.CheckCapacityAndAdd(vm, vmName, replace, quota, log)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer app.VMDB.DeleteFromMaternity(vmName)
 
 	diskName := vmGenDiskName(vmName)
 
-	seed, err := app.Seeder.GetByName(vmConfig.Seed)
+	seedName, seedVersion, err := ParseSeedReference(vmConfig.Seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seed, err := app.Seeder.GetByName(seedName)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if seed.Ready == false {
-		return nil, nil, fmt.Errorf("seed %s is not ready", vmConfig.Seed)
+	seedVolume, err := seed.GetVolumeNameForVersion(seedVersion)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if active {
@@ -151,6 +180,10 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		if err != nil {
 			return nil, nil, err
 		}
+		err = CheckPortsConflicts(app.VMDB, vmConfig.Ports, vmName.Name, app.Config)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// check if backup exists (if a restore was requested)
@@ -174,6 +207,11 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	if err != nil {
 		return nil, nil, err
 	}
+	// IPv6 is statically configured by cloud-init (see ci-user-data.yml)
+	vm.AssignedIPv6, err = RandomUniqueIPv6(app)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	transientLease := &libvirtxml.NetworkDHCPHost{
 		Name: vmName.LibvirtDomainName(app),
@@ -186,7 +224,7 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	// 1 - copy from reference image
 	log.Infof("creating VM disk '%s'", diskName)
 	err = app.Libvirt.CreateDiskFromSeed(
-		seed.GetVolumeName(),
+		seedVolume,
 		diskName,
 		app.Config.GetTemplateFilepath("volume.xml"),
 		log)
@@ -219,6 +257,23 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, err
 	}
 
+	// 2b - data disks (persistent ones may already exist)
+	err = vmCheckPersistentDisksFree(vmName, vmConfig, app)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	createdDataDisks, err := vmCreateDataDisks(vmName, vmConfig, app, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer func() {
+		if !commit {
+			vmDeleteDataDisks(createdDataDisks, app, log)
+		}
+	}()
+
 	// 3 - define domain
 	log.Infof("defining vm domain (%s)", domainName)
 	xml, err := ioutil.ReadFile(app.Config.GetTemplateFilepath("vm.xml"))
@@ -234,12 +289,15 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 
 	domcfg.Name = domainName
 
+	// max memory and vCPUs give some headroom for online resize (balloon
+	// and vCPU hotplug, see VMResize)
 	domcfg.Memory.Unit = "bytes"
-	domcfg.Memory.Value = uint(vm.Config.RAMSize)
+	domcfg.Memory.Value = uint(vm.Config.RAMSizeMax)
 	domcfg.CurrentMemory.Unit = "bytes"
 	domcfg.CurrentMemory.Value = uint(vm.Config.RAMSize)
 
-	domcfg.VCPU.Value = vm.Config.CPUCount
+	domcfg.VCPU.Value = vm.Config.CPUCountMax
+	domcfg.VCPU.Current = strconv.Itoa(vm.Config.CPUCount)
 
 	serial := "ds=nocloud-net;s=http://" + app.Libvirt.NetworkXML.IPs[0].Address + ":" + strconv.Itoa(AppInternalServerPost) + "/cloud-init/" + vm.SecretUUID + "/"
 	serialFound := false
@@ -267,6 +325,12 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, errors.New("vm xml file: a single disk with 'ua-mulch-disk' alias is required, see sample file")
 	}
 
+	dataDisks, err := vmDataDisksXML(vmName, vmConfig, app)
+	if err != nil {
+		return nil, nil, err
+	}
+	domcfg.Devices.Disks = append(domcfg.Devices.Disks, dataDisks...)
+
 	foundInterfaces := 0
 	for _, intf := range domcfg.Devices.Interfaces {
 		if intf.Alias != nil && intf.Alias.Name == VMNetworkAliasBridge {
@@ -290,6 +354,13 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 			if foundParam != 1 {
 				return nil, nil, fmt.Errorf("vm xml file: found %d IP parameter(s) for %s filter, exactly one is needed", foundParam, AppNWFilter)
 			}
+			if vm.AssignedIPv6 != "" {
+				intf.FilterRef.Filter = AppNWFilterIPv6
+				intf.FilterRef.Parameters = append(intf.FilterRef.Parameters, libvirtxml.DomainInterfaceFilterParam{
+					Name:  "IPV6",
+					Value: vm.AssignedIPv6,
+				})
+			}
 			foundInterfaces++
 		}
 	}
@@ -298,6 +369,8 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		return nil, nil, fmt.Errorf("vm xml file: found %d interface(s) with 'ua-mulch-bridge' alias, exactly one is needed", foundInterfaces)
 	}
 
+	vmLimitsXML(domcfg, &vm.Config.Limits)
+
 	xml2, err := domcfg.Marshal()
 	if err != nil {
 		return nil, nil, err
@@ -371,16 +444,9 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 	log.Infof("running 'prepare' scripts")
 	tasks := []*RunTask{}
 	for _, confTask := range vm.Config.Prepare {
-		stream, errG := GetContentFromURL(confTask.ScriptURL)
+		task, errG := app.ScriptCache.GetTask(vm, "prepare", confTask, log)
 		if errG != nil {
-			return nil, nil, fmt.Errorf("unable to get script '%s': %s", confTask.ScriptURL, errG)
-		}
-		defer stream.Close()
-
-		task := &RunTask{
-			ScriptName:   path.Base(confTask.ScriptURL),
-			ScriptReader: stream,
-			As:           confTask.As,
+			return nil, nil, errG
 		}
 		tasks = append(tasks, task)
 	}
@@ -414,14 +480,19 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 				vmDoAction.Name = value
 			}
 			if isVar, value = common.StringIsVariable(line, "_MULCH_ACTION_SCRIPT"); isVar {
-				stream, errG := GetContentFromURL(value)
+				scriptURL, sum, errP := ParseScriptReference(value)
+				if errP != nil {
+					errDoAction = errP
+					return
+				}
+				_, _, errG := app.ScriptCache.Get(scriptURL, sum, log)
 				if errG != nil {
-					errDoAction = fmt.Errorf("unable to get script '%s': %s", value, errG)
+					errDoAction = fmt.Errorf("unable to get script '%s': %s", scriptURL, errG)
 					return
 				}
-				stream.Close()
 
-				vmDoAction.ScriptURL = value
+				vmDoAction.ScriptURL = scriptURL
+				vmDoAction.SHA256 = sum
 			}
 			if isVar, value = common.StringIsVariable(line, "_MULCH_ACTION_USER"); isVar {
 				vmDoAction.User = value
@@ -480,16 +551,9 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		log.Infof("running 'install' scripts")
 		tasks := []*RunTask{}
 		for _, confTask := range vm.Config.Install {
-			stream, errG := GetContentFromURL(confTask.ScriptURL)
+			task, errG := app.ScriptCache.GetTask(vm, "install", confTask, log)
 			if errG != nil {
-				return nil, nil, fmt.Errorf("unable to get script '%s': %s", confTask.ScriptURL, errG)
-			}
-			defer stream.Close()
-
-			task := &RunTask{
-				ScriptName:   path.Base(confTask.ScriptURL),
-				ScriptReader: stream,
-				As:           confTask.As,
+				return nil, nil, errG
 			}
 			tasks = append(tasks, task)
 		}
@@ -523,6 +587,18 @@ func NewVM(vmConfig *VMConfig, active bool, allowScriptFailure bool, authorKey s
 		}
 	}
 
+	// 6 - check app health (a blank restore will be checked after the
+	// restore, see VMRebuild)
+	if vm.Config.RestoreBackup != BackupBlankRestore {
+		err = VMWaitHealthy(vm, app, log)
+		if err != nil {
+			if !allowScriptFailure {
+				return nil, nil, err
+			}
+			log.Error(err.Error())
+		}
+	}
+
 	// all is OK, commit (= no defer) and save vm to DB
 	log.Infof("saving VM in database")
 	err = app.VMDB.Add(vm, vmName, active)
@@ -675,6 +751,12 @@ func VMLockUnlock(vmName *VMName, locked bool, vmdb *VMDatabase) error {
 	return nil
 }
 
+// VMMaintenance will enable or disable maintenance mode for VM's domains
+// (mulch-proxy will then serve a maintenance page)
+func VMMaintenance(vmName *VMName, enabled bool, vmdb *VMDatabase) error {
+	return vmdb.SetMaintenance(vmName, enabled)
+}
+
 // VMDelete will delete a VM (using its name) and linked storages.
 func VMDelete(vmName *VMName, app *App, log *Log) error {
 	vm, err := app.VMDB.GetByName(vmName)
@@ -738,6 +820,12 @@ func VMDelete(vmName *VMName, app *App, log *Log) error {
 	// Casual refresh, without any error checking. Alacool.
 	app.Libvirt.Pools.Disks.Refresh(0)
 
+	// 1 - delete data disks (persistent ones may be kept)
+	err = vmDeleteDomainDataDisks(vmName, domcfg, app, log)
+	if err != nil {
+		return err
+	}
+
 	// 2 - delete Disk volume
 	if diskName != "" {
 		log.Infof("removing disk volume '%s'", diskName)
@@ -1037,20 +1125,18 @@ func VMBackup(vmName *VMName, authorKey string, app *App, log *Log, compressAllo
 	})
 
 	for _, confTask := range vm.Config.Backup {
-		stream, errG := GetContentFromURL(confTask.ScriptURL)
+		task, errG := app.ScriptCache.GetTask(vm, "backup", confTask, log)
 		if errG != nil {
-			return "", fmt.Errorf("unable to get script '%s': %s", confTask.ScriptURL, errG)
-		}
-		defer stream.Close()
-
-		task := &RunTask{
-			ScriptName:   path.Base(confTask.ScriptURL),
-			ScriptReader: stream,
-			As:           confTask.As,
+			return "", errG
 		}
 		tasks = append(tasks, task)
 	}
 
+	// save recorded script revisions
+	if errU := app.VMDB.Update(); errU != nil {
+		log.Errorf("unable to save script revisions: %s", errU)
+	}
+
 	tasks = append(tasks, &RunTask{
 		ScriptName:   "post-backup.sh",
 		ScriptReader: post,
@@ -1167,20 +1253,18 @@ func VMRestoreNoChecks(vm *VM, vmName *VMName, backup *Backup, app *App, log *Lo
 	})
 
 	for _, confTask := range vm.Config.Restore {
-		stream, errG := GetContentFromURL(confTask.ScriptURL)
+		task, errG := app.ScriptCache.GetTask(vm, "restore", confTask, log)
 		if errG != nil {
-			return fmt.Errorf("unable to get script '%s': %s", confTask.ScriptURL, errG)
-		}
-		defer stream.Close()
-
-		task := &RunTask{
-			ScriptName:   path.Base(confTask.ScriptURL),
-			ScriptReader: stream,
-			As:           confTask.As,
+			return errG
 		}
 		tasks = append(tasks, task)
 	}
 
+	// save recorded script revisions
+	if errU := app.VMDB.Update(); errU != nil {
+		log.Errorf("unable to save script revisions: %s", errU)
+	}
+
 	tasks = append(tasks, &RunTask{
 		ScriptName:   "post-restore.sh",
 		ScriptReader: post,
@@ -1261,6 +1345,11 @@ func VMRename(orgVMName *VMName, newVMName *VMName, app *App, log *Log) error {
 		return err
 	}
 
+	err = vmRenameDataDisks(orgVMName, newVMName, vm.Config, domcfg, app, log)
+	if err != nil {
+		return err
+	}
+
 	newDiskName := vmGenDiskName(newVMName)
 
 	diskName := ""
@@ -1375,13 +1464,13 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 		return errors.New("VM should be up and running")
 	}
 
-	configFile := vm.Config.FileContent
-
-	conf, err := NewVMConfigFromTomlReader(strings.NewReader(configFile), log)
+	conf, err := newVMConfigFromContents(vm.Config.FileContent, vm.Config.ExpandedContent, app, log)
 	if err != nil {
 		return fmt.Errorf("decoding config: %s", err)
 	}
 
+	conf.Version = vm.Config.Version
+
 	if backupAndRestore {
 		conf.RestoreBackup = BackupBlankRestore
 	} else {
@@ -1390,28 +1479,65 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 
 	success := false
 
+	var newVM *VM
+	var newVMName *VMName
+
 	// create VM rev+1
 	// replace original VM author with "rebuilder"
-	newVM, newVMName, err := NewVM(conf, false, VMStopOnScriptFailure, authorKey, app, log)
-	if err != nil {
-		log.Error(err.Error())
-		return fmt.Errorf("Cannot create VM: %s", err)
+	createNewVM := func() error {
+		var errN error
+		newVM, newVMName, errN = NewVM(conf, false, VMStopOnScriptFailure, authorKey, nil, app, log)
+		if errN != nil {
+			log.Error(errN.Error())
+			return fmt.Errorf("Cannot create VM: %s", errN)
+		}
+		// … but keep its owner (quotas)
+		newVM.OwnerKey = vm.Owner()
+		return nil
 	}
 
-	defer func() {
+	deleteNewVM := func() {
 		if success == false {
 			err = VMDelete(newVMName, app, log)
 			if err != nil {
 				log.Error(err.Error())
 			}
 		}
-	}()
+	}
+
+	// persistent disks can't be used by two running revisions, so rev+1
+	// is created after rev+0 backup and shutdown (longer downtime)
+	persistentDisks := vmHasPersistentDisks(conf)
+
+	if !persistentDisks {
+		err = createNewVM()
+		if err != nil {
+			return err
+		}
+		defer deleteNewVM()
+	}
 
 	sourceIsActive := entry.Active
+	originalMaintenance := vm.Maintenance
 
 	downtimeStart := time.Now()
 
 	if sourceIsActive {
+		// keep domains published (in maintenance) while inactive
+		err = VMMaintenance(vmName, true, app.VMDB)
+		if err != nil {
+			return err
+		}
+
+		defer func() {
+			if success == false {
+				err = VMMaintenance(vmName, originalMaintenance, app.VMDB)
+				if err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}()
+
 		// set rev+0 as inactive ("default" behavior, add a --no-downtime flag?)
 		err = app.VMDB.SetActiveRevision(vmName.Name, RevisionNone)
 		if err != nil {
@@ -1428,6 +1554,7 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 		}()
 	}
 
+	var backup *Backup
 	if backupAndRestore {
 		// backup rev+0
 		backupName, err := VMBackup(vmName, authorKey, app, log, BackupCompressDisable)
@@ -1450,20 +1577,55 @@ func VMRebuild(vmName *VMName, lock bool, authorKey string, app *App, log *Log)
 			}
 		}()
 
-		backup := app.BackupsDB.GetByName(backupName)
+		backup = app.BackupsDB.GetByName(backupName)
 		if backup == nil {
 			return fmt.Errorf("can't find backup '%s' in DB", backupName)
 		}
+	}
+
+	if persistentDisks {
+		// stop rev+0, releasing its persistent disks
+		log.Infof("stopping %s (persistent disks)", vmName)
+		err = VMStopByName(vmName, app, log)
+		if err != nil {
+			return fmt.Errorf("stopping original VM: %s", err)
+		}
+
+		defer func() {
+			if success == false {
+				err = VMStartByName(vmName, vm.SecretUUID, app, log)
+				if err != nil {
+					log.Error(err.Error())
+				}
+			}
+		}()
+
+		err = createNewVM()
+		if err != nil {
+			return err
+		}
+		defer deleteNewVM()
+	}
 
+	if backupAndRestore {
 		// restore rev+1
 		err = VMRestoreNoChecks(newVM, newVMName, backup, app, log)
 		if err != nil {
 			return fmt.Errorf("restoring backup: %s", err)
 		}
+
+		err = VMWaitHealthy(newVM, app, log)
+		if err != nil {
+			return err
+		}
 	}
 
 	if sourceIsActive {
 		// activate rev+1
+		err = VMMaintenance(newVMName, originalMaintenance, app.VMDB)
+		if err != nil {
+			return err
+		}
 		err = app.VMDB.SetActiveRevision(newVMName.Name, newVMName.Revision)
 		if err != nil {
 			return fmt.Errorf("can't enable new revision: %s", err)
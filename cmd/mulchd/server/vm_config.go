@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/OnitiFR/mulch/common"
@@ -21,11 +22,21 @@ const (
 	VMAutoRebuildMonthly = "monthly"
 )
 
+// healthcheck type values
+const (
+	VMHealthCheckTypeHTTP    = "http"
+	VMHealthCheckTypeTCP     = "tcp"
+	VMHealthCheckTypeCommand = "command"
+)
+
 // VMConfig stores needed parameters for a new VM
 type VMConfig struct {
-	FileContent string // config file content
+	FileContent     string // config file content
+	ExpandedContent string // same, with includes resolved
+	Version         int    // see VMConfigHistoryDatabase
 
 	Name           string
+	Project        string
 	Hostname       string
 	Timezone       string
 	AppUser        string
@@ -33,13 +44,21 @@ type VMConfig struct {
 	InitUpgrade    bool
 	DiskSize       uint64
 	RAMSize        uint64
+	RAMSizeMax     uint64 // online resize headroom
 	CPUCount       int
+	CPUCountMax    int // online resize headroom
 	Domains        []*common.Domain
+	Ports          []*common.Port
 	Env            map[string]string
 	BackupDiskSize uint64
 	BackupCompress bool
 	RestoreBackup  string
 	AutoRebuild    string
+	Disks          []*VMConfigDisk
+	Limits         VMLimits
+
+	AutoRebuildWindow       string
+	AutoRebuildSkipModified time.Duration
 
 	Prepare []*VMConfigScript
 	Install []*VMConfigScript
@@ -47,25 +66,58 @@ type VMConfig struct {
 	Restore []*VMConfigScript
 
 	DoActions map[string]*VMDoAction
+
+	HealthChecks []*VMHealthCheck
 }
 
 // VMConfigScript is a script for prepare, install, save and restore steps
 type VMConfigScript struct {
 	ScriptURL string
+	SHA256    string // pinned hash (optional)
 	As        string
 }
 
+// VMConfigDisk is an additional data disk, formatted and mounted by
+// cloud-init. A persistent disk is shared by all revisions of the VM and
+// is re-attached to the new revision during rebuilds.
+type VMConfigDisk struct {
+	Name    string
+	Size    uint64
+	Mount   string
+	FS      string
+	Persist bool
+}
+
 // VMDoAction is a script for a "do" action (scripts for usual tasks in the VM)
 type VMDoAction struct {
 	Name        string
 	ScriptURL   string
+	SHA256      string // pinned hash (optional)
 	User        string
 	Description string
+	Schedule    string // cron expression (optional)
 	FromConfig  bool
 }
 
+// VMHealthCheck describes a way to check if the VM application is healthy
+type VMHealthCheck struct {
+	Name             string
+	Type             string
+	Domain           string // http: Host header
+	Port             int    // http, tcp
+	Path             string // http
+	Status           int    // http: expected status code
+	Command          string // command: run in the VM using bash
+	As               string // command: user
+	Interval         time.Duration
+	Timeout          time.Duration
+	FailureThreshold int // consecutive failures needed to become unhealthy
+	SuccessThreshold int // consecutive successes needed to become healthy
+}
+
 type tomlVMConfig struct {
 	Name            string
+	Project         string
 	Hostname        string
 	Timezone        string
 	AppUser         string `toml:"app_user"`
@@ -74,14 +126,30 @@ type tomlVMConfig struct {
 	DiskSize        datasize.ByteSize `toml:"disk_size"`
 	RAMSize         datasize.ByteSize `toml:"ram_size"`
 	CPUCount        int               `toml:"cpu_count"`
+	RAMSizeMax      datasize.ByteSize `toml:"ram_size_max"`
+	CPUCountMax     int               `toml:"cpu_count_max"`
 	Domains         []string
 	RedirectToHTTPS bool `toml:"redirect_to_https"`
 	Redirects       [][]string
+	Ports           []string
 	Env             [][]string
 	BackupDiskSize  datasize.ByteSize `toml:"backup_disk_size"`
 	BackupCompress  bool              `toml:"backup_compress"`
 	RestoreBackup   string            `toml:"restore_backup"`
 	AutoRebuild     string            `toml:"auto_rebuild"`
+	Disks           []tomlVMDisk      `toml:"disks"`
+
+	CPUShares         uint64            `toml:"cpu_shares"`
+	CPUQuota          uint64            `toml:"cpu_quota"`
+	DiskReadBytesSec  datasize.ByteSize `toml:"disk_read_bytes_sec"`
+	DiskWriteBytesSec datasize.ByteSize `toml:"disk_write_bytes_sec"`
+	DiskReadIOPSSec   uint64            `toml:"disk_read_iops_sec"`
+	DiskWriteIOPSSec  uint64            `toml:"disk_write_iops_sec"`
+	NetInboundSec     datasize.ByteSize `toml:"net_inbound_sec"`
+	NetOutboundSec    datasize.ByteSize `toml:"net_outbound_sec"`
+
+	AutoRebuildWindow       string `toml:"auto_rebuild_window"`
+	AutoRebuildSkipModified string `toml:"auto_rebuild_skip_modified"`
 
 	PreparePrefixURL string `toml:"prepare_prefix_url"`
 	Prepare          []string
@@ -93,6 +161,16 @@ type tomlVMConfig struct {
 	Restore          []string
 
 	DoActions []tomlVMDoAction `toml:"do-actions"`
+
+	HealthChecks []tomlVMHealthCheck `toml:"healthcheck"`
+}
+
+type tomlVMDisk struct {
+	Name                 string
+	Size                 datasize.ByteSize
+	Mount                string
+	Filesystem           string
+	PersistAcrossRebuild bool `toml:"persist_across_rebuild"`
 }
 
 type tomlVMDoAction struct {
@@ -100,30 +178,43 @@ type tomlVMDoAction struct {
 	Script      string
 	User        string
 	Description string
+	Schedule    string
+}
+
+type tomlVMHealthCheck struct {
+	Name             string
+	Type             string
+	Domain           string
+	Port             int
+	Path             string
+	Status           int
+	Command          string
+	User             string
+	Interval         string
+	Timeout          string
+	FailureThreshold int `toml:"failure_threshold"`
+	SuccessThreshold int `toml:"success_threshold"`
 }
 
-func vmCheckScriptURL(scriptURL string) error {
-	// test readability
-	stream, errG := GetContentFromURL(scriptURL)
+func vmCheckScriptURL(scriptURL string, sum string, app *App, log *Log) error {
+	// test readability (and pinned hash, if any)
+	content, _, errG := app.ScriptCache.Get(scriptURL, sum, log)
 	if errG != nil {
 		return fmt.Errorf("unable to get script '%s': %s", scriptURL, errG)
 	}
-	defer stream.Close()
 
 	// check script signature
-	signature := make([]byte, 2)
-	n, errR := stream.Read(signature)
-	if n != 2 || errR != nil {
-		return fmt.Errorf("error reading script '%s' (n=%d)", scriptURL, n)
+	if len(content) < 2 {
+		return fmt.Errorf("error reading script '%s' (n=%d)", scriptURL, len(content))
 	}
-	if string(signature) != "#!" {
+	if string(content[:2]) != "#!" {
 		return fmt.Errorf("script '%s': no shebang found, is it really a shell script?", scriptURL)
 	}
 
 	return nil
 }
 
-func vmConfigGetScript(tScript string, prefixURL string) (*VMConfigScript, error) {
+func vmConfigGetScript(tScript string, prefixURL string, app *App, log *Log) (*VMConfigScript, error) {
 	script := &VMConfigScript{}
 
 	sepPlace := strings.Index(tScript, "@")
@@ -132,7 +223,10 @@ func vmConfigGetScript(tScript string, prefixURL string) (*VMConfigScript, error
 	}
 
 	as := tScript[:sepPlace]
-	scriptName := tScript[sepPlace+1:]
+	scriptName, sum, err := ParseScriptReference(tScript[sepPlace+1:])
+	if err != nil {
+		return nil, err
+	}
 
 	if !IsValidName(as) {
 		return nil, fmt.Errorf("'%s' is not a valid user name", as)
@@ -149,47 +243,192 @@ func vmConfigGetScript(tScript string, prefixURL string) (*VMConfigScript, error
 		scriptURL = prefixURL + scriptName
 	}
 
-	if err := vmCheckScriptURL(scriptURL); err != nil {
+	if err := vmCheckScriptURL(scriptURL, sum, app, log); err != nil {
 		return nil, err
 	}
 
 	script.ScriptURL = scriptURL
+	script.SHA256 = sum
 	return script, nil
 }
 
-func vmConfigGetDoAction(tDoAction *tomlVMDoAction) (*VMDoAction, error) {
+func vmConfigGetDoAction(tDoAction *tomlVMDoAction, app *App, log *Log) (*VMDoAction, error) {
 	doAction := &VMDoAction{}
 
 	if tDoAction.Name == "" || !IsValidName(tDoAction.Name) {
 		return nil, fmt.Errorf("invalid action name '%s'", tDoAction.Name)
 	}
 
-	scriptURL := tDoAction.Script
+	scriptURL, sum, err := ParseScriptReference(tDoAction.Script)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := vmCheckScriptURL(scriptURL); err != nil {
+	if err := vmCheckScriptURL(scriptURL, sum, app, log); err != nil {
 		return nil, err
 	}
 
 	doAction.Name = tDoAction.Name
 	doAction.ScriptURL = scriptURL
+	doAction.SHA256 = sum
 	doAction.Description = tDoAction.Description
 	doAction.User = tDoAction.User
 	doAction.FromConfig = true
 
+	if tDoAction.Schedule != "" {
+		if _, err := ParseCronSpec(tDoAction.Schedule); err != nil {
+			return nil, fmt.Errorf("action '%s' schedule: %s", tDoAction.Name, err)
+		}
+		doAction.Schedule = tDoAction.Schedule
+	}
+
 	return doAction, nil
 }
 
+func vmConfigGetHealthCheck(tCheck *tomlVMHealthCheck, vmConfig *VMConfig) (*VMHealthCheck, error) {
+	var err error
+
+	check := &VMHealthCheck{
+		Name:             tCheck.Name,
+		Type:             tCheck.Type,
+		Domain:           strings.TrimSpace(strings.ToLower(tCheck.Domain)),
+		Port:             tCheck.Port,
+		Path:             tCheck.Path,
+		Status:           tCheck.Status,
+		Command:          tCheck.Command,
+		As:               tCheck.User,
+		Interval:         1 * time.Minute,
+		Timeout:          10 * time.Second,
+		FailureThreshold: tCheck.FailureThreshold,
+		SuccessThreshold: tCheck.SuccessThreshold,
+	}
+
+	if check.Name == "" || !IsValidName(check.Name) {
+		return nil, fmt.Errorf("invalid healthcheck name '%s'", check.Name)
+	}
+
+	if tCheck.Interval != "" {
+		check.Interval, err = time.ParseDuration(tCheck.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("healthcheck '%s': invalid interval '%s': %s", check.Name, tCheck.Interval, err)
+		}
+	}
+	if check.Interval < 1*time.Second {
+		return nil, fmt.Errorf("healthcheck '%s': interval is too short (%s)", check.Name, check.Interval)
+	}
+
+	if tCheck.Timeout != "" {
+		check.Timeout, err = time.ParseDuration(tCheck.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("healthcheck '%s': invalid timeout '%s': %s", check.Name, tCheck.Timeout, err)
+		}
+	}
+	if check.Timeout < 1*time.Second {
+		return nil, fmt.Errorf("healthcheck '%s': timeout is too short (%s)", check.Name, check.Timeout)
+	}
+
+	if check.FailureThreshold == 0 {
+		check.FailureThreshold = 3
+	}
+	if check.SuccessThreshold == 0 {
+		check.SuccessThreshold = 1
+	}
+	if check.FailureThreshold < 1 || check.SuccessThreshold < 1 {
+		return nil, fmt.Errorf("healthcheck '%s': thresholds must be positive", check.Name)
+	}
+
+	switch check.Type {
+	case VMHealthCheckTypeHTTP:
+		if check.Domain == "" {
+			for _, domain := range vmConfig.Domains {
+				if domain.RedirectTo == "" {
+					check.Domain = domain.Name
+					break
+				}
+			}
+		}
+		if check.Port == 0 {
+			check.Port = 80
+			for _, domain := range vmConfig.Domains {
+				if domain.Name == check.Domain && domain.RedirectTo == "" {
+					check.Port = domain.DestinationPort
+				}
+			}
+		}
+		if check.Path == "" {
+			check.Path = "/"
+		}
+		if check.Path[0] != '/' {
+			return nil, fmt.Errorf("healthcheck '%s': path must start with a slash ('%s')", check.Name, check.Path)
+		}
+		if check.Status == 0 {
+			check.Status = http.StatusOK
+		}
+	case VMHealthCheckTypeTCP:
+		if check.Port == 0 {
+			return nil, fmt.Errorf("healthcheck '%s': tcp check needs a port", check.Name)
+		}
+	case VMHealthCheckTypeCommand:
+		if check.Command == "" {
+			return nil, fmt.Errorf("healthcheck '%s': command check needs a command", check.Name)
+		}
+		if check.As == "" {
+			check.As = vmConfig.AppUser
+		}
+		if !IsValidName(check.As) {
+			return nil, fmt.Errorf("healthcheck '%s': '%s' is not a valid user name", check.Name, check.As)
+		}
+	default:
+		return nil, fmt.Errorf("healthcheck '%s': invalid type '%s' (http, tcp or command)", check.Name, check.Type)
+	}
+
+	if check.Port < 0 || check.Port > 65535 {
+		return nil, fmt.Errorf("healthcheck '%s': invalid port %d", check.Name, check.Port)
+	}
+
+	return check, nil
+}
+
 // NewVMConfigFromTomlReader cretes a new VMConfig instance from
-// a io.Reader containing VM configuration description
-func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error) {
+// a io.Reader containing VM configuration description (only URL
+// includes are allowed)
+func NewVMConfigFromTomlReader(configIn io.Reader, app *App, log *Log) (*VMConfig, error) {
+	return NewVMConfigFromTomlReaderWithIncludes(configIn, nil, app, log)
+}
+
+// NewVMConfigFromTomlReaderWithIncludes is the same as
+// NewVMConfigFromTomlReader, with local include files sent by the client
+func NewVMConfigFromTomlReaderWithIncludes(configIn io.Reader, files VMConfigIncludes, app *App, log *Log) (*VMConfig, error) {
 	content, err := ioutil.ReadAll(configIn)
 	if err != nil {
 		return nil, err
 	}
 
+	expanded, err := vmConfigExpand(string(content), files)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVMConfigFromContents(string(content), expanded, app, log)
+}
+
+// NewVMConfigFromVersion creates a new VMConfig from a version stored
+// in VMConfigHistoryDatabase (includes are not resolved again)
+func NewVMConfigFromVersion(version *VMConfigVersion, app *App, log *Log) (*VMConfig, error) {
+	return newVMConfigFromContents(version.FileContent, version.ExpandedContent, app, log)
+}
+
+// newVMConfigFromContents parses an already expanded config (includes
+// are not resolved again, during rebuilds for instance)
+func newVMConfigFromContents(content string, expanded string, app *App, log *Log) (*VMConfig, error) {
+	if expanded == "" {
+		expanded = content
+	}
+
 	vmConfig := &VMConfig{
-		Env:         make(map[string]string),
-		FileContent: string(content),
+		Env:             make(map[string]string),
+		FileContent:     content,
+		ExpandedContent: expanded,
 	}
 
 	// defaults (if not in the file)
@@ -203,7 +442,7 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 		BackupCompress:  true,
 	}
 
-	meta, err := toml.Decode(vmConfig.FileContent, tConfig)
+	meta, err := toml.Decode(vmConfig.ExpandedContent, tConfig)
 
 	if err != nil {
 		return nil, err
@@ -219,6 +458,18 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.Name = tConfig.Name
 
+	project := ConfigProject{}
+	if tConfig.Project != "" {
+		var exists bool
+		project, exists = app.Config.Projects[tConfig.Project]
+		if !exists {
+			return nil, fmt.Errorf("unknown project '%s'", tConfig.Project)
+		}
+	}
+	vmConfig.Project = tConfig.Project
+	// VM names are unique per project
+	vmConfig.Name = ProjectVMName(tConfig.Project, tConfig.Name)
+
 	vmConfig.Hostname = tConfig.Hostname
 	vmConfig.Timezone = tConfig.Timezone
 
@@ -227,8 +478,8 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.AppUser = tConfig.AppUser
 
-	if tConfig.Seed == "" || !IsValidName(tConfig.Seed) {
-		return nil, fmt.Errorf("invalid seed image '%s'", tConfig.Seed)
+	if _, _, err := ParseSeedReference(tConfig.Seed); err != nil {
+		return nil, fmt.Errorf("invalid seed image '%s': %s", tConfig.Seed, err)
 	}
 	vmConfig.Seed = tConfig.Seed
 
@@ -249,6 +500,38 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.CPUCount = tConfig.CPUCount
 
+	// default headroom for online resize: twice the initial values
+	if tConfig.RAMSizeMax == 0 {
+		tConfig.RAMSizeMax = tConfig.RAMSize * 2
+	}
+	if tConfig.RAMSizeMax < tConfig.RAMSize {
+		return nil, fmt.Errorf("ram_size_max (%s) is lower than ram_size (%s)", tConfig.RAMSizeMax, tConfig.RAMSize)
+	}
+	vmConfig.RAMSizeMax = tConfig.RAMSizeMax.Bytes()
+
+	if tConfig.CPUCountMax == 0 {
+		tConfig.CPUCountMax = tConfig.CPUCount * 2
+	}
+	if tConfig.CPUCountMax < tConfig.CPUCount {
+		return nil, fmt.Errorf("cpu_count_max (%d) is lower than cpu_count (%d)", tConfig.CPUCountMax, tConfig.CPUCount)
+	}
+	vmConfig.CPUCountMax = tConfig.CPUCountMax
+
+	vmConfig.Limits = VMLimits{
+		CPUShares:         tConfig.CPUShares,
+		CPUQuota:          tConfig.CPUQuota,
+		DiskReadBytesSec:  tConfig.DiskReadBytesSec.Bytes(),
+		DiskWriteBytesSec: tConfig.DiskWriteBytesSec.Bytes(),
+		DiskReadIOPSSec:   tConfig.DiskReadIOPSSec,
+		DiskWriteIOPSSec:  tConfig.DiskWriteIOPSSec,
+		NetInboundSec:     tConfig.NetInboundSec.Bytes(),
+		NetOutboundSec:    tConfig.NetOutboundSec.Bytes(),
+	}
+	err = vmConfig.Limits.Check()
+	if err != nil {
+		return nil, err
+	}
+
 	// seeders, compute VMs, etc
 	// if len(tConfig.Domains) == 0 {
 	// 	log.Warningf("no domain defined for this VM")
@@ -345,6 +628,19 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 		}
 	}
 
+	portMap := make(map[string]bool)
+	for _, portStr := range tConfig.Ports {
+		port, err := vmConfigGetPort(portStr)
+		if err != nil {
+			return nil, err
+		}
+		if portMap[port.Key()] {
+			return nil, fmt.Errorf("port %s is duplicated in this VM", port.Key())
+		}
+		portMap[port.Key()] = true
+		vmConfig.Ports = append(vmConfig.Ports, port)
+	}
+
 	for _, line := range tConfig.Env {
 		if len(line) != 2 {
 			return nil, fmt.Errorf("invalid 'env' line, need two values (key, val), found %d", len(line))
@@ -358,6 +654,12 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 
 		// TODO: check for reserved names?
 
+		for _, secret := range SecretReferences(val) {
+			if !IsValidName(secret) {
+				return nil, fmt.Errorf("env '%s': invalid secret name '%s'", key, secret)
+			}
+		}
+
 		_, exists := vmConfig.Env[key]
 		if exists == true {
 			return nil, fmt.Errorf("duplicated 'env' name '%s'", key)
@@ -366,14 +668,54 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 		vmConfig.Env[key] = val
 	}
 
+	// project defaults
+	for key, val := range project.Env {
+		if _, exists := vmConfig.Env[key]; !exists {
+			vmConfig.Env[key] = val
+		}
+	}
+	if tConfig.PreparePrefixURL == "" {
+		tConfig.PreparePrefixURL = project.PreparePrefixURL
+	}
+	if tConfig.InstallPrefixURL == "" {
+		tConfig.InstallPrefixURL = project.InstallPrefixURL
+	}
+	if tConfig.BackupPrefixURL == "" {
+		tConfig.BackupPrefixURL = project.BackupPrefixURL
+	}
+	if tConfig.RestorePrefixURL == "" {
+		tConfig.RestorePrefixURL = project.RestorePrefixURL
+	}
+
 	if tConfig.BackupDiskSize < 32*datasize.MB {
 		return nil, fmt.Errorf("looks like a too small backup disk (%s)", tConfig.BackupDiskSize)
 	}
 	vmConfig.BackupDiskSize = tConfig.BackupDiskSize.Bytes()
 	vmConfig.BackupCompress = tConfig.BackupCompress
 
+	if len(tConfig.Disks) > VMDisksMax {
+		return nil, fmt.Errorf("too many disks (%d max)", VMDisksMax)
+	}
+	diskNames := make(map[string]bool)
+	diskMounts := make(map[string]bool)
+	for _, tDisk := range tConfig.Disks {
+		disk, err := vmConfigGetDisk(&tDisk)
+		if err != nil {
+			return nil, err
+		}
+		if diskNames[disk.Name] {
+			return nil, fmt.Errorf("duplicated disk name '%s'", disk.Name)
+		}
+		if diskMounts[disk.Mount] {
+			return nil, fmt.Errorf("duplicated disk mount point '%s'", disk.Mount)
+		}
+		diskNames[disk.Name] = true
+		diskMounts[disk.Mount] = true
+		vmConfig.Disks = append(vmConfig.Disks, disk)
+	}
+
 	for _, tScript := range tConfig.Prepare {
-		script, err := vmConfigGetScript(tScript, tConfig.PreparePrefixURL)
+		script, err := vmConfigGetScript(tScript, tConfig.PreparePrefixURL, app, log)
 		if err != nil {
 			return nil, err
 		}
@@ -381,7 +723,7 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 
 	for _, tScript := range tConfig.Install {
-		script, err := vmConfigGetScript(tScript, tConfig.InstallPrefixURL)
+		script, err := vmConfigGetScript(tScript, tConfig.InstallPrefixURL, app, log)
 		if err != nil {
 			return nil, err
 		}
@@ -389,7 +731,7 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 
 	for _, tScript := range tConfig.Backup {
-		script, err := vmConfigGetScript(tScript, tConfig.BackupPrefixURL)
+		script, err := vmConfigGetScript(tScript, tConfig.BackupPrefixURL, app, log)
 		if err != nil {
 			return nil, err
 		}
@@ -397,7 +739,7 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 
 	for _, tScript := range tConfig.Restore {
-		script, err := vmConfigGetScript(tScript, tConfig.RestorePrefixURL)
+		script, err := vmConfigGetScript(tScript, tConfig.RestorePrefixURL, app, log)
 		if err != nil {
 			return nil, err
 		}
@@ -405,16 +747,37 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 	}
 	vmConfig.RestoreBackup = tConfig.RestoreBackup
 
-	if tConfig.AutoRebuild != "" && tConfig.AutoRebuild != VMAutoRebuildDaily &&
+	if IsCronExpression(tConfig.AutoRebuild) {
+		if _, err := ParseCronSpec(tConfig.AutoRebuild); err != nil {
+			return nil, fmt.Errorf("auto_rebuild: %s", err)
+		}
+		if tConfig.AutoRebuildWindow != "" {
+			return nil, fmt.Errorf("auto_rebuild_window can't be used with a cron expression")
+		}
+	} else if tConfig.AutoRebuild != "" && tConfig.AutoRebuild != VMAutoRebuildDaily &&
 		tConfig.AutoRebuild != VMAutoRebuildWeekly && tConfig.AutoRebuild != VMAutoRebuildMonthly {
 		return nil, fmt.Errorf("'%s' is not a correct value for auto_rebuild setting", tConfig.AutoRebuild)
 	}
 	vmConfig.AutoRebuild = tConfig.AutoRebuild
 
+	if tConfig.AutoRebuildWindow != "" {
+		if _, _, err := ParseTimeWindow(tConfig.AutoRebuildWindow); err != nil {
+			return nil, fmt.Errorf("auto_rebuild_window: %s", err)
+		}
+	}
+	vmConfig.AutoRebuildWindow = tConfig.AutoRebuildWindow
+
+	if tConfig.AutoRebuildSkipModified != "" {
+		vmConfig.AutoRebuildSkipModified, err = time.ParseDuration(tConfig.AutoRebuildSkipModified)
+		if err != nil {
+			return nil, fmt.Errorf("auto_rebuild_skip_modified: %s", err)
+		}
+	}
+
 	var actions []*VMDoAction
 
 	for _, tDoAction := range tConfig.DoActions {
-		doAction, err := vmConfigGetDoAction(&tDoAction)
+		doAction, err := vmConfigGetDoAction(&tDoAction, app, log)
 		if err != nil {
 			return nil, err
 		}
@@ -431,5 +794,18 @@ func NewVMConfigFromTomlReader(configIn io.Reader, log *Log) (*VMConfig, error)
 		vmConfig.DoActions[action.Name] = action
 	}
 
+	checkNames := make(map[string]bool)
+	for _, tCheck := range tConfig.HealthChecks {
+		check, err := vmConfigGetHealthCheck(&tCheck, vmConfig)
+		if err != nil {
+			return nil, err
+		}
+		if checkNames[check.Name] {
+			return nil, fmt.Errorf("duplicate healthcheck '%s'", check.Name)
+		}
+		checkNames[check.Name] = true
+		vmConfig.HealthChecks = append(vmConfig.HealthChecks, check)
+	}
+
 	return vmConfig, nil
 }
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VMConfigVersion is a version of a VM config file (all versions are
+// kept, for every create and redefine)
+type VMConfigVersion struct {
+	Version         int
+	Date            time.Time
+	AuthorKey       string
+	Message         string
+	FileContent     string
+	ExpandedContent string
+}
+
+// VMConfigHistoryDatabase stores all config versions, per VM name (so
+// the history is shared by all revisions of a VM)
+type VMConfigHistoryDatabase struct {
+	filename string
+	db       map[string][]*VMConfigVersion
+	mutex    sync.Mutex
+}
+
+// NewVMConfigHistoryDatabase instanciates a new VMConfigHistoryDatabase
+func NewVMConfigHistoryDatabase(filename string) (*VMConfigHistoryDatabase, error) {
+	db := &VMConfigHistoryDatabase{
+		filename: filename,
+		db:       make(map[string][]*VMConfigVersion),
+	}
+
+	// if the file exists, load it
+	if _, err := os.Stat(db.filename); err == nil {
+		err = db.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// save the file to check if it's writable
+	err := db.save()
+	if err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// This is done internaly, because it must be done with the mutex locked,
+// but we can't lock it here, since save() is called by functions that
+// are already locking the mutex.
+func (db *VMConfigHistoryDatabase) save() error {
+	f, err := os.OpenFile(db.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&db.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *VMConfigHistoryDatabase) load() error {
+	f, err := os.Open(db.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	requiredMode, err := strconv.ParseInt("0600", 8, 32)
+	if err != nil {
+		return err
+	}
+
+	if stat.Mode() != os.FileMode(requiredMode) {
+		return fmt.Errorf("%s: only the owner should be able to read/write this file (mode 0600)", db.filename)
+	}
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(&db.db)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Add a new version of the config, and return its version number
+func (db *VMConfigHistoryDatabase) Add(vmName string, config *VMConfig, authorKey string, message string) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	versions := db.db[vmName]
+	number := 1
+	if len(versions) > 0 {
+		number = versions[len(versions)-1].Version + 1
+	}
+
+	db.db[vmName] = append(versions, &VMConfigVersion{
+		Version:         number,
+		Date:            time.Now(),
+		AuthorKey:       authorKey,
+		Message:         message,
+		FileContent:     config.FileContent,
+		ExpandedContent: config.ExpandedContent,
+	})
+
+	return number, db.save()
+}
+
+// Get all config versions of a VM (oldest first)
+func (db *VMConfigHistoryDatabase) Get(vmName string) []*VMConfigVersion {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	return db.db[vmName]
+}
+
+// GetVersion returns a specific config version of a VM
+func (db *VMConfigHistoryDatabase) GetVersion(vmName string, version int) (*VMConfigVersion, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for _, v := range db.db[vmName] {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("config version %d not found for VM '%s'", version, vmName)
+}
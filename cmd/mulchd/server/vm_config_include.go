@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// vmConfigIncludeMaxDepth limits nested includes
+const vmConfigIncludeMaxDepth = 10
+
+// script steps, each with its "<step>_prefix_url" setting
+var vmConfigScriptSteps = []string{"prepare", "install", "backup", "restore"}
+
+// VMConfigIncludes are local include files sent by the client, indexed
+// by their key (see vmConfigIncludeKey)
+type VMConfigIncludes map[string]string
+
+// vmConfigExpand resolves "include" settings of a VM config and returns
+// the expanded config. Merge rules:
+// - scalars: the including file wins, and a later include overrides an
+// earlier one
+// - arrays (scripts, domains, …): concatenated, in include order, then
+// values of the including file
+// - env and do-actions: merged by key (env name, action name), same
+// override order as scalars
+// - tables: merged recursively, using the same rules
+// Relative scripts are resolved against the prefix URL of their own file
+// before merging (then against the project prefix, if still relative).
+func vmConfigExpand(content string, files VMConfigIncludes) (string, error) {
+	tree, includes, err := vmConfigLoadTree(content, "config", files, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// nothing to expand, keep the original file (with comments)
+	if includes == 0 {
+		return content, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("# expanded config (includes resolved by mulchd)\n\n")
+	enc := toml.NewEncoder(&buf)
+	err = enc.Encode(tree)
+	if err != nil {
+		return "", fmt.Errorf("encoding expanded config: %s", err)
+	}
+	return buf.String(), nil
+}
+
+// returns the merged tree and the number of includes
+func vmConfigLoadTree(content string, name string, files VMConfigIncludes, stack []string) (map[string]interface{}, int, error) {
+	tree := make(map[string]interface{})
+	if _, err := toml.Decode(content, &tree); err != nil {
+		return nil, 0, fmt.Errorf("%s: %s", name, err)
+	}
+
+	vmConfigResolvePrefixes(tree)
+
+	raw, exists := tree["include"]
+	if !exists {
+		return tree, 0, nil
+	}
+	delete(tree, "include")
+
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: 'include' must be a list of files/URLs", name)
+	}
+
+	if len(stack) >= vmConfigIncludeMaxDepth {
+		return nil, 0, fmt.Errorf("%s: too many nested includes", name)
+	}
+
+	// key of this file (the main config file has none)
+	current := ""
+	if len(stack) > 0 {
+		current = stack[len(stack)-1]
+	}
+
+	count := 0
+	merged := make(map[string]interface{})
+	for _, item := range list {
+		include, ok := item.(string)
+		if !ok {
+			return nil, 0, fmt.Errorf("%s: 'include' must be a list of files/URLs", name)
+		}
+		key := vmConfigIncludeKey(current, include)
+
+		for _, parent := range stack {
+			if parent == key {
+				return nil, 0, fmt.Errorf("%s: include loop with '%s'", name, key)
+			}
+		}
+
+		includeContent, err := vmConfigGetInclude(key, files)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %s", name, err)
+		}
+
+		// copy the stack, sibling includes must not share its backing array
+		subStack := append(append([]string{}, stack...), key)
+		sub, subCount, err := vmConfigLoadTree(includeContent, key, files, subStack)
+		if err != nil {
+			return nil, 0, err
+		}
+		vmConfigMerge(merged, sub)
+		count += subCount + 1
+	}
+	vmConfigMerge(merged, tree)
+
+	return merged, count, nil
+}
+
+// vmConfigIncludeKey returns the key of an include of the parent file:
+// URLs are kept as-is (or resolved against the parent, if it's an URL),
+// local files use their cleaned path, relative to the directory of the
+// main config file (the client uses the same keys when sending them).
+func vmConfigIncludeKey(parent string, include string) string {
+	if vmConfigIsURL(include) {
+		return include
+	}
+
+	if vmConfigIsURL(parent) {
+		base, err := url.Parse(parent)
+		if err != nil {
+			return include
+		}
+		ref, err := url.Parse(include)
+		if err != nil {
+			return include
+		}
+		return base.ResolveReference(ref).String()
+	}
+
+	if path.IsAbs(include) {
+		return path.Clean(include)
+	}
+	return path.Join(path.Dir(parent), include)
+}
+
+func vmConfigIsURL(include string) bool {
+	return strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://")
+}
+
+func vmConfigGetInclude(include string, files VMConfigIncludes) (string, error) {
+	if vmConfigIsURL(include) {
+		stream, err := GetContentFromURL(include)
+		if err != nil {
+			return "", fmt.Errorf("include '%s': %s", include, err)
+		}
+		defer stream.Close()
+
+		content, err := ioutil.ReadAll(stream)
+		if err != nil {
+			return "", fmt.Errorf("include '%s': %s", include, err)
+		}
+		return string(content), nil
+	}
+
+	content, exists := files[include]
+	if !exists {
+		return "", fmt.Errorf("include '%s' not found (local includes must be sent by the client)", include)
+	}
+	return content, nil
+}
+
+// prefix relative scripts of a file with its own prefix URLs, and
+// remove those settings (they would leak to other files when merged)
+func vmConfigResolvePrefixes(tree map[string]interface{}) {
+	for _, step := range vmConfigScriptSteps {
+		prefix, ok := tree[step+"_prefix_url"].(string)
+		if !ok {
+			continue
+		}
+		delete(tree, step+"_prefix_url")
+
+		list, ok := tree[step].([]interface{})
+		if !ok {
+			continue
+		}
+		for i, item := range list {
+			if tScript, ok := item.(string); ok {
+				list[i] = vmConfigPrefixScript(tScript, prefix)
+			}
+		}
+	}
+}
+
+// "user@script" -> "user@<prefix>script", if script is not an URL
+// (invalid lines are returned as-is, they're rejected later)
+func vmConfigPrefixScript(tScript string, prefix string) string {
+	sepPlace := strings.Index(tScript, "@")
+	if sepPlace == -1 {
+		return tScript
+	}
+
+	ref := tScript[sepPlace+1:]
+	scriptName := ref
+	if pos := strings.Index(ref, ScriptPinSeparator); pos != -1 {
+		scriptName = ref[:pos]
+	}
+
+	if _, err := url.ParseRequestURI(scriptName); err == nil {
+		return tScript
+	}
+	return tScript[:sepPlace+1] + prefix + ref
+}
+
+// merge src into dst (see vmConfigExpand for rules)
+func vmConfigMerge(dst map[string]interface{}, src map[string]interface{}) {
+	for key, srcVal := range src {
+		dstVal, exists := dst[key]
+		if !exists {
+			dst[key] = srcVal
+			continue
+		}
+
+		switch key {
+		case "env":
+			dstTyped, dstOk := dstVal.([]interface{})
+			srcTyped, srcOk := srcVal.([]interface{})
+			if dstOk && srcOk {
+				dst[key] = vmConfigMergeEnv(dstTyped, srcTyped)
+				continue
+			}
+		case "do-actions":
+			dstTyped, dstOk := dstVal.([]map[string]interface{})
+			srcTyped, srcOk := srcVal.([]map[string]interface{})
+			if dstOk && srcOk {
+				dst[key] = vmConfigMergeDoActions(dstTyped, srcTyped)
+				continue
+			}
+		}
+
+		switch srcTyped := srcVal.(type) {
+		case map[string]interface{}:
+			if dstTyped, ok := dstVal.(map[string]interface{}); ok {
+				vmConfigMerge(dstTyped, srcTyped)
+				continue
+			}
+		case []interface{}:
+			if dstTyped, ok := dstVal.([]interface{}); ok {
+				dst[key] = append(dstTyped, srcTyped...)
+				continue
+			}
+		case []map[string]interface{}:
+			if dstTyped, ok := dstVal.([]map[string]interface{}); ok {
+				dst[key] = append(dstTyped, srcTyped...)
+				continue
+			}
+		}
+		dst[key] = srcVal
+	}
+}
+
+// src env lines override dst lines with the same name, others are
+// appended (duplicates inside src are kept, and rejected later)
+func vmConfigMergeEnv(dst []interface{}, src []interface{}) []interface{} {
+	index := make(map[string]int)
+	for i, line := range dst {
+		if key := vmConfigEnvKey(line); key != "" {
+			index[key] = i
+		}
+	}
+
+	for _, line := range src {
+		key := vmConfigEnvKey(line)
+		if i, exists := index[key]; exists {
+			dst[i] = line
+			delete(index, key)
+			continue
+		}
+		dst = append(dst, line)
+	}
+	return dst
+}
+
+func vmConfigEnvKey(line interface{}) string {
+	values, ok := line.([]interface{})
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	key, _ := values[0].(string)
+	return key
+}
+
+// same as vmConfigMergeEnv, using action names
+func vmConfigMergeDoActions(dst []map[string]interface{}, src []map[string]interface{}) []map[string]interface{} {
+	index := make(map[string]int)
+	for i, action := range dst {
+		if name, _ := action["name"].(string); name != "" {
+			index[name] = i
+		}
+	}
+
+	for _, action := range src {
+		name, _ := action["name"].(string)
+		if i, exists := index[name]; exists {
+			dst[i] = action
+			delete(index, name)
+			continue
+		}
+		dst = append(dst, action)
+	}
+	return dst
+}
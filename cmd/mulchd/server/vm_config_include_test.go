@@ -0,0 +1,216 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVMConfigMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		dst  map[string]interface{}
+		src  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "scalar override",
+			dst:  map[string]interface{}{"seed": "debian_10", "cpu_count": int64(1)},
+			src:  map[string]interface{}{"seed": "ubuntu_2004"},
+			want: map[string]interface{}{"seed": "ubuntu_2004", "cpu_count": int64(1)},
+		},
+		{
+			name: "lists are concatenated",
+			dst:  map[string]interface{}{"domains": []interface{}{"a.com"}},
+			src:  map[string]interface{}{"domains": []interface{}{"b.com"}},
+			want: map[string]interface{}{"domains": []interface{}{"a.com", "b.com"}},
+		},
+		{
+			name: "tables are merged",
+			dst: map[string]interface{}{
+				"t": map[string]interface{}{"a": "1", "b": "2"},
+			},
+			src: map[string]interface{}{
+				"t": map[string]interface{}{"b": "3"},
+			},
+			want: map[string]interface{}{
+				"t": map[string]interface{}{"a": "1", "b": "3"},
+			},
+		},
+		{
+			name: "env merged by name",
+			dst: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"A", "1"},
+				[]interface{}{"B", "2"},
+			}},
+			src: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"B", "20"},
+				[]interface{}{"C", "3"},
+			}},
+			want: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"A", "1"},
+				[]interface{}{"B", "20"},
+				[]interface{}{"C", "3"},
+			}},
+		},
+		{
+			name: "env duplicates in the same file are kept",
+			dst: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"A", "1"},
+			}},
+			src: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"A", "2"},
+				[]interface{}{"A", "3"},
+			}},
+			want: map[string]interface{}{"env": []interface{}{
+				[]interface{}{"A", "2"},
+				[]interface{}{"A", "3"},
+			}},
+		},
+		{
+			name: "do-actions merged by name",
+			dst: map[string]interface{}{"do-actions": []map[string]interface{}{
+				{"name": "db", "script": "a.sh"},
+				{"name": "open", "script": "b.sh"},
+			}},
+			src: map[string]interface{}{"do-actions": []map[string]interface{}{
+				{"name": "open", "script": "c.sh"},
+				{"name": "logs", "script": "d.sh"},
+			}},
+			want: map[string]interface{}{"do-actions": []map[string]interface{}{
+				{"name": "db", "script": "a.sh"},
+				{"name": "open", "script": "c.sh"},
+				{"name": "logs", "script": "d.sh"},
+			}},
+		},
+		{
+			name: "type mismatch, src wins",
+			dst:  map[string]interface{}{"ports": []interface{}{"80/tcp"}},
+			src:  map[string]interface{}{"ports": "none"},
+			want: map[string]interface{}{"ports": "none"},
+		},
+	}
+
+	for _, test := range tests {
+		vmConfigMerge(test.dst, test.src)
+		if !reflect.DeepEqual(test.dst, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.dst, test.want)
+		}
+	}
+}
+
+func TestVMConfigResolvePrefixes(t *testing.T) {
+	sum := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name string
+		tree map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "relative and absolute scripts",
+			tree: map[string]interface{}{
+				"install_prefix_url": "https://a.com/",
+				"install": []interface{}{
+					"admin@deb.sh",
+					"app@https://b.com/wp.sh",
+				},
+			},
+			want: map[string]interface{}{
+				"install": []interface{}{
+					"admin@https://a.com/deb.sh",
+					"app@https://b.com/wp.sh",
+				},
+			},
+		},
+		{
+			name: "pinned script",
+			tree: map[string]interface{}{
+				"prepare_prefix_url": "https://a.com/",
+				"prepare":            []interface{}{"admin@deb.sh" + ScriptPinSeparator + sum},
+			},
+			want: map[string]interface{}{
+				"prepare": []interface{}{"admin@https://a.com/deb.sh" + ScriptPinSeparator + sum},
+			},
+		},
+		{
+			name: "no prefix, left for the project",
+			tree: map[string]interface{}{
+				"backup": []interface{}{"app@backup.sh"},
+			},
+			want: map[string]interface{}{
+				"backup": []interface{}{"app@backup.sh"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		vmConfigResolvePrefixes(test.tree)
+		if !reflect.DeepEqual(test.tree, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.tree, test.want)
+		}
+	}
+}
+
+func TestVMConfigIncludeKey(t *testing.T) {
+	tests := []struct {
+		parent  string
+		include string
+		want    string
+	}{
+		{"", "common.toml", "common.toml"},
+		{"", "./a/../b/x.toml", "b/x.toml"},
+		{"", "../shared/base.toml", "../shared/base.toml"},
+		{"a/x.toml", "common.toml", "a/common.toml"},
+		{"a/x.toml", "../b/y.toml", "b/y.toml"},
+		{"a/x.toml", "/etc/mulch/base.toml", "/etc/mulch/base.toml"},
+		{"a/x.toml", "https://example.com/base.toml", "https://example.com/base.toml"},
+		{"https://example.com/mulch/wp.toml", "lamp.toml", "https://example.com/mulch/lamp.toml"},
+	}
+
+	for _, test := range tests {
+		got := vmConfigIncludeKey(test.parent, test.include)
+		if got != test.want {
+			t.Errorf("'%s' from '%s': got '%s', want '%s'", test.include, test.parent, got, test.want)
+		}
+	}
+}
+
+func TestVMConfigLoadTreeIncludes(t *testing.T) {
+	// two directories, each with its own common.toml
+	files := VMConfigIncludes{
+		"a/x.toml":      "include = [\"common.toml\"]\nx = \"x\"\n",
+		"a/common.toml": "from_a = \"a\"\n",
+		"b/y.toml":      "include = [\"common.toml\"]\ny = \"y\"\n",
+		"b/common.toml": "from_b = \"b\"\n",
+	}
+	tree, count, err := vmConfigLoadTree("include = [\"a/x.toml\", \"b/y.toml\"]\n", "config", files, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[string]interface{}{"x": "x", "y": "y", "from_a": "a", "from_b": "b"}
+	if !reflect.DeepEqual(tree, want) || count != 4 {
+		t.Errorf("got %v (%d includes), want %v (4 includes)", tree, count, want)
+	}
+
+	// the same file included twice, but not a loop
+	files = VMConfigIncludes{
+		"a.toml":      "include = [\"common.toml\"]\n",
+		"b.toml":      "include = [\"common.toml\"]\n",
+		"common.toml": "c = 1\n",
+	}
+	_, _, err = vmConfigLoadTree("include = [\"a.toml\", \"b.toml\"]\n", "config", files, nil)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	// a real loop, using another path to the same file
+	files = VMConfigIncludes{
+		"a/x.toml": "include = [\"../b/y.toml\"]\n",
+		"b/y.toml": "include = [\"./../a/x.toml\"]\n",
+	}
+	_, _, err = vmConfigLoadTree("include = [\"a/x.toml\"]\n", "config", files, nil)
+	if err == nil || !strings.Contains(err.Error(), "include loop") {
+		t.Errorf("include loop error expected, got %v", err)
+	}
+}
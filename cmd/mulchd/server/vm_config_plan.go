@@ -0,0 +1,295 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// VMConfigPlan checks a parsed config without creating anything: seed
+// readiness, domain conflicts, backup to restore and host capacity (script
+// reachability is already checked while parsing). Use current if the
+// config will replace an existing VM config (redefine).
+func VMConfigPlan(conf *VMConfig, current *VMConfig, app *App, log *Log) error {
+	problems := 0
+	fail := func(format string, args ...interface{}) {
+		problems++
+		log.Errorf(format, args...)
+	}
+
+	// seed
+	seedName, seedVersion, err := ParseSeedReference(conf.Seed)
+	if err != nil {
+		fail("seed: %s", err)
+	} else if seed, errG := app.Seeder.GetByName(seedName); errG != nil {
+		fail("seed: %s", errG)
+	} else if !seed.Ready {
+		fail("seed '%s' is not ready (%s)", seedName, seed.Status)
+	} else if _, errV := seed.GetVolumeNameForVersion(seedVersion); errV != nil {
+		fail("seed: %s", errV)
+	} else {
+		log.Successf("seed '%s' is ready", conf.Seed)
+	}
+
+	// domains
+	excludeVM := ""
+	if current != nil {
+		excludeVM = current.Name
+	} else if app.VMDB.GetCountForName(conf.Name) > 0 {
+		log.Warningf("VM '%s' already exists (a new revision is needed)", conf.Name)
+	}
+	err = CheckDomainsConflicts(app.VMDB, conf.Domains, excludeVM, app.Config)
+	if err != nil {
+		fail("domains: %s", err)
+	} else {
+		log.Successf("no domain conflict (%d domain(s))", len(conf.Domains))
+	}
+
+	// ports
+	err = CheckPortsConflicts(app.VMDB, conf.Ports, excludeVM, app.Config)
+	if err != nil {
+		fail("ports: %s", err)
+	} else if len(conf.Ports) > 0 {
+		log.Successf("no port conflict (%d port(s))", len(conf.Ports))
+	}
+
+	// backup
+	if conf.RestoreBackup != "" && conf.RestoreBackup != BackupBlankRestore {
+		if app.BackupsDB.GetByName(conf.RestoreBackup) == nil {
+			fail("backup '%s' not found in database", conf.RestoreBackup)
+		}
+	}
+	if conf.RestoreBackup != "" && len(conf.Restore) == 0 {
+		fail("no restore script defined, can't restore")
+	}
+
+	// host capacity
+	status, err := app.Status()
+	if err != nil {
+		fail("unable to get host status: %s", err)
+	} else {
+		ramMB := int(conf.RAMSize / 1024 / 1024)
+		diskSize := conf.DiskSize + conf.BackupDiskSize
+		for _, disk := range conf.Disks {
+			diskSize += disk.Size
+		}
+		diskMB := int(diskSize / 1024 / 1024)
+		activeMemMB := status.VMActiveMemMB
+		if current != nil {
+			activeMemMB -= int(current.RAMSize / 1024 / 1024)
+		}
+
+		if conf.CPUCount > status.HostCPUs {
+			fail("%d CPUs requested, host only has %d", conf.CPUCount, status.HostCPUs)
+		}
+		if ramMB > status.HostMemoryTotalMB {
+			fail("%d MB of RAM requested, host only has %d MB", ramMB, status.HostMemoryTotalMB)
+		} else if activeMemMB+ramMB > status.HostMemoryTotalMB {
+			log.Warningf("host memory will be overcommitted (%d MB for running VMs, %d MB total)", activeMemMB+ramMB, status.HostMemoryTotalMB)
+		}
+		if diskMB > status.FreeStorageMB {
+			log.Warningf("disks may not fit on host storage (%d MB requested, %d MB free)", diskMB, status.FreeStorageMB)
+		}
+		replace := current != nil || app.VMDB.GetCountForName(conf.Name) > 0
+		errC := app.CheckCapacity(VMConfigResources(conf, !replace), replace, log)
+		if errC != nil {
+			fail("%s", errC)
+		} else {
+			log.Successf("host capacity checked (%d CPU(s), %d MB RAM, %d MB disks)", conf.CPUCount, ramMB, diskMB)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+// VMConfigDiff returns a human readable, semantic diff between two
+// configs ("+" added, "-" removed, "~" modified). Env values are
+// never shown.
+func VMConfigDiff(old *VMConfig, new *VMConfig) []string {
+	var diff []string
+
+	scalar := func(name string, oldVal string, newVal string) {
+		if oldVal != newVal {
+			diff = append(diff, fmt.Sprintf("~ %s: %s → %s", name, oldVal, newVal))
+		}
+	}
+	size := func(val uint64) string {
+		return (datasize.ByteSize(val) * datasize.B).HR()
+	}
+
+	scalar("hostname", old.Hostname, new.Hostname)
+	scalar("timezone", old.Timezone, new.Timezone)
+	scalar("app_user", old.AppUser, new.AppUser)
+	scalar("seed", old.Seed, new.Seed)
+	scalar("init_upgrade", strconv.FormatBool(old.InitUpgrade), strconv.FormatBool(new.InitUpgrade))
+	scalar("cpu_count", strconv.Itoa(old.CPUCount), strconv.Itoa(new.CPUCount))
+	scalar("ram_size", size(old.RAMSize), size(new.RAMSize))
+	scalar("disk_size", size(old.DiskSize), size(new.DiskSize))
+	scalar("backup_disk_size", size(old.BackupDiskSize), size(new.BackupDiskSize))
+	scalar("backup_compress", strconv.FormatBool(old.BackupCompress), strconv.FormatBool(new.BackupCompress))
+	scalar("restore_backup", old.RestoreBackup, new.RestoreBackup)
+	scalar("auto_rebuild", old.AutoRebuild, new.AutoRebuild)
+	scalar("auto_rebuild_window", old.AutoRebuildWindow, new.AutoRebuildWindow)
+	scalar("auto_rebuild_skip_modified", old.AutoRebuildSkipModified.String(), new.AutoRebuildSkipModified.String())
+
+	for _, setting := range vmLimitSettings {
+		scalar(setting.Key, setting.Format(*setting.Field(&old.Limits)), setting.Format(*setting.Field(&new.Limits)))
+	}
+
+	// domains
+	oldDomains := make(map[string]string)
+	newDomains := make(map[string]string)
+	for _, domain := range old.Domains {
+		oldDomains[domain.Name] = vmConfigDiffDomain(domain.RedirectTo, domain.DestinationPort, domain.RedirectToHTTPS)
+	}
+	for _, domain := range new.Domains {
+		newDomains[domain.Name] = vmConfigDiffDomain(domain.RedirectTo, domain.DestinationPort, domain.RedirectToHTTPS)
+	}
+	diff = append(diff, vmConfigDiffMaps("domain", oldDomains, newDomains, true)...)
+
+	// ports
+	oldPorts := make(map[string]string)
+	newPorts := make(map[string]string)
+	for _, port := range old.Ports {
+		oldPorts[port.Key()] = port.String()
+	}
+	for _, port := range new.Ports {
+		newPorts[port.Key()] = port.String()
+	}
+	diff = append(diff, vmConfigDiffMaps("port", oldPorts, newPorts, true)...)
+
+	// scripts
+	steps := []struct {
+		name string
+		old  []*VMConfigScript
+		new  []*VMConfigScript
+	}{
+		{"prepare", old.Prepare, new.Prepare},
+		{"install", old.Install, new.Install},
+		{"backup", old.Backup, new.Backup},
+		{"restore", old.Restore, new.Restore},
+	}
+	for _, step := range steps {
+		oldScripts := vmConfigDiffScripts(step.old)
+		newScripts := vmConfigDiffScripts(step.new)
+		if strings.Join(oldScripts, "\n") == strings.Join(newScripts, "\n") {
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("~ %s scripts:", step.name))
+		for _, script := range oldScripts {
+			diff = append(diff, "    - "+script)
+		}
+		for _, script := range newScripts {
+			diff = append(diff, "    + "+script)
+		}
+	}
+
+	// data disks
+	oldDisks := make(map[string]string)
+	newDisks := make(map[string]string)
+	for _, disk := range old.Disks {
+		oldDisks[disk.Name] = vmConfigDiffDisk(disk)
+	}
+	for _, disk := range new.Disks {
+		newDisks[disk.Name] = vmConfigDiffDisk(disk)
+	}
+	diff = append(diff, vmConfigDiffMaps("disk", oldDisks, newDisks, true)...)
+
+	// env (masked)
+	diff = append(diff, vmConfigDiffMaps("env", old.Env, new.Env, false)...)
+
+	// do-actions (only those from config, others are kept by redefine)
+	oldActions := make(map[string]string)
+	newActions := make(map[string]string)
+	for name, action := range old.DoActions {
+		if action.FromConfig {
+			oldActions[name] = vmConfigDiffAction(action)
+		}
+	}
+	for name, action := range new.DoActions {
+		newActions[name] = vmConfigDiffAction(action)
+	}
+	diff = append(diff, vmConfigDiffMaps("do-action", oldActions, newActions, true)...)
+
+	return diff
+}
+
+func vmConfigDiffMaps(kind string, oldMap map[string]string, newMap map[string]string, showValues bool) []string {
+	var keys []string
+	for key := range oldMap {
+		keys = append(keys, key)
+	}
+	for key := range newMap {
+		if _, exists := oldMap[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, key := range keys {
+		oldVal, oldExists := oldMap[key]
+		newVal, newExists := newMap[key]
+		if !showValues {
+			oldVal = "***"
+			newVal = "***"
+		}
+		switch {
+		case !oldExists:
+			diff = append(diff, fmt.Sprintf("+ %s %s: %s", kind, key, newVal))
+		case !newExists:
+			diff = append(diff, fmt.Sprintf("- %s %s: %s", kind, key, oldVal))
+		case oldMap[key] != newMap[key]:
+			diff = append(diff, fmt.Sprintf("~ %s %s: %s → %s", kind, key, oldVal, newVal))
+		}
+	}
+	return diff
+}
+
+func vmConfigDiffDomain(redirectTo string, port int, redirectToHTTPS bool) string {
+	str := "port " + strconv.Itoa(port)
+	if redirectTo != "" {
+		str = "redirect to " + redirectTo
+	}
+	if redirectToHTTPS {
+		str += " (HTTPS redirect)"
+	}
+	return str
+}
+
+func vmConfigDiffDisk(disk *VMConfigDisk) string {
+	str := (datasize.ByteSize(disk.Size) * datasize.B).HR() + " " + disk.FS + " on " + disk.Mount
+	if disk.Persist {
+		str += " (persistent)"
+	}
+	return str
+}
+
+func vmConfigDiffScripts(scripts []*VMConfigScript) []string {
+	var res []string
+	for _, script := range scripts {
+		str := script.As + "@" + script.ScriptURL
+		if script.SHA256 != "" {
+			str += ScriptPinSeparator + script.SHA256
+		}
+		res = append(res, str)
+	}
+	return res
+}
+
+func vmConfigDiffAction(action *VMDoAction) string {
+	str := action.User + "@" + action.ScriptURL
+	if action.SHA256 != "" {
+		str += ScriptPinSeparator + action.SHA256
+	}
+	if action.Schedule != "" {
+		str += " (schedule: " + action.Schedule + ")"
+	}
+	return str
+}
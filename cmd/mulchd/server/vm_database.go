@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"sync"
 
@@ -32,22 +33,26 @@ type VMDatabaseEntry struct {
 type VMDatabase struct {
 	filename       string
 	domainFilename string
+	portFilename   string
 	db             map[string]*VMDatabaseEntry
 	maternityDB    map[string]*VMDatabaseEntry
 	mutex          sync.Mutex
 	onUpdate       updateCallback
 	config         *AppConfig
+	log            *Log
 }
 
 // NewVMDatabase instanciates a new VMDatabase
-func NewVMDatabase(filename string, domainFilename string, onUpdate updateCallback, config *AppConfig) (*VMDatabase, error) {
+func NewVMDatabase(filename string, domainFilename string, portFilename string, onUpdate updateCallback, config *AppConfig, log *Log) (*VMDatabase, error) {
 	vmdb := &VMDatabase{
 		filename:       filename,
 		domainFilename: domainFilename,
+		portFilename:   portFilename,
 		db:             make(map[string]*VMDatabaseEntry),
 		maternityDB:    make(map[string]*VMDatabaseEntry),
 		onUpdate:       onUpdate,
 		config:         config,
+		log:            log,
 	}
 
 	// if the file exists, load it
@@ -72,15 +77,38 @@ func NewVMDatabase(filename string, domainFilename string, onUpdate updateCallba
 func (vmdb *VMDatabase) genDomainsDB() error {
 	domains := make(map[string]*common.Domain)
 
+	// VMs without any active revision but in maintenance (ex: during a
+	// rebuild) still publish their domains, so the proxy can serve
+	// a maintenance page instead of a "host not found" error
+	published := make(map[string]*VMDatabaseEntry)
 	for _, entry := range vmdb.db {
-		if entry.Active == false {
+		if entry.Active == true {
+			published[entry.Name.Name] = entry
+		}
+	}
+	for _, entry := range vmdb.db {
+		if entry.Active == true || entry.VM.Maintenance == false {
+			continue
+		}
+		other, exists := published[entry.Name.Name]
+		if exists && (other.Active || other.Name.Revision > entry.Name.Revision) {
 			continue
 		}
+		published[entry.Name.Name] = entry
+	}
+
+	for _, entry := range published {
 		vm := entry.VM
 		for _, domain := range vm.Config.Domains {
 			domain.VMName = entry.Name.ID()
+			domain.VMBaseName = entry.Name.Name
+			domain.Maintenance = vm.Maintenance
+			domain.Canaries = nil
 			if domain.RedirectTo == "" {
-				domain.DestinationHost = vm.LastIP
+				domain.DestinationHost = vmdb.upstreamHost(vm)
+				if entry.Active == true {
+					domain.Canaries = vmdb.getDomainCanaries(entry.Name.Name, domain.Name)
+				}
 			}
 
 			otherDomain, exist := domains[domain.Name]
@@ -107,6 +135,92 @@ func (vmdb *VMDatabase) genDomainsDB() error {
 	return nil
 }
 
+// build published ports database, for active revisions only (so ports
+// follow the active revision during rebuilds)
+func (vmdb *VMDatabase) genPortsDB() error {
+	ports := make(map[string]*common.Port)
+
+	// stable order, so the same VM keeps a duplicated port
+	var ids []string
+	for id := range vmdb.db {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		entry := vmdb.db[id]
+		if entry.Active == false {
+			continue
+		}
+
+		for _, port := range entry.VM.Config.Ports {
+			otherPort, exist := ports[port.Key()]
+			if exist == true {
+				// should be prevented by CheckPortsConflicts, don't
+				// break the whole database because of one VM
+				vmdb.log.Errorf("port %s is duplicated in '%s' and '%s' VMs, ignored for '%s'", port.Key(), otherPort.VMName, entry.Name.ID(), entry.Name.ID())
+				continue
+			}
+
+			port.VMName = entry.Name.ID()
+			port.DestinationHost = vmdb.upstreamHost(entry.VM)
+			ports[port.Key()] = port
+		}
+	}
+
+	f, err := os.OpenFile(vmdb.portFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&ports)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// address used by mulch-proxy to reach the VM (IPv6, if available and
+// enabled with proxy_upstream_ipv6)
+func (vmdb *VMDatabase) upstreamHost(vm *VM) string {
+	if vmdb.config.ProxyUpstreamIPv6 && vm.AssignedIPv6 != "" {
+		return vm.AssignedIPv6
+	}
+	return vm.LastIP
+}
+
+// list inactive revisions of VM name receiving a part of domainName
+// traffic (mutex must be locked)
+func (vmdb *VMDatabase) getDomainCanaries(name string, domainName string) []*common.DomainCanary {
+	var canaries []*common.DomainCanary
+
+	for _, entry := range vmdb.db {
+		if entry.Name.Name != name || entry.Active == true || entry.VM.CanaryWeight == 0 {
+			continue
+		}
+		// don't send a share of the traffic to a maintenance page
+		if entry.VM.Maintenance == true {
+			continue
+		}
+		for _, domain := range entry.VM.Config.Domains {
+			if domain.Name != domainName || domain.RedirectTo != "" {
+				continue
+			}
+			canaries = append(canaries, &common.DomainCanary{
+				VMName:          entry.Name.ID(),
+				DestinationHost: vmdb.upstreamHost(entry.VM),
+				DestinationPort: domain.DestinationPort,
+				Weight:          entry.VM.CanaryWeight,
+			})
+		}
+	}
+
+	return canaries
+}
+
 // This is done internaly, because it must be done with the mutex locked,
 // but we can't lock it here, since save() is called by functions that
 // are already locking the mutex.
@@ -128,6 +242,11 @@ func (vmdb *VMDatabase) save() error {
 		return err
 	}
 
+	err = vmdb.genPortsDB()
+	if err != nil {
+		return err
+	}
+
 	if vmdb.onUpdate != nil {
 		vmdb.onUpdate()
 	}
@@ -225,6 +344,10 @@ func (vmdb *VMDatabase) Add(vm *VM, name *VMName, active bool) error {
 		if err != nil {
 			return err
 		}
+		err = CheckPortsConflicts(vmdb, vm.Config.Ports, name.Name, vmdb.config)
+		if err != nil {
+			return err
+		}
 	}
 
 	vmdb.mutex.Lock()
@@ -309,6 +432,18 @@ func (vmdb *VMDatabase) GetNames() []*VMName {
 	return names
 }
 
+// GetMaternityEntries returns VMs currently being created
+func (vmdb *VMDatabase) GetMaternityEntries() []*VMDatabaseEntry {
+	vmdb.mutex.Lock()
+	defer vmdb.mutex.Unlock()
+
+	entries := make([]*VMDatabaseEntry, 0, len(vmdb.maternityDB))
+	for _, entry := range vmdb.maternityDB {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
 // GetEntryByName lookups a VMDatabaseEntry entry by its name
 func (vmdb *VMDatabase) GetEntryByName(name *VMName) (*VMDatabaseEntry, error) {
 	vmdb.mutex.Lock()
@@ -495,6 +630,53 @@ func (vmdb *VMDatabase) GetCountForName(name string) int {
 	return count
 }
 
+// SetCanaryWeight will send weight % of the active revision traffic
+// to this (inactive) revision, 0 disables this canary
+func (vmdb *VMDatabase) SetCanaryWeight(name *VMName, weight int) error {
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("invalid weight %d (must be between 0 and 100)", weight)
+	}
+
+	vmdb.mutex.Lock()
+	defer vmdb.mutex.Unlock()
+
+	target, exists := vmdb.db[name.ID()]
+	if !exists {
+		return fmt.Errorf("VM %s not found in database", name)
+	}
+
+	if target.Active == true {
+		return fmt.Errorf("VM %s is the active revision, it can't be a canary", name)
+	}
+
+	total := weight
+	for _, entry := range vmdb.db {
+		if entry.Name.Name == name.Name && entry != target {
+			total += entry.VM.CanaryWeight
+		}
+	}
+	if total >= 100 {
+		return fmt.Errorf("total canary weight for '%s' must be lower than 100 (%d)", name.Name, total)
+	}
+
+	target.VM.CanaryWeight = weight
+	return vmdb.save()
+}
+
+// SetMaintenance enables or disables maintenance mode for a VM
+func (vmdb *VMDatabase) SetMaintenance(name *VMName, enabled bool) error {
+	vmdb.mutex.Lock()
+	defer vmdb.mutex.Unlock()
+
+	entry, exists := vmdb.db[name.ID()]
+	if !exists {
+		return fmt.Errorf("VM %s not found in database", name)
+	}
+
+	entry.VM.Maintenance = enabled
+	return vmdb.save()
+}
+
 // SetActiveRevision change the active instance (RevisionNone is allowed)
 func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 	// sanity checks (out of lock!)
@@ -512,6 +694,10 @@ func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 		if err != nil {
 			return err
 		}
+		err = CheckPortsConflicts(vmdb, vm.Config.Ports, name, vmdb.config)
+		if err != nil {
+			return err
+		}
 	}
 
 	vmdb.mutex.Lock()
@@ -521,6 +707,8 @@ func (vmdb *VMDatabase) SetActiveRevision(name string, revision int) error {
 		if entry.Name.Name == name {
 			if entry.Name.Revision == revision {
 				entry.Active = true
+				// promoted canary
+				entry.VM.CanaryWeight = 0
 			} else {
 				entry.Active = false
 			}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+)
+
+// VMStorageAliasDataPrefix is the alias prefix of additional data disks
+const VMStorageAliasDataPrefix = "ua-mulch-data-"
+
+// VMDisksMax is the maximum number of additional data disks
+// (vda is the system disk, vdb is the backup disk)
+const VMDisksMax = 20
+
+// supported data disk filesystems
+var vmDiskFilesystems = map[string]bool{
+	"ext4": true,
+	"xfs":  true,
+}
+
+// small helper to generate data disk volume name
+func vmGenDataDiskName(vmName *VMName, disk *VMConfigDisk) string {
+	if disk.Persist {
+		return vmName.Name + "-persist-" + disk.Name + ".qcow2"
+	}
+	return vmName.ID() + "-data-" + disk.Name + ".qcow2"
+}
+
+// device name as seen by the guest (from disk serial)
+func vmDataDiskDevice(disk *VMConfigDisk) string {
+	return "/dev/disk/by-id/virtio-" + disk.Name
+}
+
+// vmHasPersistentDisks returns true if any data disk is persistent
+func vmHasPersistentDisks(config *VMConfig) bool {
+	for _, disk := range config.Disks {
+		if disk.Persist {
+			return true
+		}
+	}
+	return false
+}
+
+// creates data disks volumes, and returns the names of the newly created
+// ones (existing persistent volumes are reused)
+func vmCreateDataDisks(vmName *VMName, config *VMConfig, app *App, log *Log) ([]string, error) {
+	var created []string
+
+	app.Libvirt.Pools.Disks.Refresh(0)
+
+	for _, disk := range config.Disks {
+		volName := vmGenDataDiskName(vmName, disk)
+
+		if disk.Persist {
+			infos, err := app.Libvirt.VolumeInfos(volName, app.Libvirt.Pools.Disks)
+			if err == nil {
+				log.Infof("re-using persistent disk '%s'", volName)
+				if disk.Size > infos.Capacity {
+					err = app.Libvirt.ResizeDisk(volName, disk.Size, app.Libvirt.Pools.Disks, log)
+					if err != nil {
+						vmDeleteDataDisks(created, app, log)
+						return nil, err
+					}
+					log.Warningf("disk '%s' was enlarged, filesystem on %s must be grown by hand", disk.Name, disk.Mount)
+				}
+				continue
+			}
+		}
+
+		log.Infof("creating data disk '%s'", volName)
+		err := app.Libvirt.UploadFileToLibvirt(
+			app.Libvirt.Pools.Disks,
+			app.Libvirt.Pools.DisksXML,
+			path.Clean(app.Config.GetTemplateFilepath("volume.xml")),
+			path.Clean(app.Config.GetTemplateFilepath("empty.qcow2")),
+			volName,
+			log)
+		if err != nil {
+			vmDeleteDataDisks(created, app, log)
+			return nil, err
+		}
+		created = append(created, volName)
+
+		err = app.Libvirt.ResizeDisk(volName, disk.Size, app.Libvirt.Pools.Disks, log)
+		if err != nil {
+			vmDeleteDataDisks(created, app, log)
+			return nil, err
+		}
+	}
+	return created, nil
+}
+
+func vmDeleteDataDisks(volNames []string, app *App, log *Log) {
+	for _, volName := range volNames {
+		log.Infof("deleting data disk '%s'", volName)
+		err := app.Libvirt.DeleteVolume(volName, app.Libvirt.Pools.Disks)
+		if err != nil {
+			log.Errorf("unable to delete data disk '%s': %s", volName, err)
+		}
+	}
+}
+
+// returns domain XML disk definitions for data disks
+func vmDataDisksXML(vmName *VMName, config *VMConfig, app *App) ([]libvirtxml.DomainDisk, error) {
+	var disks []libvirtxml.DomainDisk
+
+	if len(config.Disks) == 0 {
+		return disks, nil
+	}
+
+	xml, err := ioutil.ReadFile(app.Config.GetTemplateFilepath("disk.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	for index, disk := range config.Disks {
+		diskcfg := libvirtxml.DomainDisk{}
+		err = diskcfg.Unmarshal(string(xml))
+		if err != nil {
+			return nil, err
+		}
+		diskcfg.Alias.Name = VMStorageAliasDataPrefix + disk.Name
+		diskcfg.Source.File.File = app.Libvirt.Pools.DisksXML.Target.Path + "/" + vmGenDataDiskName(vmName, disk)
+		diskcfg.Target.Dev = "vd" + string(rune('c'+index))
+		diskcfg.Serial = disk.Name
+		disks = append(disks, diskcfg)
+	}
+	return disks, nil
+}
+
+// cloud-init fs_setup and mounts for data disks (existing filesystems
+// of persistent disks are never overwritten)
+func cloudInitDataDisks(config *VMConfig) string {
+	if len(config.Disks) == 0 {
+		return ""
+	}
+
+	var setup, mounts strings.Builder
+	setup.WriteString("fs_setup:\n")
+	mounts.WriteString("mounts:\n")
+	for _, disk := range config.Disks {
+		device := vmDataDiskDevice(disk)
+		fmt.Fprintf(&setup, "  - label: %s\n", disk.Name)
+		fmt.Fprintf(&setup, "    filesystem: %s\n", disk.FS)
+		fmt.Fprintf(&setup, "    device: %s\n", device)
+		fmt.Fprintf(&setup, "    partition: none\n")
+		fmt.Fprintf(&setup, "    overwrite: false\n")
+		fmt.Fprintf(&mounts, "  - [ %s, %s, %s, \"defaults,nofail\", \"0\", \"2\" ]\n", device, disk.Mount, disk.FS)
+	}
+	return setup.String() + mounts.String()
+}
+
+// deletes data disks of a (deleted) VM, but persistent disks are kept if
+// another revision of the VM still use them
+func vmDeleteDomainDataDisks(vmName *VMName, domcfg *libvirtxml.Domain, app *App, log *Log) error {
+	inUse := make(map[string]bool)
+	for _, otherName := range app.VMDB.GetNames() {
+		if otherName.Name != vmName.Name || otherName.Revision == vmName.Revision {
+			continue
+		}
+		other, err := app.VMDB.GetByName(otherName)
+		if err != nil {
+			return err
+		}
+		for _, disk := range other.Config.Disks {
+			inUse[vmGenDataDiskName(otherName, disk)] = true
+		}
+	}
+
+	var volNames []string
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Alias == nil || !strings.HasPrefix(disk.Alias.Name, VMStorageAliasDataPrefix) {
+			continue
+		}
+		volName := path.Base(disk.Source.File.File)
+		if inUse[volName] {
+			log.Infof("keeping persistent disk '%s' (used by another revision)", volName)
+			continue
+		}
+		volNames = append(volNames, volName)
+	}
+
+	vmDeleteDataDisks(volNames, app, log)
+	return nil
+}
+
+func vmConfigGetDisk(tDisk *tomlVMDisk) (*VMConfigDisk, error) {
+	disk := &VMConfigDisk{
+		Name:    tDisk.Name,
+		Size:    tDisk.Size.Bytes(),
+		Mount:   path.Clean(tDisk.Mount),
+		FS:      tDisk.Filesystem,
+		Persist: tDisk.PersistAcrossRebuild,
+	}
+
+	// virtio disk serials are limited to 20 chars
+	if disk.Name == "" || !IsValidName(disk.Name) || len(disk.Name) > 20 {
+		return nil, fmt.Errorf("invalid disk name '%s' (20 chars max)", disk.Name)
+	}
+	if tDisk.Size < 32*datasize.MB {
+		return nil, fmt.Errorf("disk '%s': looks like a too small disk (%s)", disk.Name, tDisk.Size)
+	}
+	if !path.IsAbs(tDisk.Mount) || disk.Mount == "/" {
+		return nil, fmt.Errorf("disk '%s': invalid mount point '%s'", disk.Name, tDisk.Mount)
+	}
+	if disk.FS == "" {
+		disk.FS = "ext4"
+	}
+	if !vmDiskFilesystems[disk.FS] {
+		return nil, fmt.Errorf("disk '%s': unsupported filesystem '%s'", disk.Name, disk.FS)
+	}
+
+	return disk, nil
+}
+
+// vmCheckPersistentDisksFree ensures that no other running revision of the
+// VM is using its persistent disks (they can't be shared by running VMs)
+func vmCheckPersistentDisksFree(vmName *VMName, config *VMConfig, app *App) error {
+	if !vmHasPersistentDisks(config) {
+		return nil
+	}
+
+	for _, otherName := range app.VMDB.GetNames() {
+		if otherName.Name != vmName.Name || otherName.Revision == vmName.Revision {
+			continue
+		}
+		running, _ := VMIsRunning(otherName, app)
+		if running {
+			return fmt.Errorf("persistent disks are in use by %s, stop it first", otherName)
+		}
+	}
+	return nil
+}
+
+// renames data disks volumes of a VM (and update its domain config)
+func vmRenameDataDisks(orgVMName *VMName, newVMName *VMName, config *VMConfig, domcfg *libvirtxml.Domain, app *App, log *Log) error {
+	if vmHasPersistentDisks(config) && app.VMDB.GetCountForName(orgVMName.Name) > 1 && orgVMName.Name != newVMName.Name {
+		return fmt.Errorf("VM %s has persistent disks shared with other revisions", orgVMName)
+	}
+
+	pool := app.Libvirt.Pools.Disks
+	poolXML := app.Libvirt.Pools.DisksXML
+	template := app.Config.GetTemplateFilepath("volume.xml")
+
+	for _, disk := range config.Disks {
+		for index, domDisk := range domcfg.Devices.Disks {
+			if domDisk.Alias == nil || domDisk.Alias.Name != VMStorageAliasDataPrefix+disk.Name {
+				continue
+			}
+
+			volName := path.Base(domDisk.Source.File.File)
+			newVolName := vmGenDataDiskName(newVMName, disk)
+			if volName == newVolName {
+				continue
+			}
+
+			log.Infof("cloning volume '%s'", volName)
+			err := app.Libvirt.CloneVolume(volName, pool, newVolName, pool, poolXML, template, log)
+			if err != nil {
+				return err
+			}
+			err = app.Libvirt.DeleteVolume(volName, pool)
+			if err != nil {
+				return err
+			}
+
+			dir := path.Dir(domDisk.Source.File.File)
+			domcfg.Devices.Disks[index].Source.File.File = path.Clean(dir + "/" + newVolName)
+		}
+	}
+	return nil
+}
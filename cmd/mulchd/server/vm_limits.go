@@ -0,0 +1,384 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+	"gopkg.in/libvirt/libvirt-go.v5"
+)
+
+// vmCPUPeriod is the CFS period used for cpu_quota (µs)
+const vmCPUPeriod = 100000
+
+// VMLimits are optional resource limits of a VM (zero = unlimited)
+type VMLimits struct {
+	CPUShares         uint64 // relative weight (libvirt default is 1024)
+	CPUQuota          uint64 // % of each vCPU
+	DiskReadBytesSec  uint64
+	DiskWriteBytesSec uint64
+	DiskReadIOPSSec   uint64
+	DiskWriteIOPSSec  uint64
+	NetInboundSec     uint64 // bytes per second
+	NetOutboundSec    uint64 // bytes per second
+}
+
+// vmLimitSetting links a VM config setting to a VMLimits field
+type vmLimitSetting struct {
+	Key   string
+	Size  bool // datasize value (ex: "10MB")
+	Group string
+	Field func(limits *VMLimits) *uint64
+}
+
+// vmLimitSettings lists VM limits settings (VM config and 'vm tune')
+var vmLimitSettings = []vmLimitSetting{
+	{"cpu_shares", false, "cpu", func(l *VMLimits) *uint64 { return &l.CPUShares }},
+	{"cpu_quota", false, "cpu", func(l *VMLimits) *uint64 { return &l.CPUQuota }},
+	{"disk_read_bytes_sec", true, "disk", func(l *VMLimits) *uint64 { return &l.DiskReadBytesSec }},
+	{"disk_write_bytes_sec", true, "disk", func(l *VMLimits) *uint64 { return &l.DiskWriteBytesSec }},
+	{"disk_read_iops_sec", false, "disk", func(l *VMLimits) *uint64 { return &l.DiskReadIOPSSec }},
+	{"disk_write_iops_sec", false, "disk", func(l *VMLimits) *uint64 { return &l.DiskWriteIOPSSec }},
+	{"net_inbound_sec", true, "net", func(l *VMLimits) *uint64 { return &l.NetInboundSec }},
+	{"net_outbound_sec", true, "net", func(l *VMLimits) *uint64 { return &l.NetOutboundSec }},
+}
+
+// Parse a setting value ("0" = unlimited)
+func (setting *vmLimitSetting) Parse(value string) (uint64, error) {
+	if setting.Size {
+		var size datasize.ByteSize
+		err := size.UnmarshalText([]byte(value))
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid size '%s'", setting.Key, value)
+		}
+		return size.Bytes(), nil
+	}
+	val, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid value '%s'", setting.Key, value)
+	}
+	return val, nil
+}
+
+// Format a setting value (TOML)
+func (setting *vmLimitSetting) Format(value uint64) string {
+	if setting.Size && value != 0 {
+		return strconv.Quote((datasize.ByteSize(value) * datasize.B).String())
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// Check returns an error if limits are invalid
+func (limits *VMLimits) Check() error {
+	if limits.CPUShares != 0 && (limits.CPUShares < 2 || limits.CPUShares > 262144) {
+		return fmt.Errorf("cpu_shares must be between 2 and 262144")
+	}
+	if limits.CPUQuota > 100 {
+		return fmt.Errorf("cpu_quota is a percentage of each vCPU (1-100)")
+	}
+	return nil
+}
+
+// Strings returns non-zero limits as "key=value" strings
+func (limits *VMLimits) Strings() []string {
+	var res []string
+	for _, setting := range vmLimitSettings {
+		val := *setting.Field(limits)
+		if val == 0 {
+			continue
+		}
+		str := strconv.FormatUint(val, 10)
+		if setting.Size {
+			str = (datasize.ByteSize(val) * datasize.B).HR()
+		}
+		if setting.Key == "cpu_quota" {
+			str += "%"
+		}
+		res = append(res, setting.Key+"="+str)
+	}
+	return res
+}
+
+func vmLimitsIOTune(limits *VMLimits) *libvirtxml.DomainDiskIOTune {
+	if limits.DiskReadBytesSec == 0 && limits.DiskWriteBytesSec == 0 &&
+		limits.DiskReadIOPSSec == 0 && limits.DiskWriteIOPSSec == 0 {
+		return nil
+	}
+	return &libvirtxml.DomainDiskIOTune{
+		ReadBytesSec:  limits.DiskReadBytesSec,
+		WriteBytesSec: limits.DiskWriteBytesSec,
+		ReadIopsSec:   limits.DiskReadIOPSSec,
+		WriteIopsSec:  limits.DiskWriteIOPSSec,
+	}
+}
+
+// libvirt bandwidth unit is KiB/s, and 0 means unlimited, so a
+// (non-zero) limit below 1 KiB/s is rounded up
+func vmLimitsBandwidthKiB(bytesSec uint64) uint {
+	if bytesSec == 0 {
+		return 0
+	}
+	kib := uint(bytesSec / 1024)
+	if kib == 0 {
+		kib = 1
+	}
+	return kib
+}
+
+func vmLimitsBandwidthParams(bytesSec uint64) *libvirtxml.DomainInterfaceBandwidthParams {
+	if bytesSec == 0 {
+		return nil
+	}
+	average := int(vmLimitsBandwidthKiB(bytesSec))
+	return &libvirtxml.DomainInterfaceBandwidthParams{Average: &average}
+}
+
+// is this disk limited (system and data disks, not backup)
+func vmLimitsDisk(disk *libvirtxml.DomainDisk) bool {
+	if disk.Alias == nil {
+		return false
+	}
+	return disk.Alias.Name == VMStorageAliasDisk || strings.HasPrefix(disk.Alias.Name, VMStorageAliasDataPrefix)
+}
+
+// vmLimitsXML applies limits to a new domain
+func vmLimitsXML(domcfg *libvirtxml.Domain, limits *VMLimits) {
+	if limits.CPUShares != 0 || limits.CPUQuota != 0 {
+		if domcfg.CPUTune == nil {
+			domcfg.CPUTune = &libvirtxml.DomainCPUTune{}
+		}
+		if limits.CPUShares != 0 {
+			domcfg.CPUTune.Shares = &libvirtxml.DomainCPUTuneShares{Value: uint(limits.CPUShares)}
+		}
+		if limits.CPUQuota != 0 {
+			domcfg.CPUTune.Period = &libvirtxml.DomainCPUTunePeriod{Value: vmCPUPeriod}
+			domcfg.CPUTune.Quota = &libvirtxml.DomainCPUTuneQuota{Value: int64(limits.CPUQuota * vmCPUPeriod / 100)}
+		}
+	}
+
+	for index, disk := range domcfg.Devices.Disks {
+		if vmLimitsDisk(&disk) {
+			domcfg.Devices.Disks[index].IOTune = vmLimitsIOTune(limits)
+		}
+	}
+
+	inbound := vmLimitsBandwidthParams(limits.NetInboundSec)
+	outbound := vmLimitsBandwidthParams(limits.NetOutboundSec)
+	for index, intf := range domcfg.Devices.Interfaces {
+		if intf.Alias == nil || intf.Alias.Name != VMNetworkAliasBridge {
+			continue
+		}
+		if inbound == nil && outbound == nil {
+			domcfg.Devices.Interfaces[index].Bandwidth = nil
+			continue
+		}
+		domcfg.Devices.Interfaces[index].Bandwidth = &libvirtxml.DomainInterfaceBandwidth{
+			Inbound:  inbound,
+			Outbound: outbound,
+		}
+	}
+}
+
+// VMGetLimits returns effective limits of a VM (from libvirt)
+func VMGetLimits(vmName *VMName, app *App) (*VMLimits, error) {
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return nil, err
+	}
+	if domain == nil {
+		return nil, fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+	defer domain.Free()
+
+	xmldoc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := &VMLimits{}
+	if domcfg.CPUTune != nil {
+		// default shares value is not a limit
+		if domcfg.CPUTune.Shares != nil && domcfg.CPUTune.Shares.Value != 1024 {
+			limits.CPUShares = uint64(domcfg.CPUTune.Shares.Value)
+		}
+		if domcfg.CPUTune.Period != nil && domcfg.CPUTune.Quota != nil &&
+			domcfg.CPUTune.Period.Value > 0 && domcfg.CPUTune.Quota.Value > 0 {
+			limits.CPUQuota = uint64(domcfg.CPUTune.Quota.Value) * 100 / domcfg.CPUTune.Period.Value
+		}
+	}
+
+	for _, disk := range domcfg.Devices.Disks {
+		if disk.Alias != nil && disk.Alias.Name == VMStorageAliasDisk && disk.IOTune != nil {
+			limits.DiskReadBytesSec = disk.IOTune.ReadBytesSec
+			limits.DiskWriteBytesSec = disk.IOTune.WriteBytesSec
+			limits.DiskReadIOPSSec = disk.IOTune.ReadIopsSec
+			limits.DiskWriteIOPSSec = disk.IOTune.WriteIopsSec
+		}
+	}
+
+	for _, intf := range domcfg.Devices.Interfaces {
+		if intf.Alias == nil || intf.Alias.Name != VMNetworkAliasBridge || intf.Bandwidth == nil {
+			continue
+		}
+		if intf.Bandwidth.Inbound != nil && intf.Bandwidth.Inbound.Average != nil {
+			limits.NetInboundSec = uint64(*intf.Bandwidth.Inbound.Average) * 1024
+		}
+		if intf.Bandwidth.Outbound != nil && intf.Bandwidth.Outbound.Average != nil {
+			limits.NetOutboundSec = uint64(*intf.Bandwidth.Outbound.Average) * 1024
+		}
+	}
+
+	return limits, nil
+}
+
+// VMTune changes limits of a VM (settings are VM config keys, see
+// vmLimitSettings), live if the VM is running. The VM config file is
+// updated too, so the next rebuild is consistent.
+func VMTune(vmName *VMName, settings map[string]string, authorKey string, app *App, log *Log) error {
+	vm, err := app.VMDB.GetByName(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.WIP != VMOperationNone {
+		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	limits := vm.Config.Limits
+	groups := make(map[string]bool)
+	changed := make(map[string]string)
+
+	for _, setting := range vmLimitSettings {
+		str, exists := settings[setting.Key]
+		if !exists {
+			continue
+		}
+		val, errP := setting.Parse(str)
+		if errP != nil {
+			return errP
+		}
+		*setting.Field(&limits) = val
+		groups[setting.Group] = true
+		changed[setting.Key] = setting.Format(val)
+	}
+
+	for key := range settings {
+		if _, known := changed[key]; !known {
+			return fmt.Errorf("unknown limit '%s'", key)
+		}
+	}
+
+	if len(changed) == 0 {
+		return fmt.Errorf("nothing to tune")
+	}
+
+	err = limits.Check()
+	if err != nil {
+		return err
+	}
+
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if domain == nil {
+		return fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+	defer domain.Free()
+
+	running, _ := VMIsRunning(vmName, app)
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	if running {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+
+	if groups["cpu"] {
+		shares := limits.CPUShares
+		if shares == 0 {
+			shares = 1024
+		}
+		quota := int64(-1)
+		if limits.CPUQuota != 0 {
+			quota = int64(limits.CPUQuota * vmCPUPeriod / 100)
+		}
+		err = domain.SetSchedulerParametersFlags(&libvirt.DomainSchedulerParameters{
+			CpuSharesSet:  true,
+			CpuShares:     shares,
+			VcpuPeriodSet: true,
+			VcpuPeriod:    vmCPUPeriod,
+			VcpuQuotaSet:  true,
+			VcpuQuota:     quota,
+		}, flags)
+		if err != nil {
+			return fmt.Errorf("CPU tuning: %s", err)
+		}
+		log.Info("CPU limits applied")
+	}
+
+	if groups["disk"] {
+		xmldoc, errX := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		if errX != nil {
+			return errX
+		}
+		domcfg := &libvirtxml.Domain{}
+		err = domcfg.Unmarshal(xmldoc)
+		if err != nil {
+			return err
+		}
+
+		for _, disk := range domcfg.Devices.Disks {
+			if !vmLimitsDisk(&disk) {
+				continue
+			}
+			err = domain.SetBlockIoTune(disk.Target.Dev, &libvirt.DomainBlockIoTuneParameters{
+				ReadBytesSecSet:  true,
+				ReadBytesSec:     limits.DiskReadBytesSec,
+				WriteBytesSecSet: true,
+				WriteBytesSec:    limits.DiskWriteBytesSec,
+				ReadIopsSecSet:   true,
+				ReadIopsSec:      limits.DiskReadIOPSSec,
+				WriteIopsSecSet:  true,
+				WriteIopsSec:     limits.DiskWriteIOPSSec,
+			}, flags)
+			if err != nil {
+				return fmt.Errorf("disk tuning (%s): %s", disk.Target.Dev, err)
+			}
+		}
+		log.Info("disk limits applied")
+	}
+
+	if groups["net"] {
+		err = domain.SetInterfaceParameters(vm.AssignedMAC, &libvirt.DomainInterfaceParameters{
+			BandwidthInAverageSet:  true,
+			BandwidthInAverage:     vmLimitsBandwidthKiB(limits.NetInboundSec),
+			BandwidthOutAverageSet: true,
+			BandwidthOutAverage:    vmLimitsBandwidthKiB(limits.NetOutboundSec),
+		}, flags)
+		if err != nil {
+			return fmt.Errorf("network tuning: %s", err)
+		}
+		log.Info("network limits applied")
+	}
+
+	vm.Config.Limits = limits
+	for key, value := range changed {
+		vm.Config.setSetting(key, value)
+	}
+	vm.LastConfigUpdate = time.Now()
+
+	vm.Config.Version, err = app.ConfigHistory.Add(vm.Config.Name, vm.Config, authorKey, "tune")
+	if err != nil {
+		log.Errorf("unable to save config history: %s", err)
+	}
+
+	return app.VMDB.Update()
+}
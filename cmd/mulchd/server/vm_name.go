@@ -3,8 +3,14 @@ package server
 import (
 	"fmt"
 	"strconv"
+	"strings"
 )
 
+// ProjectVMSeparator separates project and VM names in the name of
+// project VMs (ex: "customer_x.website"), so VM names are unique per
+// project. VM and project names can't contain this character.
+const ProjectVMSeparator = "."
+
 // VMName hosts what makes a VM unique: a name and a revision
 type VMName struct {
 	Name     string
@@ -35,3 +41,31 @@ func (name *VMName) LibvirtDomainName(app *App) string {
 func (name *VMName) String() string {
 	return fmt.Sprintf("'%s' (rev %d)", name.Name, name.Revision)
 }
+
+// ProjectVMName returns the (unique) name of VM 'name' of a project
+func ProjectVMName(project string, name string) string {
+	if project == "" {
+		return name
+	}
+	return project + ProjectVMSeparator + name
+}
+
+// SplitProjectVMName returns the project and the VM name of a project
+// VM name (empty project for VMs without project)
+func SplitProjectVMName(name string) (string, string) {
+	parts := strings.SplitN(name, ProjectVMSeparator, 2)
+	if len(parts) != 2 {
+		return "", name
+	}
+	return parts[0], parts[1]
+}
+
+// IsValidVMName returns true if name is a valid VM name, with or without
+// project
+func IsValidVMName(name string) bool {
+	project, vmName := SplitProjectVMName(name)
+	if strings.Contains(name, ProjectVMSeparator) && project == "" {
+		return false
+	}
+	return vmName != "" && IsValidName(project) && IsValidName(vmName)
+}
@@ -0,0 +1,76 @@
+package server
+
+import "testing"
+
+func TestProjectVMName(t *testing.T) {
+	tests := []struct {
+		project string
+		name    string
+		want    string
+	}{
+		{"", "website", "website"},
+		{"customer_x", "website", "customer_x.website"},
+	}
+
+	for _, test := range tests {
+		got := ProjectVMName(test.project, test.name)
+		if got != test.want {
+			t.Errorf("'%s'/'%s': got '%s', want '%s'", test.project, test.name, got, test.want)
+		}
+
+		// round trip
+		project, name := SplitProjectVMName(got)
+		if project != test.project || name != test.name {
+			t.Errorf("'%s': split to '%s'/'%s'", got, project, name)
+		}
+	}
+}
+
+func TestSplitProjectVMName(t *testing.T) {
+	tests := []struct {
+		str     string
+		project string
+		name    string
+	}{
+		{"website", "", "website"},
+		{"customer_x.website", "customer_x", "website"},
+		{"a.b.c", "a", "b.c"},
+		{".website", "", "website"},
+		{"customer_x.", "customer_x", ""},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		project, name := SplitProjectVMName(test.str)
+		if project != test.project || name != test.name {
+			t.Errorf("'%s': got '%s'/'%s', want '%s'/'%s'", test.str, project, name, test.project, test.name)
+		}
+	}
+}
+
+func TestIsValidVMName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"website", true},
+		{"web_site2", true},
+		{"customer_x.website", true},
+		{"", false},
+		{".", false},
+		{".website", false},
+		{"customer_x.", false},
+		{"a.b.c", false},
+		{"customer_x..website", false},
+		{"web-site", false},
+		{"customer-x.website", false},
+		{"web site", false},
+		{"customer_x.web/site", false},
+	}
+
+	for _, test := range tests {
+		if got := IsValidVMName(test.name); got != test.want {
+			t.Errorf("'%s': got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
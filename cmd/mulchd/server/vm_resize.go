@@ -0,0 +1,309 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/crypto/ssh"
+	libvirtxml "gopkg.in/libvirt/libvirt-go-xml.v5"
+	"gopkg.in/libvirt/libvirt-go.v5"
+)
+
+// VMResize changes vCPU count, RAM size and system disk size of a VM
+// (zero = unchanged). Changes are applied live when possible (vCPU
+// hotplug, balloon, block resize + in-guest growpart), in the domain
+// config otherwise (applied on next VM start). The VM config file is
+// updated too, so the next rebuild is consistent.
+func VMResize(vmName *VMName, cpuCount int, ramSize uint64, diskSize uint64, authorKey string, app *App, log *Log) error {
+	vm, err := app.VMDB.GetByName(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.WIP != VMOperationNone {
+		return fmt.Errorf("VM have a work in progress (%s)", string(vm.WIP))
+	}
+
+	if diskSize != 0 && diskSize < vm.Config.DiskSize {
+		return fmt.Errorf("disk can't be shrunk (current size: %s)", (datasize.ByteSize(vm.Config.DiskSize) * datasize.B).HR())
+	}
+	if ramSize != 0 && ramSize < 32*1024*1024 {
+		return errors.New("looks like a too small RAM amount")
+	}
+	if cpuCount < 0 {
+		return errors.New("invalid CPU count")
+	}
+
+	// CPU and RAM of a stopped VM will be checked on start
+	running, _ := VMIsRunning(vmName, app)
+	extra := &VMResources{}
+	if running && cpuCount > vm.Config.CPUCount {
+		extra.CPUs = cpuCount - vm.Config.CPUCount
+	}
+	if running && ramSize > vm.Config.RAMSize {
+		extra.RAMMB = int((ramSize - vm.Config.RAMSize) / 1024 / 1024)
+	}
+	if diskSize > vm.Config.DiskSize {
+		extra.DiskMB = int((diskSize - vm.Config.DiskSize) / 1024 / 1024)
+	}
+	err = app.CheckCapacity(extra, false, log)
+	if err != nil {
+		return err
+	}
+
+	// quotas are charged to the VM owner, running or not
+	quotaExtra := &VMResources{DiskMB: extra.DiskMB}
+	if cpuCount > vm.Config.CPUCount {
+		quotaExtra.CPUs = cpuCount - vm.Config.CPUCount
+	}
+	if ramSize > vm.Config.RAMSize {
+		quotaExtra.RAMMB = int((ramSize - vm.Config.RAMSize) / 1024 / 1024)
+	}
+	err = app.CheckQuota(vm.Owner(), quotaExtra, 0)
+	if err != nil {
+		return err
+	}
+
+	vm.SetOperation(VMOperationResize)
+	defer vm.SetOperation(VMOperationNone)
+
+	domain, err := app.Libvirt.GetDomainByName(vmName.LibvirtDomainName(app))
+	if err != nil {
+		return err
+	}
+	if domain == nil {
+		return fmt.Errorf("VM %s: does not exists in libvirt", vmName)
+	}
+	defer domain.Free()
+
+	xmldoc, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+
+	domcfg := &libvirtxml.Domain{}
+	err = domcfg.Unmarshal(xmldoc)
+	if err != nil {
+		return err
+	}
+
+	// libvirt always reports memory using KiB
+	if domcfg.Memory.Unit != "KiB" {
+		return fmt.Errorf("unexpected memory unit '%s'", domcfg.Memory.Unit)
+	}
+	maxRAM := uint64(domcfg.Memory.Value) * 1024
+	maxCPU := domcfg.VCPU.Value
+
+	restartNeeded := false
+	guestUpdate := false
+	settings := make(map[string]string)
+
+	// vCPUs
+	if cpuCount != 0 && cpuCount != vm.Config.CPUCount {
+		if cpuCount > maxCPU {
+			log.Warningf("%d vCPUs requested, VM max is %d, raising max", cpuCount, maxCPU)
+			err = domain.SetVcpusFlags(uint(cpuCount), libvirt.DOMAIN_VCPU_MAXIMUM|libvirt.DOMAIN_VCPU_CONFIG)
+			if err != nil {
+				return fmt.Errorf("setting max vCPUs: %s", err)
+			}
+			restartNeeded = restartNeeded || running
+			vm.Config.CPUCountMax = cpuCount
+			settings["cpu_count_max"] = strconv.Itoa(cpuCount)
+		} else if running {
+			errL := domain.SetVcpusFlags(uint(cpuCount), libvirt.DOMAIN_VCPU_LIVE)
+			if errL != nil {
+				log.Warningf("unable to change vCPUs live: %s", errL)
+				restartNeeded = true
+			} else {
+				log.Infof("vCPUs: %d → %d (live)", vm.Config.CPUCount, cpuCount)
+				guestUpdate = true
+			}
+		}
+
+		err = domain.SetVcpusFlags(uint(cpuCount), libvirt.DOMAIN_VCPU_CONFIG)
+		if err != nil {
+			return fmt.Errorf("setting vCPUs: %s", err)
+		}
+		vm.Config.CPUCount = cpuCount
+		settings["cpu_count"] = strconv.Itoa(cpuCount)
+	}
+
+	// RAM
+	if ramSize != 0 && ramSize != vm.Config.RAMSize {
+		ramKiB := ramSize / 1024
+		if ramSize > maxRAM {
+			log.Warningf("%s of RAM requested, VM max is %s, raising max",
+				(datasize.ByteSize(ramSize) * datasize.B).HR(),
+				(datasize.ByteSize(maxRAM) * datasize.B).HR())
+			err = domain.SetMemoryFlags(ramKiB, libvirt.DOMAIN_MEM_MAXIMUM|libvirt.DOMAIN_MEM_CONFIG)
+			if err != nil {
+				return fmt.Errorf("setting max RAM: %s", err)
+			}
+			restartNeeded = restartNeeded || running
+			vm.Config.RAMSizeMax = ramSize
+			settings["ram_size_max"] = vmResizeSizeSetting(ramSize)
+		} else if running {
+			errL := domain.SetMemoryFlags(ramKiB, libvirt.DOMAIN_MEM_LIVE)
+			if errL != nil {
+				log.Warningf("unable to change RAM live: %s", errL)
+				restartNeeded = true
+			} else {
+				log.Infof("RAM: %s → %s (live)",
+					(datasize.ByteSize(vm.Config.RAMSize) * datasize.B).HR(),
+					(datasize.ByteSize(ramSize) * datasize.B).HR())
+			}
+		}
+
+		err = domain.SetMemoryFlags(ramKiB, libvirt.DOMAIN_MEM_CONFIG)
+		if err != nil {
+			return fmt.Errorf("setting RAM: %s", err)
+		}
+		vm.Config.RAMSize = ramSize
+		settings["ram_size"] = vmResizeSizeSetting(ramSize)
+	}
+
+	// system disk (grow only)
+	if diskSize != 0 && diskSize != vm.Config.DiskSize {
+		target := ""
+		diskName := ""
+		for _, disk := range domcfg.Devices.Disks {
+			if disk.Alias != nil && disk.Alias.Name == VMStorageAliasDisk {
+				target = disk.Target.Dev
+				diskName = path.Base(disk.Source.File.File)
+			}
+		}
+		if diskName == "" {
+			return errors.New("unable to find VM system disk")
+		}
+
+		if running {
+			err = domain.BlockResize(target, diskSize, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+			guestUpdate = true
+		} else {
+			err = app.Libvirt.ResizeDisk(diskName, diskSize, app.Libvirt.Pools.Disks, log)
+			log.Info("filesystem will be grown by cloud-init on next start")
+		}
+		if err != nil {
+			return fmt.Errorf("resizing disk: %s", err)
+		}
+		log.Infof("disk: %s → %s",
+			(datasize.ByteSize(vm.Config.DiskSize) * datasize.B).HR(),
+			(datasize.ByteSize(diskSize) * datasize.B).HR())
+
+		vm.Config.DiskSize = diskSize
+		settings["disk_size"] = vmResizeSizeSetting(diskSize)
+	}
+
+	if len(settings) == 0 {
+		log.Info("nothing to resize")
+		return nil
+	}
+
+	// update config file and history, before any in-guest failure
+	for key, value := range settings {
+		vm.Config.setSetting(key, value)
+	}
+	vm.LastConfigUpdate = time.Now()
+
+	vm.Config.Version, err = app.ConfigHistory.Add(vm.Config.Name, vm.Config, authorKey, "resize")
+	if err != nil {
+		log.Errorf("unable to save config history: %s", err)
+	}
+
+	err = app.VMDB.Update()
+	if err != nil {
+		return err
+	}
+
+	if guestUpdate {
+		err = vmResizeGuest(vm, app, log)
+		if err != nil {
+			return err
+		}
+	}
+
+	if restartNeeded {
+		log.Warning("some changes will only be applied on next VM start (see 'vm stop' and 'vm start')")
+	}
+
+	return nil
+}
+
+// run resize.sh template in the VM (onlines vCPUs, grows root FS)
+func vmResizeGuest(vm *VM, app *App, log *Log) error {
+	script, err := os.Open(app.Config.GetTemplateFilepath("resize.sh"))
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+
+	SSHSuperUserAuth, err := app.SSHPairDB.GetPublicKeyAuth(SSHSuperUserPair)
+	if err != nil {
+		return err
+	}
+
+	run := &Run{
+		Caption: "resize",
+		SSHConn: &SSHConnection{
+			User: app.Config.MulchSuperUser,
+			Host: vm.LastIP,
+			Port: 22,
+			Auths: []ssh.AuthMethod{
+				SSHSuperUserAuth,
+			},
+			Log: log,
+		},
+		Tasks: []*RunTask{
+			{
+				ScriptName:   "resize.sh",
+				ScriptReader: script,
+				As:           app.Config.MulchSuperUser,
+			},
+		},
+		Log: log,
+	}
+	return run.Go()
+}
+
+func vmResizeSizeSetting(size uint64) string {
+	return strconv.Quote((datasize.ByteSize(size) * datasize.B).String())
+}
+
+// matches a table header ("[limits]", "[[do-actions]]"), but not an
+// inline array line of a multi-line array ("["A", "1"],")
+var vmConfigTableHeaderRe = regexp.MustCompile(`(?m)^[ \t]*\[\[?[ \t]*[A-Za-z0-9_.-]+[ \t]*\]\]?[ \t]*(#.*)?$`)
+
+// setSetting updates (or adds) a top-level scalar setting in the config
+// file content (and expanded content), so the next rebuild uses it.
+// Only the top-level part of the file (before the first table) is
+// searched, so a same-named key in a table is left untouched.
+// Settings of the main file win over includes, see vmConfigExpand.
+func (conf *VMConfig) setSetting(key string, value string) {
+	re := regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(key) + `[ \t]*=.*$`)
+	line := key + " = " + value
+
+	set := func(content string) string {
+		top, tables := content, ""
+		if loc := vmConfigTableHeaderRe.FindStringIndex(content); loc != nil {
+			top, tables = content[:loc[0]], content[loc[0]:]
+		}
+		if loc := re.FindStringIndex(top); loc != nil {
+			return top[:loc[0]] + line + top[loc[1]:] + tables
+		}
+		return line + "\n" + content
+	}
+
+	if conf.ExpandedContent == conf.FileContent {
+		conf.FileContent = set(conf.FileContent)
+		conf.ExpandedContent = conf.FileContent
+		return
+	}
+	conf.FileContent = set(conf.FileContent)
+	conf.ExpandedContent = set(conf.ExpandedContent)
+}
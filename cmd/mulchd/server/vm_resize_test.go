@@ -0,0 +1,97 @@
+package server
+
+import "testing"
+
+func TestVMConfigSetSetting(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		key     string
+		value   string
+		want    string
+	}{
+		{
+			name:    "update",
+			content: "name = \"test\"\nram_size = \"1G\"\ncpu_count = 1\n",
+			key:     "ram_size",
+			value:   `"2.0GB"`,
+			want:    "name = \"test\"\nram_size = \"2.0GB\"\ncpu_count = 1\n",
+		},
+		{
+			name:    "update, with spaces and comment",
+			content: "  cpu_count=1 # one CPU\nname = \"test\"\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count = 2\nname = \"test\"\n",
+		},
+		{
+			name:    "add when missing",
+			content: "name = \"test\"\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count = 2\nname = \"test\"\n",
+		},
+		{
+			name:    "commented setting is not updated",
+			content: "#cpu_count = 4\nname = \"test\"\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count = 2\n#cpu_count = 4\nname = \"test\"\n",
+		},
+		{
+			name:    "longer key with the same prefix",
+			content: "cpu_count_max = 4\ncpu_count = 1\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count_max = 4\ncpu_count = 2\n",
+		},
+		{
+			name:    "key in a table is left untouched",
+			content: "name = \"test\"\n\n[limits]\ncpu_count = 1\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count = 2\nname = \"test\"\n\n[limits]\ncpu_count = 1\n",
+		},
+		{
+			name:    "top-level key before tables and multi-line arrays",
+			content: "env = [\n    [\"A\", \"1\"],\n]\ndisk_size = \"20G\"\n\n[[do-actions]]\n  disk_size = \"1G\"\n",
+			key:     "disk_size",
+			value:   `"30.0GB"`,
+			want:    "env = [\n    [\"A\", \"1\"],\n]\ndisk_size = \"30.0GB\"\n\n[[do-actions]]\n  disk_size = \"1G\"\n",
+		},
+		{
+			name:    "only the first occurrence",
+			content: "cpu_count = 1\ncpu_count = 3\n",
+			key:     "cpu_count",
+			value:   "2",
+			want:    "cpu_count = 2\ncpu_count = 3\n",
+		},
+	}
+
+	for _, test := range tests {
+		conf := &VMConfig{
+			FileContent:     test.content,
+			ExpandedContent: test.content,
+		}
+		conf.setSetting(test.key, test.value)
+		if conf.FileContent != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, conf.FileContent, test.want)
+		}
+		if conf.ExpandedContent != conf.FileContent {
+			t.Errorf("%s: expanded content differs: %q", test.name, conf.ExpandedContent)
+		}
+	}
+
+	// with includes, both contents are updated independently
+	conf := &VMConfig{
+		FileContent:     "include = [\"base.toml\"]\n",
+		ExpandedContent: "# expanded config\n\nram_size = \"1GB\"\n",
+	}
+	conf.setSetting("ram_size", `"2.0GB"`)
+	if want := "ram_size = \"2.0GB\"\ninclude = [\"base.toml\"]\n"; conf.FileContent != want {
+		t.Errorf("includes: got %q, want %q", conf.FileContent, want)
+	}
+	if want := "# expanded config\n\nram_size = \"2.0GB\"\n"; conf.ExpandedContent != want {
+		t.Errorf("includes: got %q, want %q", conf.ExpandedContent, want)
+	}
+}
@@ -6,14 +6,30 @@ import "net/http/httputil"
 type Domain struct {
 	Name            string
 	VMName          string
+	VMBaseName      string // VM name, without revision
 	RedirectTo      string
 	RedirectCode    int
 	DestinationHost string
 	DestinationPort int
 	RedirectToHTTPS bool
+	Maintenance     bool
+	Canaries        []*DomainCanary
 
 	// used internaly by Mulch reverse proxy server
 	ReverseProxy *httputil.ReverseProxy `json:"-"`
 	TargetURL    string
 	Chained      bool
 }
+
+// DomainCanary is another VM revision receiving a part (Weight %) of
+// the domain traffic
+type DomainCanary struct {
+	VMName          string
+	DestinationHost string
+	DestinationPort int
+	Weight          int
+
+	// used internaly by Mulch reverse proxy server
+	ReverseProxy *httputil.ReverseProxy `json:"-"`
+	TargetURL    string
+}
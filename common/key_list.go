@@ -6,4 +6,5 @@ type APIKeyListEntries []APIKeyListEntry
 // APIKeyListEntry is an entry for a backup
 type APIKeyListEntry struct {
 	Comment string
+	Project string
 }
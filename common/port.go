@@ -0,0 +1,37 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Port protocols
+const (
+	PortProtocolTCP = "tcp"
+	PortProtocolUDP = "udp"
+)
+
+// Port defines a published TCP/UDP port, forwarded by mulch-proxy
+// from the host to a VM
+type Port struct {
+	PublicPort      int
+	Protocol        string
+	AllowFrom       string // source IP or CIDR (optional)
+	VMName          string
+	DestinationHost string
+	DestinationPort int
+}
+
+// Key returns the host side identifier of the port ("25/tcp")
+func (port *Port) Key() string {
+	return strconv.Itoa(port.PublicPort) + "/" + port.Protocol
+}
+
+// String returns the port in VM config format ("2525:25/tcp->1.2.3.4")
+func (port *Port) String() string {
+	str := fmt.Sprintf("%d:%d/%s", port.PublicPort, port.DestinationPort, port.Protocol)
+	if port.AllowFrom != "" {
+		str += "->" + port.AllowFrom
+	}
+	return str
+}
@@ -0,0 +1,15 @@
+package common
+
+// APIQuota describes quota and usage of an API key (zero max = unlimited)
+type APIQuota struct {
+	Key        string
+	VMs        int
+	CPUs       int
+	CPUsMax    int
+	RAMMB      int
+	RAMMBMax   int
+	DiskMB     int
+	DiskMBMax  int
+	Backups    int
+	BackupsMax int
+}
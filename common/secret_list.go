@@ -0,0 +1,15 @@
+package common
+
+import "time"
+
+// APISecretListEntries is a list of entries for "secret list" command
+type APISecretListEntries []APISecretListEntry
+
+// APISecretListEntry is an entry for a secret (the value is never sent)
+type APISecretListEntry struct {
+	Name      string
+	Project   string
+	Modified  time.Time
+	AuthorKey string
+	UsedBy    []string
+}
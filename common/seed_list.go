@@ -11,4 +11,6 @@ type APISeedListEntry struct {
 	Ready        bool
 	Size         uint64
 	LastModified time.Time
+	Parent       string
+	UsedBy       []string
 }
@@ -4,12 +4,19 @@ import "time"
 
 // APISeedStatus expose seed informations
 type APISeedStatus struct {
-	Name       string
-	File       string
-	Ready      bool
-	URL        string
-	Seeder     string
-	Size       uint64
-	StatusTime time.Time
-	Status     string
+	Name         string
+	File         string
+	Ready        bool
+	URL          string
+	Seeder       string
+	Size         uint64
+	SHA256       string
+	Versions     []string
+	Parent       string
+	UsedBy       []string
+	Uploaded     bool
+	AuthorKey    string
+	UploadOffset int64
+	StatusTime   time.Time
+	Status       string
 }
@@ -35,6 +35,7 @@ type APIStatus struct {
 	FreeBackupMB       int
 	ProvisionedDisksMB int
 	AllocatedDisksMB   int
+	GitDeployKey       string
 	SSHConnections     []APISSHConnection
 	Operations         []APIOperation
 }
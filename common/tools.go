@@ -90,7 +90,9 @@ func StringExpandVariables(str string, variables map[string]interface{}) string
 	for _, v := range vars {
 		if val, exists := variables[v]; exists == true {
 			re := regexp.MustCompile("\\$" + v + "(" + stringWordSeparators + "|$)")
-			str = re.ReplaceAllString(str, InterfaceValueToString(val)+"${1}")
+			// "$" in values must not be expanded by the regexp
+			value := strings.Replace(InterfaceValueToString(val), "$", "$$", -1)
+			str = re.ReplaceAllString(str, value+"${1}")
 		}
 	}
 	return str
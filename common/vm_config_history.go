@@ -0,0 +1,16 @@
+package common
+
+import "time"
+
+// APIVMConfigVersionEntries is a list of config versions for
+// "vm config history" command
+type APIVMConfigVersionEntries []APIVMConfigVersionEntry
+
+// APIVMConfigVersionEntry is a version of a VM config
+type APIVMConfigVersionEntry struct {
+	Version   int
+	Date      time.Time
+	AuthorKey string
+	Message   string
+	Current   bool
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // APIVMDoListEntries is a list of actions for "do" command
 type APIVMDoListEntries []APIVMDoListEntry
 
@@ -8,4 +10,18 @@ type APIVMDoListEntry struct {
 	Name        string
 	User        string
 	Description string
+	Schedule    string
+}
+
+// APIVMDoHistoryEntries is a list of past runs of a "do" action
+type APIVMDoHistoryEntries []APIVMDoHistoryEntry
+
+// APIVMDoHistoryEntry is a past run of a "do" action
+type APIVMDoHistoryEntry struct {
+	Start      time.Time
+	Duration   time.Duration
+	Scheduled  bool
+	ExitStatus int
+	Error      string
+	Output     string
 }
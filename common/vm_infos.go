@@ -6,6 +6,7 @@ import "time"
 type APIVMInfos struct {
 	Name                string
 	Revision            int
+	Project             string
 	Active              bool
 	Up                  bool
 	Seed                string
@@ -16,6 +17,7 @@ type APIVMInfos struct {
 	BackupDiskSizeMB    uint64
 	Hostname            string
 	Domains             []string
+	Ports               []string
 	SuperUser           string
 	AppUser             string
 	InitDate            time.Time
@@ -24,5 +26,7 @@ type APIVMInfos struct {
 	AuthorKey           string
 	Locked              bool
 	AssignedIPv4        string
+	AssignedIPv6        string
 	AssignedMAC         string
+	Limits              []string
 }
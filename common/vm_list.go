@@ -14,6 +14,8 @@ type APIVMListEntry struct {
 	WIP       string
 	SuperUser string
 	AppUser   string
+	Health    string
+	Canary    int
 }
 
 // APIVMBasicListEntries is a light variant of APIVMListEntries
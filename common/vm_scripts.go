@@ -0,0 +1,17 @@
+package common
+
+import "time"
+
+// APIVMScriptEntries is a list of script revisions for "vm scripts" command
+type APIVMScriptEntries []APIVMScriptEntry
+
+// APIVMScriptEntry is the exact revision of a script run in a VM
+type APIVMScriptEntry struct {
+	Step   string
+	URL    string
+	As     string
+	SHA256 string
+	Commit string
+	Pinned bool
+	Date   time.Time
+}
@@ -4,6 +4,8 @@
 # TYPE ("GOOD" / "BAD")
 # SUBJECT
 # CONTENT
+# PROJECT (optional, VM project)
+# RECIPIENTS (optional, project alert_recipients, comma separated)
 # Variables content is as harmless as possible: no (single/double) quotes, $, …
 
 hook_url="https://hooks.slack.com/services/xxx"
@@ -0,0 +1,40 @@
+#!/bin/bash
+
+# run by mulchd after an online resize: bring hotplugged vCPUs online
+# and grow the root filesystem (if its disk was enlarged)
+
+for cpu in /sys/devices/system/cpu/cpu[0-9]*/online; do
+    if [ "$(cat "$cpu")" = "0" ]; then
+        echo 1 | sudo tee "$cpu" > /dev/null
+    fi
+done
+echo "online CPUs: $(nproc)"
+
+root=$(findmnt -n -o SOURCE /)
+fstype=$(findmnt -n -o FSTYPE /)
+part=$(cat "/sys/class/block/$(basename "$root")/partition" 2> /dev/null)
+
+if [ -n "$part" ]; then
+    disk="/dev/$(lsblk -n -o PKNAME "$root" | head -n 1)"
+    sudo growpart "$disk" "$part"
+    # growpart returns 1 when there's nothing to do
+    if [ $? -gt 1 ]; then
+        >&2 echo "unable to grow partition $part on $disk"
+        exit 10
+    fi
+fi
+
+case "$fstype" in
+    ext*)
+        sudo resize2fs "$root" || exit $?
+        ;;
+    xfs)
+        sudo xfs_growfs / || exit $?
+        ;;
+    *)
+        >&2 echo "unsupported root filesystem '$fstype'"
+        exit 11
+        ;;
+esac
+
+df -h /
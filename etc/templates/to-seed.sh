@@ -0,0 +1,22 @@
+#!/bin/bash
+
+# Generalization of a VM disk captured with "vm to-seed". This script
+# runs inside the (offline) image, using virt-customize.
+# (user name variables are expanded by mulchd)
+
+cloud-init clean --logs || exit $?
+
+# regenerated on first boot
+rm -f /etc/ssh/ssh_host_*
+truncate -s 0 /etc/machine-id
+rm -f /var/lib/dbus/machine-id
+
+# Mulch users, keys and settings are created again by cloud-init
+userdel -r -f $_APP_USER 2> /dev/null
+userdel -r -f $_MULCH_SUPER_USER 2> /dev/null
+groupdel mulcher 2> /dev/null
+rm -f /etc/sudoers.d/90-cloud-init-users
+rm -f /root/.ssh/authorized_keys
+rm -f /etc/mulch.env /etc/mulch-secrets.env /etc/profile.d/mulch-env.sh
+
+rm -f /root/.bash_history /home/*/.bash_history
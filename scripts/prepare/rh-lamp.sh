@@ -142,7 +142,7 @@ file="/home/$_MULCH_SUPER_USER/.httpd_env"
 sudo bash -c "cat > $http_env" <<- EOS
 #!/bin/bash
 echo "# generated, do not modify" > $file
-grep ^export /etc/mulch.env | sed 's/; /\n/g' | sed 's/^export //' >> $file
+cat /etc/mulch.env /etc/mulch-secrets.env 2>/dev/null | grep ^export | sed 's/; /\n/g' | sed 's/^export //' >> $file
 cat "/home/$_APP_USER/env" >> $file
 EOS
 [ $? -eq 0 ] || exit $?